@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// envPrefix 环境变量的前缀，比如 Web.APIHost 对应 CHAT_WEB_APIHOST
+const envPrefix = "CHAT"
+
+// defaultConfigFile 没有指定 --config 时读取的配置文件，不存在时使用默认配置
+const defaultConfigFile = "./zarf/config/config.yaml"
+
+// config 服务的所有配置
+// 优先级从高到低：命令行参数、环境变量、配置文件、默认值
+type config struct {
+	Version struct {
+		Build string
+		Desc  string
+	}
+	Web struct {
+		ReadTimeout          time.Duration
+		WriteTimeout         time.Duration
+		IdleTimeout          time.Duration
+		ShutdownTimeout      time.Duration
+		ShutdownDrain        time.Duration
+		APIHost              string
+		DebugHost            string
+		GRPCHost             string
+		TrustedProxies       []string
+		CORSAllowedOrigins   []string
+		CORSAllowCredentials bool
+		CORSAllowedHeaders   []string
+		CORSExposedHeaders   []string
+		CORSMaxAge           time.Duration
+		TLSCertFile          string
+		TLSKeyFile           string
+		TLSClientCAFile      string
+		TLSClientAuth        string
+		RedirectHost         string
+	}
+	Admin struct {
+		Token string
+	}
+	Auth struct {
+		TokenSecret string
+		TokenTTL    time.Duration
+	}
+	Tracing struct {
+		ServiceName  string
+		Exporter     string
+		OTLPEndpoint string
+		Probability  float64
+	}
+	RateLimit struct {
+		HTTPRate        float64
+		HTTPBurst       int
+		MessageRate     float64
+		MessageBurst    int
+		MaxViolations   int
+		ViolationWindow time.Duration
+	}
+	Chat struct {
+		MaxFrameSize         int64
+		MaxMessageLength     int
+		MaxNameLength        int
+		SendQueueSize        int
+		MaxConnections       int
+		Compression          bool
+		CompressionLevel     int
+		CompressionThreshold int
+		HandshakeTimeout     time.Duration
+		PingInterval         time.Duration
+		WriteWait            time.Duration
+		IdleTimeout          time.Duration
+		MessageTTL           time.Duration
+		ResumeWindow         time.Duration
+		ResumeBuffer         int
+	}
+	Log struct {
+		Level            string
+		Components       map[string]string
+		Encoding         string
+		Stdout           bool
+		InfoFile         string
+		ErrorFile        string
+		MaxSize          int
+		MaxBackups       int
+		MaxAge           int
+		Compress         bool
+		SampleMessages   []string
+		SampleInitial    int
+		SampleThereafter int
+	}
+	Moderation struct {
+		Words          []string
+		RejectWords    bool
+		Patterns       []string
+		PatternAction  string
+		BlockLinks     bool
+		AllowedDomains []string
+		QuarantineSize int
+	}
+}
+
+// setting 一个配置项，默认值的类型决定命令行参数的类型
+// reload 为 true 的配置项在配置文件变化或者收到 SIGHUP 时立即生效，其他的需要重启
+type setting struct {
+	key    string
+	def    any
+	usage  string
+	secret bool
+	reload bool
+}
+
+// chatDefaults 聊天服务的默认配置，与 chattest 使用同一份
+var chatDefaults = chat.DefaultConfig()
+
+// settings 所有的配置项，用于设置默认值、绑定命令行参数和环境变量以及输出 --help
+// 新增配置时需要同时在 config 中添加字段
+var settings = []setting{
+	{key: "Web.ReadTimeout", def: 5 * time.Second, usage: "读取请求的超时时间"},
+	{key: "Web.WriteTimeout", def: 10 * time.Second, usage: "写入响应的超时时间"},
+	{key: "Web.IdleTimeout", def: 120 * time.Second, usage: "keep-alive 连接的空闲超时时间"},
+	{key: "Web.ShutdownTimeout", def: 20 * time.Second, usage: "优雅关闭的超时时间"},
+	{key: "Web.ShutdownDrain", def: 5 * time.Second, usage: "就绪检查失败后等待负载均衡器摘除实例的时间"},
+	{key: "Web.APIHost", def: "0.0.0.0:9000", usage: "API 监听地址"},
+	{key: "Web.DebugHost", def: "0.0.0.0:9010", usage: "调试和管理接口监听地址"},
+	{key: "Web.GRPCHost", def: "", usage: "供内部服务使用的 gRPC 接口监听地址，与 websocket 共用聊天的注册表，设置了证书时使用同样的 TLS 配置，为空时不启动"},
+	{key: "Web.TrustedProxies", def: []string{}, usage: "信任的反向代理的 IP 或者 CIDR，只有来自这些地址的请求才使用 X-Forwarded-For 作为客户端 IP，为空时使用连接的地址"},
+	{key: "Web.CORSAllowedOrigins", def: []string{"*"}, usage: "允许跨域请求和 websocket 握手的来源，支持 https://*.example.com 匹配子域名", reload: true},
+	{key: "Web.CORSAllowCredentials", def: false, usage: "允许跨域请求携带 cookie 和 Authorization 等凭证"},
+	{key: "Web.CORSAllowedHeaders", def: []string{"Authorization", "Content-Type", "traceparent", "X-Request-ID"}, usage: "预检请求允许的请求头"},
+	{key: "Web.CORSExposedHeaders", def: []string{"X-Request-ID"}, usage: "浏览器中的脚本可以读取的响应头"},
+	{key: "Web.CORSMaxAge", def: 10 * time.Minute, usage: "浏览器缓存预检结果的时间，为 0 时不设置"},
+	{key: "Web.TLSCertFile", def: "", usage: "API 的证书文件，设置后 API 使用 HTTPS，文件更新后自动重新读取"},
+	{key: "Web.TLSKeyFile", def: "", usage: "API 证书的私钥文件"},
+	{key: "Web.TLSClientCAFile", def: "", usage: "校验客户端证书的 CA 文件，设置后启用 mTLS，证书的 subject 决定聊天身份"},
+	{key: "Web.TLSClientAuth", def: "require", usage: "设置了 TLSClientCAFile 时的客户端证书要求：require 或 optional"},
+	{key: "Web.RedirectHost", def: "", usage: "把 HTTP 请求重定向到 HTTPS 的监听地址，为空时不启动"},
+
+	{key: "Admin.Token", def: "", usage: "管理接口的 token，为空时禁用管理接口", secret: true},
+
+	{key: "Auth.TokenSecret", def: "", usage: "签发和校验用户 token 的密钥，为空时只能使用客户端证书访问 /v1 接口", secret: true},
+	{key: "Auth.TokenTTL", def: 24 * time.Hour, usage: "管理接口签发的用户 token 的有效期"},
+
+	{key: "Tracing.ServiceName", def: "chat", usage: "span 中的服务名"},
+	{key: "Tracing.Exporter", def: "none", usage: "span 导出方式：none、stdout 或 otlp"},
+	{key: "Tracing.OTLPEndpoint", def: "http://localhost:4318/v1/traces", usage: "OTLP/HTTP 导出地址"},
+	{key: "Tracing.Probability", def: 1.0, usage: "采样比例，0 到 1"},
+
+	{key: "RateLimit.HTTPRate", def: 10.0, usage: "每个 IP 每秒允许的请求数", reload: true},
+	{key: "RateLimit.HTTPBurst", def: 20, usage: "每个 IP 允许的突发请求数", reload: true},
+	{key: "RateLimit.MessageRate", def: chatDefaults.MessageRate, usage: "每个用户每秒允许发送的消息数", reload: true},
+	{key: "RateLimit.MessageBurst", def: chatDefaults.MessageBurst, usage: "每个用户允许的突发消息数", reload: true},
+	{key: "RateLimit.MaxViolations", def: chatDefaults.MaxViolations, usage: "ViolationWindow 内超过限流的次数达到该值后断开连接，为 0 时不断开", reload: true},
+	{key: "RateLimit.ViolationWindow", def: chatDefaults.ViolationWindow, usage: "统计超过限流次数的时间窗口", reload: true},
+
+	{key: "Chat.MaxFrameSize", def: chatDefaults.MaxFrameSize, usage: "客户端单个帧的最大字节数"},
+	{key: "Chat.MaxMessageLength", def: chatDefaults.MaxMessageLength, usage: "消息文本的最大字符数", reload: true},
+	{key: "Chat.MaxNameLength", def: chatDefaults.MaxNameLength, usage: "用户名的最大字符数", reload: true},
+	{key: "Chat.SendQueueSize", def: chatDefaults.SendQueueSize, usage: "每个连接待发送队列的长度"},
+	{key: "Chat.MaxConnections", def: chatDefaults.MaxConnections, usage: "最大的在线连接数，为 0 时不限制", reload: true},
+	{key: "Chat.Compression", def: chatDefaults.Compression, usage: "客户端支持时使用 permessage-deflate 压缩"},
+	{key: "Chat.CompressionLevel", def: chatDefaults.CompressionLevel, usage: "压缩级别，-2 到 9，1 最快"},
+	{key: "Chat.CompressionThreshold", def: chatDefaults.CompressionThreshold, usage: "小于这个字节数的帧不压缩"},
+	{key: "Chat.HandshakeTimeout", def: chatDefaults.HandshakeTimeout, usage: "等待客户端发送身份的时间", reload: true},
+	{key: "Chat.PingInterval", def: chatDefaults.PingInterval, usage: "发送 ping 和检查空闲连接的间隔", reload: true},
+	{key: "Chat.WriteWait", def: chatDefaults.WriteWait, usage: "写入控制帧的超时时间", reload: true},
+	{key: "Chat.IdleTimeout", def: chatDefaults.IdleTimeout, usage: "没有发送消息的连接超过这段时间后断开，为 0 时不检查", reload: true},
+	{key: "Chat.MessageTTL", def: chatDefaults.MessageTTL, usage: "消息在待发送队列中的过期时间，为 0 时不过期", reload: true},
+	{key: "Chat.ResumeWindow", def: chatDefaults.ResumeWindow, usage: "开启断线续传的会话断开后保留的时间，为 0 时不支持断线续传", reload: true},
+	{key: "Chat.ResumeBuffer", def: chatDefaults.ResumeBuffer, usage: "断线续传时每个用户保留的最近的消息数"},
+
+	{key: "Log.Level", def: "info", usage: "全局日志级别", reload: true},
+	{key: "Log.Components", def: map[string]string{}, usage: "按组件设置日志级别，比如 chat=debug,http=warn", reload: true},
+	{key: "Log.Encoding", def: "console", usage: "日志格式：console 或 json"},
+	{key: "Log.Stdout", def: true, usage: "同时输出到标准输出"},
+	{key: "Log.InfoFile", def: "./logs/info.log", usage: "error 以下级别的日志文件，为空时不写文件"},
+	{key: "Log.ErrorFile", def: "./logs/error.log", usage: "error 及以上级别的日志文件，为空时不写文件"},
+	{key: "Log.MaxSize", def: 10, usage: "日志文件切割的大小，单位 MB"},
+	{key: "Log.MaxBackups", def: 100, usage: "保留的旧日志文件数量"},
+	{key: "Log.MaxAge", def: 28, usage: "旧日志文件保留的天数"},
+	{key: "Log.Compress", def: false, usage: "压缩旧日志文件"},
+	{key: "Log.SampleMessages", def: []string{"chat-readMessage"}, usage: "需要采样的日志消息"},
+	{key: "Log.SampleInitial", def: 10, usage: "每秒每条消息先输出的条数"},
+	{key: "Log.SampleThereafter", def: 100, usage: "之后每隔多少条输出一条"},
+
+	{key: "Moderation.Words", def: []string{}, usage: "屏蔽词", reload: true},
+	{key: "Moderation.RejectWords", def: false, usage: "包含屏蔽词的消息直接拒绝，否则替换为 *", reload: true},
+	{key: "Moderation.Patterns", def: []string{}, usage: "正则表达式规则", reload: true},
+	{key: "Moderation.PatternAction", def: "reject", usage: "命中正则表达式时的处理：reject 或 quarantine", reload: true},
+	{key: "Moderation.BlockLinks", def: false, usage: "拒绝包含链接的消息", reload: true},
+	{key: "Moderation.AllowedDomains", def: []string{}, usage: "BlockLinks 开启时允许的域名", reload: true},
+	{key: "Moderation.QuarantineSize", def: chat.DefaultQuarantineSize, usage: "内存中保存的等待审核的隔离消息数，超过时丢弃最旧的"},
+}
+
+// flagName 配置项对应的命令行参数，比如 Web.APIHost 对应 --web-apihost
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, ".", "-"))
+}
+
+// envName 配置项对应的环境变量，比如 Web.APIHost 对应 CHAT_WEB_APIHOST
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// =============================================================================
+
+// newViper 解析命令行参数，设置默认值并绑定环境变量和命令行参数
+// 指定 --help 时输出所有配置项并返回 pflag.ErrHelp
+func newViper(args []string) (*viper.Viper, error) {
+	flags := pflag.NewFlagSet("cap", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configFile := flags.String("config", defaultConfigFile, "配置文件路径")
+
+	for _, s := range settings {
+		name, usage := flagName(s.key), s.usage
+		switch def := s.def.(type) {
+		case string:
+			flags.String(name, def, usage)
+		case bool:
+			flags.Bool(name, def, usage)
+		case int:
+			flags.Int(name, def, usage)
+		case int64:
+			flags.Int64(name, def, usage)
+		case float64:
+			flags.Float64(name, def, usage)
+		case time.Duration:
+			flags.Duration(name, def, usage)
+		case []string:
+			flags.StringSlice(name, def, usage)
+		case map[string]string:
+			flags.StringToString(name, def, usage)
+		default:
+			return nil, fmt.Errorf("setting %s: unsupported default type %T", s.key, s.def)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			usage(os.Stdout)
+		}
+		return nil, err
+	}
+
+	v := viper.New()
+
+	for _, s := range settings {
+		v.SetDefault(s.key, s.def)
+		if err := v.BindPFlag(s.key, flags.Lookup(flagName(s.key))); err != nil {
+			return nil, err
+		}
+	}
+
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	// 默认的配置文件不存在时使用默认配置，指定的配置文件必须存在
+	// viper 的 SetConfigFile 会忽略空字符串，所以不使用配置文件时不能调用
+	v.SetConfigType("yaml")
+	if flags.Changed("config") || fileExists(*configFile) {
+		v.SetConfigFile(*configFile)
+	}
+
+	return v, nil
+}
+
+// loadConfig 读取配置文件并校验配置
+// 收到 SIGHUP 时也会调用，重新读取配置文件，命令行参数和环境变量保持不变
+func loadConfig(v *viper.Viper) (config, error) {
+	cfg := config{
+		Version: struct {
+			Build string
+			Desc  string
+		}{build, "sales service"},
+	}
+
+	if v.ConfigFileUsed() != "" {
+		if err := v.ReadInConfig(); err != nil {
+			return config{}, fmt.Errorf("read config file: %w", err)
+		}
+	}
+
+	// 环境变量中的 map 是字符串，比如 CHAT_LOG_COMPONENTS=chat=debug,http=warn
+	hook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		stringToMapHook,
+	))
+
+	if err := v.Unmarshal(&cfg, hook); err != nil {
+		return config{}, fmt.Errorf("unmarshal config: %w", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+// stringToMapHook 把 a=b,c=d 格式的字符串解析为 map[string]string
+func stringToMapHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(map[string]string{}) {
+		return data, nil
+	}
+
+	m := make(map[string]string)
+	for _, pair := range strings.Split(data.(string), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+	}
+
+	return m, nil
+}
+
+// validate 校验配置，返回所有不合法的配置项
+func (cfg config) validate() error {
+	var errs []error
+	check := func(ok bool, key string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	positive := func(key string, d time.Duration) {
+		check(d > 0, key, "must be positive, got %s", d)
+	}
+	address := func(key string, addr string) {
+		_, _, err := net.SplitHostPort(addr)
+		check(err == nil, key, "invalid address %q: %v", addr, err)
+	}
+	level := func(key string, l string) {
+		_, err := zapcore.ParseLevel(l)
+		check(err == nil, key, "invalid log level %q", l)
+	}
+
+	positive("Web.ReadTimeout", cfg.Web.ReadTimeout)
+	positive("Web.WriteTimeout", cfg.Web.WriteTimeout)
+	positive("Web.IdleTimeout", cfg.Web.IdleTimeout)
+	positive("Web.ShutdownTimeout", cfg.Web.ShutdownTimeout)
+	check(cfg.Web.ShutdownDrain >= 0, "Web.ShutdownDrain", "must not be negative, got %s", cfg.Web.ShutdownDrain)
+	address("Web.APIHost", cfg.Web.APIHost)
+	address("Web.DebugHost", cfg.Web.DebugHost)
+	if cfg.Web.GRPCHost != "" {
+		address("Web.GRPCHost", cfg.Web.GRPCHost)
+	}
+	for _, p := range cfg.Web.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(p)
+		check(net.ParseIP(p) != nil || cidrErr == nil, "Web.TrustedProxies", "invalid IP or CIDR %q", p)
+	}
+
+	if err := origin.Validate(cfg.Web.CORSAllowedOrigins); err != nil {
+		check(false, "Web.CORSAllowedOrigins", "%v", err)
+	}
+	check(cfg.Web.CORSMaxAge >= 0, "Web.CORSMaxAge", "must not be negative, got %s", cfg.Web.CORSMaxAge)
+
+	useTLS := cfg.Web.TLSCertFile != ""
+	check(useTLS == (cfg.Web.TLSKeyFile != ""), "Web.TLSKeyFile", "TLSCertFile and TLSKeyFile must be set together")
+	check(useTLS || cfg.Web.TLSClientCAFile == "", "Web.TLSClientCAFile", "requires TLSCertFile and TLSKeyFile")
+	check(cfg.Web.TLSClientAuth == "require" || cfg.Web.TLSClientAuth == "optional", "Web.TLSClientAuth", "must be require or optional, got %q", cfg.Web.TLSClientAuth)
+	if cfg.Web.RedirectHost != "" {
+		check(useTLS, "Web.RedirectHost", "requires TLSCertFile and TLSKeyFile")
+		address("Web.RedirectHost", cfg.Web.RedirectHost)
+	}
+
+	positive("Auth.TokenTTL", cfg.Auth.TokenTTL)
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		check(false, "Tracing.Exporter", "must be none, stdout or otlp, got %q", cfg.Tracing.Exporter)
+	}
+	check(cfg.Tracing.Probability >= 0 && cfg.Tracing.Probability <= 1, "Tracing.Probability", "must be between 0 and 1, got %v", cfg.Tracing.Probability)
+
+	check(cfg.RateLimit.HTTPRate > 0, "RateLimit.HTTPRate", "must be positive, got %v", cfg.RateLimit.HTTPRate)
+	check(cfg.RateLimit.HTTPBurst >= 1, "RateLimit.HTTPBurst", "must be at least 1, got %d", cfg.RateLimit.HTTPBurst)
+	check(cfg.RateLimit.MessageRate > 0, "RateLimit.MessageRate", "must be positive, got %v", cfg.RateLimit.MessageRate)
+	check(cfg.RateLimit.MessageBurst >= 1, "RateLimit.MessageBurst", "must be at least 1, got %d", cfg.RateLimit.MessageBurst)
+	check(cfg.RateLimit.MaxViolations >= 0, "RateLimit.MaxViolations", "must not be negative, got %d", cfg.RateLimit.MaxViolations)
+	positive("RateLimit.ViolationWindow", cfg.RateLimit.ViolationWindow)
+
+	check(cfg.Chat.MaxFrameSize > 0, "Chat.MaxFrameSize", "must be positive, got %d", cfg.Chat.MaxFrameSize)
+	check(cfg.Chat.MaxMessageLength > 0, "Chat.MaxMessageLength", "must be positive, got %d", cfg.Chat.MaxMessageLength)
+	check(cfg.Chat.MaxNameLength > 0, "Chat.MaxNameLength", "must be positive, got %d", cfg.Chat.MaxNameLength)
+	check(cfg.Chat.SendQueueSize > 0, "Chat.SendQueueSize", "must be positive, got %d", cfg.Chat.SendQueueSize)
+	check(cfg.Chat.CompressionLevel >= -2 && cfg.Chat.CompressionLevel <= 9, "Chat.CompressionLevel", "must be between -2 and 9, got %d", cfg.Chat.CompressionLevel)
+	check(cfg.Chat.CompressionThreshold >= 0, "Chat.CompressionThreshold", "must not be negative, got %d", cfg.Chat.CompressionThreshold)
+	check(cfg.Chat.MaxConnections >= 0, "Chat.MaxConnections", "must not be negative, got %d", cfg.Chat.MaxConnections)
+	positive("Chat.HandshakeTimeout", cfg.Chat.HandshakeTimeout)
+	positive("Chat.PingInterval", cfg.Chat.PingInterval)
+	positive("Chat.WriteWait", cfg.Chat.WriteWait)
+	check(cfg.Chat.IdleTimeout >= 0, "Chat.IdleTimeout", "must not be negative, got %s", cfg.Chat.IdleTimeout)
+	check(cfg.Chat.MessageTTL >= 0, "Chat.MessageTTL", "must not be negative, got %s", cfg.Chat.MessageTTL)
+	check(cfg.Chat.ResumeWindow >= 0, "Chat.ResumeWindow", "must not be negative, got %s", cfg.Chat.ResumeWindow)
+	check(cfg.Chat.ResumeBuffer > 0, "Chat.ResumeBuffer", "must be positive, got %d", cfg.Chat.ResumeBuffer)
+
+	level("Log.Level", cfg.Log.Level)
+	for component, l := range cfg.Log.Components {
+		level("Log.Components."+component, l)
+	}
+	check(cfg.Log.Encoding == "console" || cfg.Log.Encoding == "json", "Log.Encoding", "must be console or json, got %q", cfg.Log.Encoding)
+	check(cfg.Log.Stdout || cfg.Log.InfoFile != "" || cfg.Log.ErrorFile != "", "Log", "at least one of Stdout, InfoFile and ErrorFile is required")
+
+	check(cfg.Moderation.QuarantineSize > 0, "Moderation.QuarantineSize", "must be positive, got %d", cfg.Moderation.QuarantineSize)
+
+	// 屏蔽词和正则表达式由 chat.NewFilters 校验
+	if _, err := chat.NewFilters(cfg.moderation()); err != nil {
+		check(false, "Moderation", "%v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// moderation 返回内容审核的配置
+func (cfg config) moderation() chat.ModerationConfig {
+	return chat.ModerationConfig{
+		Words:          cfg.Moderation.Words,
+		RejectWords:    cfg.Moderation.RejectWords,
+		Patterns:       cfg.Moderation.Patterns,
+		PatternAction:  cfg.Moderation.PatternAction,
+		BlockLinks:     cfg.Moderation.BlockLinks,
+		AllowedDomains: cfg.Moderation.AllowedDomains,
+	}
+}
+
+// chatSettings 返回聊天服务可以在运行时修改的配置
+func (cfg config) chatSettings() (chat.Settings, error) {
+	filters, err := chat.NewFilters(cfg.moderation())
+	if err != nil {
+		return chat.Settings{}, fmt.Errorf("moderation filters: %w", err)
+	}
+
+	return chat.Settings{
+		MessageRate:      cfg.RateLimit.MessageRate,
+		MessageBurst:     cfg.RateLimit.MessageBurst,
+		MaxViolations:    cfg.RateLimit.MaxViolations,
+		ViolationWindow:  cfg.RateLimit.ViolationWindow,
+		MaxMessageLength: cfg.Chat.MaxMessageLength,
+		MaxNameLength:    cfg.Chat.MaxNameLength,
+		MaxConnections:   cfg.Chat.MaxConnections,
+		Filters:          filters,
+		HandshakeTimeout: cfg.Chat.HandshakeTimeout,
+		PingInterval:     cfg.Chat.PingInterval,
+		WriteWait:        cfg.Chat.WriteWait,
+		IdleTimeout:      cfg.Chat.IdleTimeout,
+		MessageTTL:       cfg.Chat.MessageTTL,
+		ResumeWindow:     cfg.Chat.ResumeWindow,
+	}, nil
+}
+
+// clientAuth 返回设置了 TLSClientCAFile 时对客户端证书的要求
+func (cfg config) clientAuth() tls.ClientAuthType {
+	if cfg.Web.TLSClientAuth == "optional" {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
+// redacted 返回隐藏了敏感配置的副本，用于输出日志
+func (cfg config) redacted() config {
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = "******"
+	}
+	if cfg.Auth.TokenSecret != "" {
+		cfg.Auth.TokenSecret = "******"
+	}
+	return cfg
+}
+
+// =============================================================================
+
+// usage 输出所有配置项的命令行参数、环境变量和默认值
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: cap [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "优先级从高到低：命令行参数、环境变量、配置文件、默认值。")
+	fmt.Fprintf(w, "配置文件的 key 与下面的 KEY 相同，默认读取 %s。\n", defaultConfigFile)
+	fmt.Fprintln(w, "RELOAD 为 yes 的配置项在配置文件变化或者收到 SIGHUP 时立即生效，其他的需要重启。")
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tFLAG\tENV\tDEFAULT\tRELOAD\tDESCRIPTION")
+	fmt.Fprintf(tw, "\t--config\t\t%s\t\t配置文件路径\n", defaultConfigFile)
+	for _, s := range settings {
+		def := fmt.Sprint(s.def)
+		switch d := s.def.(type) {
+		case []string:
+			def = strings.Join(d, ",")
+		case map[string]string:
+			def = ""
+		}
+		if s.secret {
+			def = "(secret)"
+		}
+		reload := ""
+		if s.reload {
+			reload = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t--%s\t%s\t%s\t%s\t%s\n", s.key, flagName(s.key), envName(s.key), def, reload, s.usage)
+	}
+	tw.Flush()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -2,14 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/zhangpetergo/chat/chat/app/domain/grpcapp"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
 	"github.com/zhangpetergo/chat/chat/app/sdk/mux"
+	"github.com/zhangpetergo/chat/chat/foundation/certs"
 	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,100 +33,196 @@ import (
 var build = "develop"
 
 func main() {
+	v, err := newViper(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
+	}
 
 	// 初始化日志
-	logger.InitLogger()
+	levels, err := logger.NewLevels(cfg.Log.Level, cfg.Log.Components)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logger:", err)
+		os.Exit(1)
+	}
+
+	log, err := logger.New(logger.Config{
+		Levels:           levels,
+		Encoding:         cfg.Log.Encoding,
+		Stdout:           cfg.Log.Stdout,
+		InfoFile:         cfg.Log.InfoFile,
+		ErrorFile:        cfg.Log.ErrorFile,
+		MaxSize:          cfg.Log.MaxSize,
+		MaxBackups:       cfg.Log.MaxBackups,
+		MaxAge:           cfg.Log.MaxAge,
+		Compress:         cfg.Log.Compress,
+		SampleMessages:   cfg.Log.SampleMessages,
+		SampleInitial:    cfg.Log.SampleInitial,
+		SampleThereafter: cfg.Log.SampleThereafter,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logger:", err)
+		os.Exit(1)
+	}
 
 	ctx := context.Background()
-	if err := run(ctx); err != nil {
-		logger.Log.Errorw("startup", "err", err)
+	if err := run(ctx, log, levels, v, cfg); err != nil {
+		log.Errorw("startup", "err", err)
+		log.Sync()
 		os.Exit(1)
 	}
+
+	// 确保日志缓冲区在程序退出时被刷新
+	log.Sync()
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, log *zap.SugaredLogger, levels *logger.Levels, v *viper.Viper, cfg config) error {
 
 	// -------------------------------------------------------------------------
 	// GOMAXPROCS
-	logger.Log.Infow("startup", "GOMAXPROCS", runtime.GOMAXPROCS(0))
+	log.Infow("startup", "GOMAXPROCS", runtime.GOMAXPROCS(0))
 
 	// -------------------------------------------------------------------------
-	// Configuration
-	cfg := struct {
-		Version struct {
-			Build string
-			Desc  string
-		}
-		Web struct {
-			ReadTimeout        time.Duration
-			WriteTimeout       time.Duration
-			IdleTimeout        time.Duration
-			ShutdownTimeout    time.Duration
-			APIHost            string
-			CORSAllowedOrigins []string
-		}
-	}{
-		Version: struct {
-			Build string
-			Desc  string
-		}{build, "sales service"},
-	}
-
-	// 设置配置默认值
-	// web
-	viper.SetDefault("Web.ReadTimeout", "5s")
-	viper.SetDefault("Web.WriteTimeout", "10s")
-	viper.SetDefault("Web.IdleTimeout", "120s")
-	viper.SetDefault("Web.ShutdownTimeout", "20s")
-	viper.SetDefault("Web.APIHost", "0.0.0.0:9000")
-	viper.SetDefault("Web.CORSAllowedOrigins", "*")
-
-	// 设置配置文件路径和名称
-	configPath := "./zarf/config"
-	configName := "config"
-
-	viper.AddConfigPath(configPath)
-	viper.SetConfigName(configName)
-	viper.SetConfigType("yaml")
-
-	// 检查文件是否存在
-	if _, err := os.Stat(configPath + "/" + configName + ".yaml"); err == nil {
-		// 文件存在，读取配置文件
-		if err := viper.ReadInConfig(); err != nil {
-			return err
-		}
-	} else if os.IsNotExist(err) {
-		// 文件不存在，使用默认配置
-	} else {
-		// 其他错误
-		return err
+	// App Starting
+
+	log.Infow("starting service", "version", cfg.Version.Build)
+	defer log.Info("shutdown complete")
+
+	log.Infow("startup", "config", cfg.redacted(), "configFile", v.ConfigFileUsed())
+	logger.BuildInfo(log)
+
+	// -------------------------------------------------------------------------
+	// Start Tracing Support
+
+	log.Infow("startup", "status", "initializing tracing support", "exporter", cfg.Tracing.Exporter)
+
+	var exporter tracer.Exporter
+	switch cfg.Tracing.Exporter {
+	case "none":
+	case "stdout":
+		exporter = tracer.NewStdoutExporter(os.Stdout)
+	case "otlp":
+		exporter = tracer.NewOTLPExporter(cfg.Tracing.OTLPEndpoint, nil, 5*time.Second)
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", cfg.Tracing.Exporter)
 	}
 
-	// 读取配置
-	err := viper.Unmarshal(&cfg)
+	trc := tracer.New(tracer.Config{
+		ServiceName: cfg.Tracing.ServiceName,
+		Probability: cfg.Tracing.Probability,
+		Exporter:    exporter,
+	})
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		trc.Shutdown(ctx)
+	}()
+
+	// -------------------------------------------------------------------------
+	// Chat Support
+
+	settings, err := cfg.chatSettings()
 	if err != nil {
-		// 解析配置失败
 		return err
 	}
 
+	// CORS 和 websocket 握手使用同一个允许的来源列表
+	origins, err := origin.New(cfg.Web.CORSAllowedOrigins)
+	if err != nil {
+		return fmt.Errorf("cors allowed origins: %w", err)
+	}
+
+	cht := chat.NewChat(log, chat.Config{
+		Settings:      settings,
+		MaxFrameSize:  cfg.Chat.MaxFrameSize,
+		SendQueueSize: cfg.Chat.SendQueueSize,
+		ResumeBuffer:  cfg.Chat.ResumeBuffer,
+		Tracer:        trc,
+		Origins:       origins,
+		Quarantine:    chat.NewMemoryQuarantine(cfg.Moderation.QuarantineSize),
+		ClientCerts:   cfg.Web.TLSCertFile != "" && cfg.Web.TLSClientCAFile != "",
+
+		Compression:          cfg.Chat.Compression,
+		CompressionLevel:     cfg.Chat.CompressionLevel,
+		CompressionThreshold: cfg.Chat.CompressionThreshold,
+	})
+	defer cht.Stop()
+
 	// -------------------------------------------------------------------------
-	// App Starting
+	// Auth Support
 
-	logger.Log.Infow("starting service", "version", cfg.Version.Build)
-	defer logger.Log.Info("shutdown complete")
+	if cfg.Auth.TokenSecret == "" {
+		log.Warnw("startup", "status", "token secret is empty, user tokens disabled")
+	}
 
-	logger.Log.Infow("startup", "config", cfg)
-	logger.BuildInfo()
+	authenticator := auth.New(auth.Config{
+		Secret: cfg.Auth.TokenSecret,
+		TTL:    cfg.Auth.TokenTTL,
+	})
+
+	// -------------------------------------------------------------------------
+	// Start Debug Service
+
+	if cfg.Admin.Token == "" {
+		log.Warnw("startup", "status", "admin token is empty, admin api disabled")
+	}
+
+	go func() {
+		log.Infow("startup", "status", "debug router started", "host", cfg.Web.DebugHost)
+
+		debugAPI := mux.DebugAPI(mux.DebugConfig{
+			Log:        log,
+			AdminToken: cfg.Admin.Token,
+			Chat:       cht,
+			Levels:     levels,
+			Auth:       authenticator,
+		})
+
+		if err := http.ListenAndServe(cfg.Web.DebugHost, debugAPI); err != nil {
+			log.Errorw("shutdown", "status", "debug router closed", "host", cfg.Web.DebugHost, "err", err)
+		}
+	}()
 
 	// -------------------------------------------------------------------------
 	// Start API Service
 
-	logger.Log.Infow("startup", "status", "initializing V1 API support")
+	log.Infow("startup", "status", "initializing V1 API support")
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
-	webAPI := mux.WebAPI()
+	var shuttingDown atomic.Bool
+
+	httpLimiter := rate.NewKeyed(cfg.RateLimit.HTTPRate, cfg.RateLimit.HTTPBurst)
+
+	webAPI := mux.WebAPI(mux.Config{
+		Log:            log,
+		HTTPLimiter:    httpLimiter,
+		TrustedProxies: cfg.Web.TrustedProxies,
+		Build:          build,
+		Chat:           cht,
+		ShuttingDown:   &shuttingDown,
+		Tracer:         trc,
+		Auth:           authenticator,
+		CORS: mid.CORSConfig{
+			Origins:          origins,
+			AllowCredentials: cfg.Web.CORSAllowCredentials,
+			AllowedMethods:   []string{http.MethodGet, http.MethodPut, http.MethodDelete},
+			AllowedHeaders:   cfg.Web.CORSAllowedHeaders,
+			ExposedHeaders:   cfg.Web.CORSExposedHeaders,
+			MaxAge:           cfg.Web.CORSMaxAge,
+		},
+	})
 
 	api := http.Server{
 		Addr:         cfg.Web.APIHost,
@@ -121,14 +233,111 @@ func run(ctx context.Context) error {
 		//ErrorLog:     logger.NewStdLogger(log, logger.LevelError),
 	}
 
-	serverErrors := make(chan error, 1)
+	// 设置了证书时使用 HTTPS，证书文件更新后由 reloader 重新读取，已有的连接不受影响
+	var certReloader *certs.Reloader
+	if cfg.Web.TLSCertFile != "" {
+		certReloader, err = certs.New(cfg.Web.TLSCertFile, cfg.Web.TLSKeyFile, cfg.Web.TLSClientCAFile, cfg.clientAuth())
+		if err != nil {
+			return fmt.Errorf("load tls certificate: %w", err)
+		}
+
+		api.TLSConfig = certReloader.TLSConfig()
+		// websocket 需要 HTTP/1.1，不启用 HTTP/2
+		api.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+
+		leaf := certReloader.Leaf()
+		log.Infow("startup", "status", "tls enabled", "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter,
+			"clientCA", cfg.Web.TLSClientCAFile, "clientAuth", cfg.Web.TLSClientAuth)
+	}
+
+	serverErrors := make(chan error, 2)
 
 	go func() {
-		logger.Log.Infow("startup", "status", "api router started", "host", api.Addr)
+		log.Infow("startup", "status", "api router started", "host", api.Addr, "tls", certReloader != nil)
 
+		if certReloader != nil {
+			serverErrors <- api.ListenAndServeTLS("", "")
+			return
+		}
 		serverErrors <- api.ListenAndServe()
 	}()
 
+	// -------------------------------------------------------------------------
+	// Start gRPC Service
+
+	// gRPC 的会话与 websocket 的会话在同一个注册表中，可以互相发送消息
+	var grpcServer *grpc.Server
+	if cfg.Web.GRPCHost != "" {
+		var opts []grpc.ServerOption
+		if certReloader != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(certReloader.GRPCTLSConfig())))
+		}
+
+		grpcServer = grpc.NewServer(opts...)
+		grpcapp.Register(grpcServer, grpcapp.Config{
+			Log:          log,
+			Chat:         cht,
+			Auth:         authenticator,
+			ShuttingDown: &shuttingDown,
+		})
+
+		lis, err := net.Listen("tcp", cfg.Web.GRPCHost)
+		if err != nil {
+			return fmt.Errorf("grpc listen: %w", err)
+		}
+
+		go func() {
+			log.Infow("startup", "status", "grpc router started", "host", cfg.Web.GRPCHost, "tls", certReloader != nil)
+
+			serverErrors <- grpcServer.Serve(lis)
+		}()
+	}
+
+	// -------------------------------------------------------------------------
+	// Start Redirect Service
+
+	if cfg.Web.RedirectHost != "" {
+		go func() {
+			log.Infow("startup", "status", "redirect router started", "host", cfg.Web.RedirectHost)
+
+			_, port, _ := net.SplitHostPort(cfg.Web.APIHost)
+			redirect := http.Server{
+				Addr:         cfg.Web.RedirectHost,
+				Handler:      mux.Redirect(port),
+				ReadTimeout:  cfg.Web.ReadTimeout,
+				WriteTimeout: cfg.Web.WriteTimeout,
+				IdleTimeout:  cfg.Web.IdleTimeout,
+			}
+
+			if err := redirect.ListenAndServe(); err != nil {
+				log.Errorw("shutdown", "status", "redirect router closed", "host", cfg.Web.RedirectHost, "err", err)
+			}
+		}()
+	}
+
+	// -------------------------------------------------------------------------
+	// Reload Support
+
+	// 配置文件变化或者收到 SIGHUP 时重新读取配置，应用可以热更新的配置
+	// 证书文件变化或者收到 SIGHUP 时重新读取证书
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	reloadCtx, stopReload := context.WithCancel(ctx)
+	defer stopReload()
+
+	r := reloader{
+		log:         log,
+		v:           v,
+		levels:      levels,
+		chat:        cht,
+		httpLimiter: httpLimiter,
+		certs:       certReloader,
+		origins:     origins,
+		applied:     cfg,
+	}
+	go r.run(reloadCtx, hup)
+
 	// -------------------------------------------------------------------------
 	// Shutdown
 
@@ -137,12 +346,32 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("server error: %w", err)
 
 	case sig := <-shutdown:
-		logger.Log.Infow("shutdown", "status", "shutdown started", "signal", sig)
-		defer logger.Log.Infow("shutdown", "status", "shutdown complete", "signal", sig)
+		log.Infow("shutdown", "status", "shutdown started", "signal", sig)
+		shuttingDown.Store(true)
+
+		// 就绪检查失败并且拒绝新的 websocket 连接，等待一段时间让负载均衡器把实例摘除后再关闭监听
+		time.Sleep(cfg.Web.ShutdownDrain)
+		defer log.Infow("shutdown", "status", "shutdown complete", "signal", sig)
 
 		ctx, cancel := context.WithTimeout(ctx, cfg.Web.ShutdownTimeout)
 		defer cancel()
 
+		// Connect 的流不会自己结束，与 API 一起等待，超时后强制关闭
+		if grpcServer != nil {
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			defer func() {
+				select {
+				case <-stopped:
+				case <-ctx.Done():
+					grpcServer.Stop()
+				}
+			}()
+		}
+
 		if err := api.Shutdown(ctx); err != nil {
 			api.Close()
 			return fmt.Errorf("could not stop server gracefully: %w", err)
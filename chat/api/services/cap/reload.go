@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/foundation/certs"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reloadDebounce 编辑器保存文件时会产生多个事件，等待事件停止后再重新读取
+const reloadDebounce = 200 * time.Millisecond
+
+// reloader 重新读取配置，校验通过后应用可以热更新的配置
+// 需要重启的配置保持启动时的值，每次重新读取时都会提示
+type reloader struct {
+	log         *zap.SugaredLogger
+	v           *viper.Viper
+	levels      *logger.Levels
+	chat        *chat.Chat
+	httpLimiter *rate.Keyed
+	// certs 为 nil 时 API 没有使用 TLS
+	certs *certs.Reloader
+	// origins CORS 和 websocket 握手允许的来源
+	origins *origin.Policy
+
+	// applied 当前生效的配置
+	applied config
+}
+
+// change 重新读取后发生变化的一个配置项
+type change struct {
+	key      string
+	old, new any
+	setting  setting
+}
+
+func (c change) String() string {
+	if c.setting.secret {
+		return c.key + ": ****** -> ******"
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.key, c.old, c.new)
+}
+
+// run 在收到 SIGHUP 或者配置文件变化时重新读取配置，证书文件变化时重新读取证书，直到 ctx 取消
+func (r *reloader) run(ctx context.Context, hup <-chan os.Signal) {
+	var changed <-chan struct{}
+	if path := r.v.ConfigFileUsed(); path != "" {
+		ch, err := watchFiles(ctx, r.log, path)
+		if err != nil {
+			r.log.Errorw("reload", "status", "watch config file failed, only SIGHUP reloads", "file", path, "err", err)
+		} else {
+			changed = ch
+		}
+	}
+
+	var certsChanged <-chan struct{}
+	if r.certs != nil {
+		ch, err := watchFiles(ctx, r.log, r.certs.Files()...)
+		if err != nil {
+			r.log.Errorw("reload", "status", "watch certificate files failed, only SIGHUP reloads", "files", r.certs.Files(), "err", err)
+		} else {
+			certsChanged = ch
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("SIGHUP")
+			r.reloadCerts("SIGHUP")
+		case <-changed:
+			r.reload("file changed")
+		case <-certsChanged:
+			r.reloadCerts("file changed")
+		}
+	}
+}
+
+// reload 重新读取配置，配置不合法时保持当前的配置
+func (r *reloader) reload(trigger string) {
+	next, err := loadConfig(r.v)
+	if err != nil {
+		r.log.Errorw("reload", "status", "invalid config, keeping current config", "trigger", trigger, "err", err)
+		return
+	}
+
+	changes := diffConfig(r.applied, next)
+	if len(changes) == 0 {
+		r.log.Infow("reload", "status", "no changes", "trigger", trigger)
+		return
+	}
+
+	cfg := r.applied
+	var applied, restart []string
+	for _, c := range changes {
+		if !c.setting.reload {
+			restart = append(restart, c.key)
+			continue
+		}
+		field(&cfg, c.key).Set(reflect.ValueOf(c.new))
+		applied = append(applied, c.String())
+	}
+
+	if len(applied) > 0 {
+		if err := r.apply(cfg); err != nil {
+			r.log.Errorw("reload", "status", "apply config failed, keeping current config", "trigger", trigger, "err", err)
+			return
+		}
+		r.applied = cfg
+
+		r.log.Infow("reload", "status", "config reloaded", "trigger", trigger, "changes", applied)
+	}
+
+	if len(restart) > 0 {
+		r.log.Warnw("reload", "status", "some changes require a restart", "trigger", trigger, "keys", restart)
+	}
+}
+
+// reloadCerts 重新读取证书，新的证书只用于之后的 TLS 握手，已有的连接不受影响
+// 读取失败时继续使用当前的证书，比如证书和私钥只更新了一个
+func (r *reloader) reloadCerts(trigger string) {
+	if r.certs == nil {
+		return
+	}
+
+	if err := r.certs.Reload(); err != nil {
+		r.log.Errorw("reload", "status", "invalid certificate, keeping current certificate", "trigger", trigger, "err", err)
+		return
+	}
+
+	leaf := r.certs.Leaf()
+	r.log.Infow("reload", "status", "certificate reloaded", "trigger", trigger, "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter)
+}
+
+// apply 把配置应用到各个组件
+// 先校验所有的配置再修改组件，任意一项不合法时不修改任何组件，避免组件之间的配置不一致
+func (r *reloader) apply(cfg config) error {
+	settings, err := cfg.chatSettings()
+	if err != nil {
+		return err
+	}
+
+	if err := logger.ValidateLevels(cfg.Log.Level, cfg.Log.Components); err != nil {
+		return fmt.Errorf("log levels: %w", err)
+	}
+
+	if err := origin.Validate(cfg.Web.CORSAllowedOrigins); err != nil {
+		return fmt.Errorf("cors allowed origins: %w", err)
+	}
+
+	// 上面已经校验过，下面的修改不会失败
+	if err := r.levels.Set(cfg.Log.Level, cfg.Log.Components); err != nil {
+		return fmt.Errorf("set log levels: %w", err)
+	}
+	if err := r.origins.Set(cfg.Web.CORSAllowedOrigins); err != nil {
+		return fmt.Errorf("set cors allowed origins: %w", err)
+	}
+	r.httpLimiter.SetLimit(cfg.RateLimit.HTTPRate, cfg.RateLimit.HTTPBurst)
+	r.chat.Reconfigure(logger.NewContext(context.Background(), r.log), settings)
+
+	return nil
+}
+
+// =============================================================================
+
+// diffConfig 按 settings 的顺序返回发生变化的配置项
+func diffConfig(old, new config) []change {
+	var changes []change
+	for _, s := range settings {
+		o := field(&old, s.key).Interface()
+		n := field(&new, s.key).Interface()
+		if !reflect.DeepEqual(o, n) {
+			changes = append(changes, change{key: s.key, old: o, new: n, setting: s})
+		}
+	}
+	return changes
+}
+
+// field 返回配置项对应的字段，key 的格式是 Section.Field
+func field(cfg *config, key string) reflect.Value {
+	section, name, _ := strings.Cut(key, ".")
+	return reflect.ValueOf(cfg).Elem().FieldByName(section).FieldByName(name)
+}
+
+// watchFiles 监听文件的变化，变化停止 reloadDebounce 后发送通知
+// 监听的是文件所在的目录，这样编辑器通过重命名保存文件以及 Kubernetes 更新 ConfigMap 和 Secret 时也能收到通知
+func watchFiles(ctx context.Context, log *zap.SugaredLogger, paths ...string) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		files[p] = true
+
+		dir := filepath.Dir(p)
+		if dirs[dir] {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+		dirs[dir] = true
+	}
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		defer w.Close()
+
+		var debounce *time.Timer
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !files[filepath.Clean(e.Name)] && !strings.HasPrefix(filepath.Base(e.Name), "..") {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(reloadDebounce, notify)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorw("reload", "status", "watch files", "files", paths, "err", err)
+			}
+		}
+	}()
+
+	return changed, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestApplyAllOrNothing(t *testing.T) {
+	// 测试目录下没有默认的配置文件，使用默认配置
+	v, err := newViper(nil)
+	if err != nil {
+		t.Fatalf("new viper: %v", err)
+	}
+
+	cfg, err := loadConfig(v)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	cfg.Web.CORSAllowedOrigins = []string{"https://chat.example.com"}
+
+	levels, err := logger.NewLevels(cfg.Log.Level, cfg.Log.Components)
+	if err != nil {
+		t.Fatalf("new levels: %v", err)
+	}
+	origins, err := origin.New(cfg.Web.CORSAllowedOrigins)
+	if err != nil {
+		t.Fatalf("new origins: %v", err)
+	}
+	cht := chat.NewChat(zap.NewNop().Sugar(), chat.DefaultConfig())
+	t.Cleanup(cht.Stop)
+
+	r := reloader{
+		log:         zap.NewNop().Sugar(),
+		v:           v,
+		levels:      levels,
+		chat:        cht,
+		httpLimiter: rate.NewKeyed(cfg.RateLimit.HTTPRate, cfg.RateLimit.HTTPBurst),
+		origins:     origins,
+		applied:     cfg,
+	}
+
+	// 日志级别合法，来源不合法，日志级别也不应该被修改
+	next := cfg
+	next.Log.Level = "debug"
+	next.Web.CORSAllowedOrigins = []string{"https://*"}
+	if err := r.apply(next); err == nil {
+		t.Fatal("apply: expected an error for invalid origins")
+	}
+
+	if global, _ := levels.Snapshot(); global != cfg.Log.Level {
+		t.Errorf("log level: got %s, want %s", global, cfg.Log.Level)
+	}
+	if !origins.Allowed("https://chat.example.com") {
+		t.Error("origins: original origin is no longer allowed")
+	}
+
+	// 两项都合法时都会修改
+	next.Web.CORSAllowedOrigins = []string{"https://other.example.com"}
+	if err := r.apply(next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	if global, _ := levels.Snapshot(); global != "debug" {
+		t.Errorf("log level: got %s, want debug", global)
+	}
+	if !origins.Allowed("https://other.example.com") {
+		t.Error("origins: new origin is not allowed")
+	}
+}
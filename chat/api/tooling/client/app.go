@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/client"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errQuit 用户输入 /quit
+var errQuit = errors.New("quit")
+
+type lineKind int
+
+const (
+	lineIn lineKind = iota
+	lineOut
+	lineInfo
+	lineError
+)
+
+// line 会话中显示的一行
+type line struct {
+	kind lineKind
+	at   time.Time
+	from string
+	text string
+}
+
+// conversation 和一个用户的会话，系统公告和提示放在 ID 为 uuid.Nil 的会话中
+type conversation struct {
+	peer   client.User
+	lines  []line
+	unread int
+}
+
+// app 保存客户端的状态，只在主循环中访问，不需要加锁
+type app struct {
+	cfg    config
+	me     client.User
+	client *client.Client
+	ui     ui
+	status string
+
+	convs  map[uuid.UUID]*conversation
+	order  []uuid.UUID
+	active uuid.UUID
+
+	// known 收到过消息或者在 /who 中出现过的用户
+	known map[uuid.UUID]client.User
+}
+
+func newApp(cfg config, c *client.Client) *app {
+	a := app{
+		cfg:    cfg,
+		me:     c.User(),
+		client: c,
+		status: "connected",
+		convs:  make(map[uuid.UUID]*conversation),
+		known:  make(map[uuid.UUID]client.User),
+	}
+
+	a.conversation(client.User{ID: uuid.Nil, Name: "*system*"})
+
+	return &a
+}
+
+// loop 处理连接事件和用户输入，直到用户退出或者 ctx 取消
+func (a *app) loop(ctx context.Context, input <-chan string, resize <-chan os.Signal) error {
+	a.ui.render(a)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case e, ok := <-a.client.Events():
+			if !ok {
+				return nil
+			}
+			a.handleEvent(e)
+
+		case <-resize:
+			a.ui.resize()
+
+		case text, ok := <-input:
+			if !ok {
+				return nil
+			}
+			a.ui.inputDone()
+			if err := a.handleInput(ctx, text); err != nil {
+				if errors.Is(err, errQuit) {
+					return nil
+				}
+				a.info(lineError, err.Error())
+			}
+		}
+
+		a.ui.render(a)
+	}
+}
+
+func (a *app) handleEvent(e client.Event) {
+	switch e.Kind {
+	case client.EventConnected:
+		a.status = "connected"
+		text := "connected to " + a.cfg.URL
+		switch {
+		case e.Resumed && e.Gap:
+			text += ", session resumed, some messages were lost"
+		case e.Resumed:
+			text += ", session resumed"
+		}
+		a.addLine(uuid.Nil, line{kind: lineInfo, at: time.Now(), text: text})
+
+	case client.EventDisconnected:
+		a.status = "disconnected"
+		text := e.Err.Error()
+		if e.Reconnecting {
+			a.status = "reconnecting"
+			text += ", reconnecting"
+		}
+		a.addLine(uuid.Nil, line{kind: lineError, at: time.Now(), text: text})
+
+	case client.EventSystem:
+		a.addLine(uuid.Nil, line{kind: lineInfo, at: e.System.At, from: "system", text: e.System.System})
+
+	case client.EventError:
+		a.info(lineError, e.Error.Error())
+
+	case client.EventMessage:
+		msg := e.Message
+		a.known[msg.From.ID] = msg.From
+		text := msg.Msg
+		if msg.Muted {
+			text += " (muted)"
+		}
+		// 通过 ID 创建的会话在收到消息后使用对方的用户名
+		a.conversation(msg.From).peer = msg.From
+		a.addLine(msg.From.ID, line{kind: lineIn, at: time.Now(), from: msg.From.Name, text: strings.TrimRight(text, "\n")})
+	}
+}
+
+func (a *app) handleInput(ctx context.Context, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(text, "/") {
+		if a.active == uuid.Nil {
+			return errors.New("no active conversation, use /join <user> or /msg <user> <text>")
+		}
+		return a.send(ctx, a.convs[a.active].peer, text)
+	}
+
+	cmd, args, _ := strings.Cut(text, " ")
+	args = strings.TrimSpace(args)
+
+	switch cmd {
+	case "/msg":
+		ref, msg, _ := strings.Cut(args, " ")
+		if ref == "" || strings.TrimSpace(msg) == "" {
+			return errors.New("usage: /msg <user> <text>")
+		}
+		to, err := a.resolve(ref)
+		if err != nil {
+			return err
+		}
+		a.activate(to)
+		return a.send(ctx, to, strings.TrimSpace(msg))
+
+	case "/join":
+		if args == "" {
+			return errors.New("usage: /join <user>")
+		}
+		to, err := a.resolve(args)
+		if err != nil {
+			return err
+		}
+		a.activate(to)
+
+	case "/rooms":
+		a.rooms()
+
+	case "/history":
+		return a.history(args)
+
+	case "/who":
+		return a.who(ctx)
+
+	case "/help":
+		a.help()
+
+	case "/quit":
+		return errQuit
+
+	default:
+		return fmt.Errorf("unknown command %s, type /help", cmd)
+	}
+
+	return nil
+}
+
+func (a *app) send(ctx context.Context, to client.User, msg string) error {
+	if err := a.client.Send(ctx, to.ID, msg); err != nil {
+		return err
+	}
+
+	a.addLine(to.ID, line{kind: lineOut, at: time.Now(), from: a.me.Name, text: msg})
+	return nil
+}
+
+// rooms 列出本地的会话，服务端目前只支持一对一的会话
+func (a *app) rooms() {
+	a.info(lineInfo, "conversations (the server has no rooms yet, conversations are one-to-one):")
+	for _, id := range a.order[1:] {
+		c := a.convs[id]
+		a.info(lineInfo, fmt.Sprintf("  %s %s unread=%d", c.peer.Name, c.peer.ID, c.unread))
+	}
+}
+
+// history 显示会话在本地的最近 n 条消息，服务端不保存历史消息
+func (a *app) history(args string) error {
+	n := 20
+	id := a.active
+
+	for _, arg := range strings.Fields(args) {
+		if v, err := strconv.Atoi(arg); err == nil {
+			n = v
+			continue
+		}
+		to, err := a.resolve(arg)
+		if err != nil {
+			return err
+		}
+		id = to.ID
+	}
+
+	c, exists := a.convs[id]
+	if !exists {
+		return errors.New("no such conversation")
+	}
+
+	var lines []line
+	for _, l := range c.lines {
+		if l.kind == lineIn || l.kind == lineOut {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	a.info(lineInfo, fmt.Sprintf("last %d messages with %s (kept locally, the server has no history):", len(lines), c.peer.Name))
+	for _, l := range lines {
+		a.info(lineInfo, fmt.Sprintf("  %s %s: %s", l.at.Format("15:04:05"), l.from, l.text))
+	}
+
+	return nil
+}
+
+// who 列出在线用户，需要配置管理接口的地址和 token，否则只列出已知的用户
+func (a *app) who(ctx context.Context) error {
+	if a.cfg.AdminURL == "" || a.cfg.AdminToken == "" {
+		a.info(lineInfo, "known users (set admin-url and admin-token to list online users):")
+		users := make([]client.User, 0, len(a.known))
+		for _, u := range a.known {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+		for _, u := range users {
+			a.info(lineInfo, fmt.Sprintf("  %s %s", u.Name, u.ID))
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(a.cfg.AdminURL, "/")+"/admin/sessions", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.cfg.AdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("who: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("who: %s", resp.Status)
+	}
+
+	var sessions sessionList
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return fmt.Errorf("who: %w", err)
+	}
+
+	a.info(lineInfo, fmt.Sprintf("%d users online:", sessions.Total))
+	for _, s := range sessions.Items {
+		a.known[s.UserID] = client.User{ID: s.UserID, Name: s.Name}
+		a.info(lineInfo, fmt.Sprintf("  %s %s since %s", s.Name, s.UserID, s.ConnectedAt.Format(time.DateTime)))
+	}
+
+	return nil
+}
+
+func (a *app) help() {
+	for _, s := range []string{
+		"commands:",
+		"  /msg <user> <text>   send a message and switch to the conversation",
+		"  /join <user>         switch to the conversation with user",
+		"  /rooms               list conversations",
+		"  /history [user] [n]  show the last n messages of a conversation",
+		"  /who                 list online users",
+		"  /quit                exit",
+		"<user> is a user ID, an ID prefix or the name of a known user",
+	} {
+		a.info(lineInfo, s)
+	}
+}
+
+// resolve 根据 ID、ID 前缀或者已知的用户名查找用户
+func (a *app) resolve(ref string) (client.User, error) {
+	if id, err := uuid.Parse(ref); err == nil {
+		if u, exists := a.known[id]; exists {
+			return u, nil
+		}
+		return client.User{ID: id, Name: id.String()[:8]}, nil
+	}
+
+	var matches []client.User
+	for id, u := range a.known {
+		if strings.EqualFold(u.Name, ref) || strings.HasPrefix(id.String(), ref) {
+			matches = append(matches, u)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return client.User{}, fmt.Errorf("unknown user %q", ref)
+	case 1:
+		return matches[0], nil
+	}
+
+	return client.User{}, fmt.Errorf("user %q is ambiguous, use the ID", ref)
+}
+
+// conversation 返回和 peer 的会话，不存在时创建
+func (a *app) conversation(peer client.User) *conversation {
+	if c, exists := a.convs[peer.ID]; exists {
+		return c
+	}
+
+	c := conversation{peer: peer}
+	a.convs[peer.ID] = &c
+	a.order = append(a.order, peer.ID)
+
+	return &c
+}
+
+// activate 切换到和 peer 的会话
+func (a *app) activate(peer client.User) {
+	c := a.conversation(peer)
+	c.unread = 0
+	a.active = peer.ID
+}
+
+func (a *app) addLine(id uuid.UUID, l line) {
+	c := a.convs[id]
+	c.lines = append(c.lines, l)
+	if id != a.active {
+		c.unread++
+	}
+	a.ui.print(c.peer, l)
+}
+
+// info 在当前会话中显示提示
+func (a *app) info(kind lineKind, text string) {
+	a.addLine(a.active, line{kind: kind, at: time.Now(), text: text})
+}
@@ -1,167 +1,229 @@
+// client 是一个终端聊天客户端
+//
+// 使用方式：
+//
+//	go run ./chat/api/tooling/client --name Alice
+//	go run ./chat/api/tooling/client --config ~/.chat/client.yaml
+//
+// 配置文件是 yaml 格式，key 和命令行参数相同，命令行参数优先
 package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/zhangpetergo/chat/chat/foundation/logger"
-	"go.uber.org/zap"
-	"log"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/client"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 )
 
-func main() {
-	err := hack1()
-	if err != nil {
-		log.Fatal(err)
-	}
+// config 客户端的配置
+type config struct {
+	URL        string `mapstructure:"url"`
+	ID         string `mapstructure:"id"`
+	Name       string `mapstructure:"name"`
+	Token      string `mapstructure:"token"`
+	AdminURL   string `mapstructure:"admin-url"`
+	AdminToken string `mapstructure:"admin-token"`
+	Plain      bool   `mapstructure:"plain"`
+	Encoding   string `mapstructure:"encoding"`
+	TLSCert    string `mapstructure:"tls-cert"`
+	TLSKey     string `mapstructure:"tls-key"`
+	TLSCA      string `mapstructure:"tls-ca"`
 }
 
-func hack1() error {
-	users := []uuid.UUID{
-		uuid.MustParse("8ce5af7a-788c-4c83-8e70-4500b775b359"),
-		uuid.MustParse("d92d3e84-a08d-4d55-b211-8199299495a2"),
+func main() {
+	if err := run(); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "client:", err)
+		os.Exit(1)
 	}
+}
 
-	var ID uuid.UUID
-	switch os.Args[1] {
-	case "0":
-		ID = users[0]
-	case "1":
-		ID = users[1]
+func run() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("ID:", ID.String())
-
-	// 客户端访问 websocket 服务端
-	const url = "ws://localhost:9000/connect"
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	dialer, ident, err := tlsDialer(cfg)
 	if err != nil {
-		return fmt.Errorf("dial: %w", err)
+		return err
 	}
 
-	defer conn.Close()
-
-	// -------------------------------------------------------------------------
-	// 读取服务端返回的消息
+	me := client.User{Name: cfg.Name}
+	switch {
+	case ident != nil && cfg.ID == "":
+		// 使用客户端证书时服务端按证书确定身份
+		me = client.User{ID: ident.ID, Name: ident.Name}
+		fmt.Fprintf(os.Stderr, "using identity %s (%s) from the client certificate\n", me.ID, me.Name)
+	case cfg.ID == "":
+		// 没有配置 ID 时生成一个，下次可以通过 --id 或者配置文件使用同一个身份
+		me.ID = uuid.New()
+		fmt.Fprintf(os.Stderr, "no id configured, using %s\n", me.ID)
+	default:
+		if me.ID, err = uuid.Parse(cfg.ID); err != nil {
+			return fmt.Errorf("parse id: %w", err)
+		}
+	}
 
-	_, msg, err := conn.ReadMessage()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	c, err := client.Dial(ctx, cfg.URL, client.Options{
+		User:        me,
+		Token:       cfg.Token,
+		Dialer:      dialer,
+		Compression: true,
+		Encoding:    cfg.Encoding,
+		Reconnect:   true,
+		Resume:      true,
+	})
 	if err != nil {
-		return fmt.Errorf("read: %w", err)
-	}
-	if string(msg) != "HELLO" {
-		return fmt.Errorf("unexpected message: %s", msg)
+		return err
 	}
+	defer c.Close()
 
-	// -------------------------------------------------------------------------
-	// 向服务端发送消息 {"id":"8ce5af7a-788c-4c83-8e70-4500b775b359","name":"Alice"}
+	a := newApp(cfg, c)
 
-	usr := struct {
-		ID   uuid.UUID `json:"id"`
-		Name string    `json:"name"`
-	}{
-		ID:   ID,
-		Name: "Peter",
+	resize := make(chan os.Signal, 1)
+	if cfg.Plain || !isatty.IsTerminal(os.Stdout.Fd()) {
+		a.ui = plainUI{w: os.Stdout}
+	} else {
+		a.ui = newTUI(os.Stdout)
+		notifyResize(resize)
 	}
+	defer a.ui.close()
 
-	data, err := json.Marshal(usr)
-	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
-	}
+	input := make(chan string)
+	go func() {
+		defer close(input)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			input <- scanner.Text()
+		}
+	}()
 
-	err = conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	if err := a.loop(ctx, input, resize); err != nil && !errors.Is(err, context.Canceled) {
+		return err
 	}
 
-	// -------------------------------------------------------------------------
-	// 读取服务端返回的消息
+	return nil
+}
 
-	_, msg, err = conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("read: %w", err)
+// loadConfig 读取命令行参数和配置文件
+// 没有指定 --config 时，存在 ~/.chat/client.yaml 就读取它
+func loadConfig() (config, error) {
+	flags := pflag.NewFlagSet("client", pflag.ContinueOnError)
+	configFile := flags.String("config", "", "配置文件路径，默认为 ~/.chat/client.yaml")
+	flags.String("url", "ws://localhost:9000/connect", "服务端 websocket 地址")
+	flags.String("id", "", "用户 ID，为空时随机生成")
+	flags.String("name", os.Getenv("USER"), "用户名")
+	flags.String("token", "", "连接时通过 Authorization 请求头发送的 token")
+	flags.String("admin-url", "", "管理接口地址，/who 使用，比如 http://localhost:9010")
+	flags.String("admin-token", "", "管理接口的 token")
+	flags.Bool("plain", false, "不使用分栏界面，逐行输出")
+	flags.String("encoding", "json", "消息的编码：json、msgpack 或者 cbor")
+	flags.String("tls-cert", "", "mTLS 的客户端证书，没有设置 --id 时使用证书对应的身份")
+	flags.String("tls-key", "", "客户端证书的私钥")
+	flags.String("tls-ca", "", "校验服务端证书的 CA，为空时使用系统的 CA")
+
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return config{}, err
 	}
-	fmt.Println(string(msg))
 
-	go func() {
-		for {
-			_, msg, err = conn.ReadMessage()
-			if err != nil {
-				fmt.Println("read: %w", err)
-				return
-			}
+	v := viper.New()
+	if err := v.BindPFlags(flags); err != nil {
+		return config{}, err
+	}
 
-			var outMsg outMessage
-			err = json.Unmarshal(msg, &outMsg)
-			if err != nil {
-				logger.Log.Error("unmarshal message failed", zap.Error(err))
-				return
+	path := *configFile
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if p := filepath.Join(home, ".chat", "client.yaml"); fileExists(p) {
+				path = p
 			}
+		}
+	}
 
-			fmt.Println(outMsg.Msg)
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return config{}, fmt.Errorf("read config: %w", err)
 		}
-	}()
+	}
+
+	var cfg config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return config{}, fmt.Errorf("parse config: %w", err)
+	}
+
+	if cfg.Name == "" {
+		return config{}, errors.New("name is required")
+	}
 
-	// -------------------------------------------------------------------------
-	// handshake 完成后发送消息
+	return cfg, nil
+}
 
-	// 生成一个 uuid
-	// 8ce5af7a-788c-4c83-8e70-4500b775b359
-	// d92d3e84-a08d-4d55-b211-8199299495a2
+// tlsDialer 根据 TLS 配置创建 Dialer，没有设置时返回 nil 使用默认的 Dialer
+// 设置了客户端证书时同时返回证书对应的身份
+func tlsDialer(cfg config) (*websocket.Dialer, *chat.Identity, error) {
+	if cfg.TLSCert == "" && cfg.TLSCA == "" {
+		return nil, nil, nil
+	}
 
-	for {
-		fmt.Printf("\n\n")
-		fmt.Print("message>")
-		reader := bufio.NewReader(os.Stdin)
+	tlsCfg := tls.Config{MinVersion: tls.VersionTLS12}
 
-		input, err := reader.ReadString('\n')
+	if cfg.TLSCA != "" {
+		data, err := os.ReadFile(cfg.TLSCA)
 		if err != nil {
-			return fmt.Errorf("read string: %w", err)
+			return nil, nil, fmt.Errorf("read tls ca: %w", err)
 		}
-
-		var from, to uuid.UUID
-
-		switch os.Args[1] {
-		case "0":
-			from = users[0]
-			to = users[1]
-		case "1":
-			from = users[1]
-			to = users[0]
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, errors.New("tls ca: no certificates found")
 		}
+		tlsCfg.RootCAs = pool
+	}
 
-		inMsg := inMessage{
-			FromID: from,
-			ToID:   to,
-			Msg:    input,
+	var ident *chat.Identity
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load client certificate: %w", err)
 		}
-
-		data, err = json.Marshal(inMsg)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
 		if err != nil {
-			return fmt.Errorf("marshal: %w", err)
+			return nil, nil, fmt.Errorf("parse client certificate: %w", err)
 		}
-		err = conn.WriteMessage(websocket.TextMessage, data)
+		id, err := chat.IdentityFromCert(leaf)
 		if err != nil {
-			return fmt.Errorf("write: %w", err)
+			return nil, nil, err
 		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+		ident = &id
 	}
-}
 
-type inMessage struct {
-	FromID uuid.UUID `json:"fromID"`
-	ToID   uuid.UUID `json:"toID"`
-	Msg    string    `json:"msg"`
-}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tlsCfg
 
-type outMessage struct {
-	From user   `json:"from"`
-	To   user   `json:"to"`
-	Msg  string `json:"msg"`
+	return &dialer, ident, nil
 }
 
-type user struct {
-	ID   uuid.UUID `json:"id"`
-	Name string    `json:"name"`
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// session 管理接口返回的在线会话
+type session struct {
+	UserID      uuid.UUID `json:"userID"`
+	Name        string    `json:"name"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+type sessionList struct {
+	Total int       `json:"total"`
+	Items []session `json:"items"`
+}
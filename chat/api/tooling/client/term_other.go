@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// termSize 无法获取终端大小时使用 80x24
+func termSize() (int, int) {
+	return 80, 24
+}
+
+// notifyResize 不支持监听终端大小变化
+func notifyResize(ch chan<- os.Signal) {}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"os/signal"
+)
+
+// termSize 返回终端的列数和行数，获取失败时返回 80x24
+func termSize() (int, int) {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// notifyResize 终端大小变化时向 ch 发送信号
+func notifyResize(ch chan<- os.Signal) {
+	signal.Notify(ch, unix.SIGWINCH)
+}
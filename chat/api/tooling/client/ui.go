@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/client"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ui 显示客户端的状态
+// render 在每次处理完事件或者输入后调用，print 在新增一行时调用
+// inputDone 在用户输入一行后调用，resize 在终端大小变化后调用
+type ui interface {
+	render(a *app)
+	print(peer client.User, l line)
+	inputDone()
+	resize()
+	close()
+}
+
+// =============================================================================
+
+// plainUI 逐行输出，用于不是终端的场景，比如重定向到文件
+type plainUI struct {
+	w io.Writer
+}
+
+func (p plainUI) render(a *app) {}
+
+func (p plainUI) print(peer client.User, l line) {
+	switch l.kind {
+	case lineIn, lineOut:
+		fmt.Fprintf(p.w, "%s [%s] %s: %s\n", l.at.Format("15:04:05"), peer.Name, l.from, l.text)
+	case lineError:
+		fmt.Fprintf(p.w, "%s ! %s\n", l.at.Format("15:04:05"), l.text)
+	default:
+		fmt.Fprintf(p.w, "%s * %s\n", l.at.Format("15:04:05"), l.text)
+	}
+}
+
+func (p plainUI) inputDone() {}
+
+func (p plainUI) resize() {}
+
+func (p plainUI) close() {}
+
+// =============================================================================
+
+// 终端控制序列
+const (
+	escClearScreen = "\x1b[2J"
+	escClearLine   = "\x1b[2K"
+	escClearBelow  = "\x1b[J"
+	escSaveCursor  = "\x1b7"
+	escRestore     = "\x1b8"
+	escReset       = "\x1b[0m"
+	escReverse     = "\x1b[7m"
+	escBold        = "\x1b[1m"
+	escDim         = "\x1b[2m"
+	escRed         = "\x1b[31m"
+	escGreen       = "\x1b[32m"
+	escCyan        = "\x1b[36m"
+)
+
+// tui 左边是会话列表，右边是当前会话的消息，最下面两行是输入区域
+// 输入使用终端的行编辑模式，重绘时保存并恢复光标位置，不影响正在输入的内容
+// 输入区域设置为滚动区域，回车换行时上面的窗格不会滚动
+type tui struct {
+	w      io.Writer
+	width  int
+	height int
+	prompt string
+}
+
+func newTUI(w io.Writer) *tui {
+	t := tui{w: w}
+	t.resize()
+	return &t
+}
+
+// resize 终端大小变化后重新设置滚动区域并清屏
+func (t *tui) resize() {
+	t.width, t.height = termSize()
+
+	fmt.Fprint(t.w, escClearScreen)
+	fmt.Fprintf(t.w, "\x1b[%d;%dr", t.height-1, t.height)
+	t.resetInput("")
+}
+
+// resetInput 清空输入区域并显示提示符
+func (t *tui) resetInput(prompt string) {
+	if prompt != "" {
+		t.prompt = prompt
+	}
+	fmt.Fprintf(t.w, "\x1b[%d;1H%s%s", t.height-1, escClearBelow, t.prompt)
+}
+
+func (t *tui) print(peer client.User, l line) {}
+
+func (t *tui) render(a *app) {
+	var b strings.Builder
+
+	b.WriteString(escSaveCursor)
+
+	// 标题栏
+	status := fmt.Sprintf(" chat | %s (%s) | %s | /help ", a.me.Name, a.me.ID.String()[:8], a.status)
+	t.moveTo(&b, 1)
+	b.WriteString(escReverse + pad(status, t.width) + escReset)
+
+	paneHeight := t.height - 3
+	left := min(28, t.width/3)
+	right := t.width - left - 1
+
+	convs := t.conversations(a, left)
+	msgs := t.messages(a, right, paneHeight)
+
+	for i := 0; i < paneHeight; i++ {
+		t.moveTo(&b, i+2)
+
+		var l string
+		if i < len(convs) {
+			l = convs[i]
+		}
+		b.WriteString(l)
+		b.WriteString(strings.Repeat(" ", max(0, left-visibleLen(l))))
+
+		b.WriteString(escDim + "│" + escReset)
+
+		if i < len(msgs) {
+			b.WriteString(msgs[i])
+		}
+	}
+
+	// 输入区域上面的分隔线
+	t.moveTo(&b, t.height-2)
+	b.WriteString(escDim + strings.Repeat("─", t.width) + escReset)
+
+	b.WriteString(escRestore)
+
+	fmt.Fprint(t.w, b.String())
+
+	// 提示符显示当前会话
+	prompt := "> "
+	if a.active != uuid.Nil {
+		prompt = a.convs[a.active].peer.Name + "> "
+	}
+	if prompt != t.prompt {
+		t.resetInput(prompt)
+	}
+}
+
+// inputDone 用户输入一行后调用，清空输入区域
+func (t *tui) inputDone() {
+	t.resetInput("")
+}
+
+func (t *tui) close() {
+	fmt.Fprint(t.w, "\x1b[r"+escClearScreen+"\x1b[1;1H")
+}
+
+func (t *tui) moveTo(b *strings.Builder, row int) {
+	fmt.Fprintf(b, "\x1b[%d;1H%s", row, escClearLine)
+}
+
+// conversations 左边窗格的每一行
+func (t *tui) conversations(a *app, width int) []string {
+	var rows []string
+	for _, id := range a.order {
+		c := a.convs[id]
+
+		name := c.peer.Name
+		if c.unread > 0 {
+			name = fmt.Sprintf("%s (%d)", name, c.unread)
+		}
+		name = truncate(" "+name, width-1)
+
+		if id == a.active {
+			rows = append(rows, escReverse+pad(name, width)+escReset)
+			continue
+		}
+		if c.unread > 0 {
+			name = escBold + name + escReset
+		}
+		rows = append(rows, name)
+	}
+	return rows
+}
+
+// messages 右边窗格的每一行，只显示最后能放下的行，过长的消息自动换行
+func (t *tui) messages(a *app, width int, height int) []string {
+	c := a.convs[a.active]
+
+	var rows []string
+	for i := len(c.lines) - 1; i >= 0 && len(rows) < height; i-- {
+		l := c.lines[i]
+
+		prefix := " " + l.at.Format("15:04:05") + " "
+		color := escDim
+		switch l.kind {
+		case lineIn:
+			prefix += l.from + ": "
+			color = escCyan
+		case lineOut:
+			prefix += l.from + ": "
+			color = escGreen
+		case lineError:
+			color = escRed
+		}
+
+		wrapped := wrap(prefix+l.text, width)
+		for j := len(wrapped) - 1; j >= 0 && len(rows) < height; j-- {
+			rows = append(rows, color+wrapped[j]+escReset)
+		}
+	}
+
+	// 倒序收集，这里反转
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+
+	return rows
+}
+
+// =============================================================================
+
+func visibleLen(s string) int {
+	var n int
+	var esc bool
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			esc = true
+		case esc:
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				esc = false
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return truncate(s, width)
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width-1]) + "…"
+}
+
+func wrap(s string, width int) []string {
+	if width <= 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, para := range strings.Split(s, "\n") {
+		r := []rune(para)
+		for len(r) > width {
+			lines = append(lines, string(r[:width]))
+			r = r[width:]
+		}
+		lines = append(lines, string(r))
+	}
+	return lines
+}
@@ -0,0 +1,345 @@
+// loadtest 模拟大量客户端对 chat 服务进行压测
+//
+// 使用方式：
+//
+//	go run ./chat/api/tooling/loadtest -clients 1000 -connect-rate 100 -msg-rate 1 -duration 5m
+//	go run ./chat/api/tooling/loadtest -clients 500 -soak -duration 6h -debug-url http://localhost:9010
+//
+// 每个客户端按 msg-rate 向随机的 fanout 个在线客户端发送消息，消息中带有发送时间，
+// 接收方据此计算端到端的延迟。服务端目前没有房间，fanout 通过向多个用户分别发送消息模拟
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/client"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// payloadPrefix 压测消息的前缀，格式为 lt|发送时间的纳秒|填充
+const payloadPrefix = "lt|"
+
+type config struct {
+	url         string
+	debugURL    string
+	clients     int
+	connectRate float64
+	msgRate     float64
+	fanout      int
+	size        int
+	compress    bool
+	duration    time.Duration
+	report      time.Duration
+	drain       time.Duration
+	soak        bool
+	sample      time.Duration
+	growth      float64
+	trend       int
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "ws://localhost:9000/connect", "服务端 websocket 地址")
+	flag.StringVar(&cfg.debugURL, "debug-url", "http://localhost:9010", "服务端调试端口地址，soak 模式使用")
+	flag.IntVar(&cfg.clients, "clients", 100, "模拟的客户端数量")
+	flag.Float64Var(&cfg.connectRate, "connect-rate", 50, "每秒建立的连接数")
+	flag.Float64Var(&cfg.msgRate, "msg-rate", 1, "每个客户端每秒发送的消息数")
+	flag.IntVar(&cfg.fanout, "fanout", 1, "每条消息发送给多少个用户")
+	flag.IntVar(&cfg.size, "size", 64, "消息的字节数")
+	flag.BoolVar(&cfg.compress, "compress", false, "请求 permessage-deflate 压缩")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "压测时长，从所有客户端开始连接时计算")
+	flag.DurationVar(&cfg.report, "report", 10*time.Second, "输出统计的间隔")
+	flag.DurationVar(&cfg.drain, "drain", 2*time.Second, "停止发送后等待消息送达的时间")
+	flag.BoolVar(&cfg.soak, "soak", false, "定期检查服务端的 goroutine 和堆内存是否持续增长")
+	flag.DurationVar(&cfg.sample, "sample", time.Minute, "soak 模式采样 /debug/vars 的间隔")
+	flag.Float64Var(&cfg.growth, "growth", 1.5, "soak 模式超过基线多少倍时报警")
+	flag.IntVar(&cfg.trend, "trend", 5, "soak 模式连续多少次采样增长时报警")
+	flag.Parse()
+
+	if cfg.clients < 1 || cfg.connectRate <= 0 || cfg.msgRate < 0 || cfg.fanout < 1 || cfg.size < 0 {
+		return errors.New("clients, connect-rate and fanout must be positive, msg-rate and size must not be negative")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	lt := newLoadTest(cfg)
+
+	fmt.Printf("starting %d clients at %.0f/s, %.1f msg/s each, fanout %d, %d bytes, for %s\n",
+		cfg.clients, cfg.connectRate, cfg.msgRate, cfg.fanout, cfg.size, cfg.duration)
+
+	lt.start(ctx)
+
+	if len(lt.monitor.flagged) > 0 {
+		return fmt.Errorf("%d possible leaks detected", len(lt.monitor.flagged))
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+type loadTest struct {
+	cfg     config
+	stats   *stats
+	monitor *monitor
+
+	mu      sync.RWMutex
+	clients []*client.Client
+
+	// connectErr 只输出第一次连接失败的原因，比如服务端的 HTTP 限流
+	connectErr sync.Once
+}
+
+func newLoadTest(cfg config) *loadTest {
+	return &loadTest{
+		cfg:     cfg,
+		stats:   newStats(),
+		monitor: newMonitor(cfg.debugURL, cfg.growth, cfg.trend),
+	}
+}
+
+// start 建立连接、发送消息并定期输出统计，直到压测时间结束或者 ctx 取消
+func (lt *loadTest) start(ctx context.Context) {
+	begin := time.Now()
+
+	runCtx, cancel := context.WithTimeout(ctx, lt.cfg.duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lt.connectAll(runCtx, &wg)
+	}()
+
+	lt.reportLoop(runCtx, begin)
+
+	// 停止发送，等待还在路上的消息
+	wg.Wait()
+	if ctx.Err() == nil {
+		time.Sleep(lt.cfg.drain)
+	}
+
+	lt.mu.Lock()
+	for _, c := range lt.clients {
+		c.Close()
+	}
+	lt.mu.Unlock()
+
+	fmt.Println("final:")
+	fmt.Println(lt.stats.report(time.Since(begin)))
+
+	if lt.cfg.soak {
+		fmt.Printf("soak: %d warnings\n", len(lt.monitor.flagged))
+		for _, f := range lt.monitor.flagged {
+			fmt.Println("  " + f)
+		}
+	}
+}
+
+// connectAll 按 connect-rate 建立连接，每个连接成功后开始发送消息
+func (lt *loadTest) connectAll(ctx context.Context, wg *sync.WaitGroup) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / lt.cfg.connectRate))
+	defer ticker.Stop()
+
+	for i := 0; i < lt.cfg.clients; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c, err := lt.connect(ctx, i)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				lt.stats.connectFails.Add(1)
+				lt.connectErr.Do(func() {
+					fmt.Println("connect failed:", err)
+				})
+				return
+			}
+
+			lt.sendLoop(ctx, c)
+		}()
+	}
+}
+
+func (lt *loadTest) connect(ctx context.Context, i int) (*client.Client, error) {
+	start := time.Now()
+
+	c, err := client.Dial(ctx, lt.cfg.url, client.Options{
+		User:        client.User{ID: uuid.New(), Name: fmt.Sprintf("load-%d", i)},
+		Compression: lt.cfg.compress,
+		OnEvent:     lt.handleEvent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lt.stats.handshake.record(time.Since(start))
+
+	lt.mu.Lock()
+	lt.clients = append(lt.clients, c)
+	lt.mu.Unlock()
+
+	return c, nil
+}
+
+// handleEvent 在每个客户端读取消息的 goroutine 中调用
+func (lt *loadTest) handleEvent(e client.Event) {
+	switch e.Kind {
+	case client.EventConnected:
+		lt.stats.connected.Add(1)
+
+	case client.EventDisconnected:
+		lt.stats.connected.Add(-1)
+		lt.stats.disconnects.Add(1)
+
+	case client.EventError:
+		lt.stats.addError(e.Error.Code)
+
+	case client.EventMessage:
+		sent, ok := parsePayload(e.Message.Msg)
+		if !ok {
+			return
+		}
+		lt.stats.delivered.Add(1)
+		lt.stats.delivery.record(time.Since(sent))
+	}
+}
+
+// sendLoop 按 msg-rate 发送消息，间隔加入随机抖动，避免所有客户端同时发送
+func (lt *loadTest) sendLoop(ctx context.Context, c *client.Client) {
+	if lt.cfg.msgRate == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	interval := time.Duration(float64(time.Second) / lt.cfg.msgRate)
+	for {
+		wait := interval/2 + time.Duration(rand.Int63n(int64(interval)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		for _, to := range lt.recipients(c.User().ID) {
+			if err := c.Send(ctx, to, payload(lt.cfg.size)); err != nil {
+				lt.stats.sendFails.Add(1)
+				continue
+			}
+			lt.stats.sent.Add(1)
+		}
+	}
+}
+
+// recipients 随机选择 fanout 个其它客户端，客户端不够时发送给自己
+func (lt *loadTest) recipients(self uuid.UUID) []uuid.UUID {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+
+	n := min(lt.cfg.fanout, len(lt.clients)-1)
+	if n <= 0 {
+		return []uuid.UUID{self}
+	}
+
+	ids := make([]uuid.UUID, 0, n)
+	for _, i := range rand.Perm(len(lt.clients)) {
+		id := lt.clients[i].User().ID
+		if id == self {
+			continue
+		}
+		ids = append(ids, id)
+		if len(ids) == n {
+			break
+		}
+	}
+
+	return ids
+}
+
+// reportLoop 定期输出统计，soak 模式同时采样服务端的运行状态
+func (lt *loadTest) reportLoop(ctx context.Context, begin time.Time) {
+	report := time.NewTicker(lt.cfg.report)
+	defer report.Stop()
+
+	var sample <-chan time.Time
+	if lt.cfg.soak {
+		t := time.NewTicker(lt.cfg.sample)
+		defer t.Stop()
+		sample = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-report.C:
+			fmt.Println(lt.stats.report(time.Since(begin)))
+
+		case <-sample:
+			desc, err := lt.monitor.check(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Println("soak: sample failed:", err)
+				continue
+			}
+			fmt.Println("soak:", desc)
+		}
+	}
+}
+
+// =============================================================================
+
+func payload(size int) string {
+	p := payloadPrefix + strconv.FormatInt(time.Now().UnixNano(), 10) + "|"
+	if n := size - len(p); n > 0 {
+		p += strings.Repeat("x", n)
+	}
+	return p
+}
+
+func parsePayload(msg string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(msg, payloadPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ts, _, _ := strings.Cut(rest, "|")
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ns), true
+}
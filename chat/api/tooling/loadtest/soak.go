@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sample 从调试端口的 /debug/vars 读取的一次采样
+type sample struct {
+	at         time.Time
+	goroutines int64
+	heapInuse  int64
+	users      int64
+}
+
+// vars /debug/vars 中需要的字段
+type vars struct {
+	Goroutines int64 `json:"goroutines"`
+	Runtime    struct {
+		HeapInuse int64 `json:"heapInuse"`
+	} `json:"runtime"`
+	Chat struct {
+		Users int64 `json:"users"`
+	} `json:"chat"`
+}
+
+// monitor 定期采样服务端的 goroutine 数量和堆内存，发现持续增长时报警
+// 第一次采样作为基线，之后超过基线 growth 倍并且最近 trend 次采样持续增长时认为可能泄漏
+type monitor struct {
+	url    string
+	growth float64
+	trend  int
+
+	baseline *sample
+	samples  []sample
+	flagged  []string
+}
+
+func newMonitor(debugURL string, growth float64, trend int) *monitor {
+	return &monitor{
+		url:    strings.TrimRight(debugURL, "/") + "/debug/vars",
+		growth: growth,
+		trend:  trend,
+	}
+}
+
+func (m *monitor) fetch(ctx context.Context) (sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return sample{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return sample{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return sample{}, fmt.Errorf("debug vars: %s", resp.Status)
+	}
+
+	var v vars
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return sample{}, fmt.Errorf("decode debug vars: %w", err)
+	}
+
+	return sample{
+		at:         time.Now(),
+		goroutines: v.Goroutines,
+		heapInuse:  v.Runtime.HeapInuse,
+		users:      v.Chat.Users,
+	}, nil
+}
+
+// check 采样一次并返回采样的描述，发现增长时记录报警
+func (m *monitor) check(ctx context.Context) (string, error) {
+	s, err := m.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if m.baseline == nil {
+		m.baseline = &s
+	}
+
+	m.samples = append(m.samples, s)
+	if len(m.samples) > m.trend {
+		m.samples = m.samples[1:]
+	}
+
+	desc := fmt.Sprintf("server goroutines=%d heapInuse=%.1fMiB users=%d",
+		s.goroutines, float64(s.heapInuse)/(1<<20), s.users)
+
+	if m.growing(func(s sample) int64 { return s.goroutines }) {
+		m.flag(fmt.Sprintf("%s goroutines grew from %d to %d", s.at.Format(time.TimeOnly), m.baseline.goroutines, s.goroutines))
+	}
+
+	if m.growing(func(s sample) int64 { return s.heapInuse }) {
+		m.flag(fmt.Sprintf("%s heapInuse grew from %d to %d bytes", s.at.Format(time.TimeOnly), m.baseline.heapInuse, s.heapInuse))
+	}
+
+	return desc, nil
+}
+
+// growing 最新的值超过基线的 growth 倍，并且最近 trend 次采样单调增长
+func (m *monitor) growing(value func(sample) int64) bool {
+	if len(m.samples) < m.trend {
+		return false
+	}
+
+	last := m.samples[len(m.samples)-1]
+	if float64(value(last)) < float64(value(*m.baseline))*m.growth {
+		return false
+	}
+
+	for i := 1; i < len(m.samples); i++ {
+		if value(m.samples[i]) <= value(m.samples[i-1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *monitor) flag(msg string) {
+	m.flagged = append(m.flagged, msg)
+	fmt.Println("WARNING possible leak:", msg)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histogram 指数分桶的延迟直方图，内存占用固定，适合长时间运行
+// 每个桶的上限是上一个桶的 1.1 倍，百分位的误差在 10% 以内
+type histogram struct {
+	mu      sync.Mutex
+	buckets []int64
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+const (
+	histMin    = 10 * time.Microsecond
+	histFactor = 1.1
+	histSize   = 200
+)
+
+func newHistogram() *histogram {
+	return &histogram{
+		buckets: make([]int64, histSize),
+	}
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := 0
+	if d > histMin {
+		i = int(math.Ceil(math.Log(float64(d)/float64(histMin)) / math.Log(histFactor)))
+		i = min(i, histSize-1)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+// percentile 返回 p（0-100）百分位所在桶的上限
+func (h *histogram) percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return 0
+	}
+
+	target := int64(math.Ceil(float64(h.count) * p / 100))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= target {
+			return min(time.Duration(float64(histMin)*math.Pow(histFactor, float64(i))), h.max)
+		}
+	}
+
+	return h.max
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	count, sum, mx := h.count, h.sum, h.max
+	h.mu.Unlock()
+
+	if count == 0 {
+		return "n=0"
+	}
+
+	return fmt.Sprintf("n=%d avg=%s p50=%s p90=%s p99=%s max=%s",
+		count,
+		round(sum/time.Duration(count)),
+		round(h.percentile(50)),
+		round(h.percentile(90)),
+		round(h.percentile(99)),
+		round(mx))
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// =============================================================================
+
+// stats 压测过程中的计数，所有字段可以并发更新
+type stats struct {
+	connected    atomic.Int64
+	connectFails atomic.Int64
+	disconnects  atomic.Int64
+	sent         atomic.Int64
+	sendFails    atomic.Int64
+	delivered    atomic.Int64
+
+	handshake *histogram
+	delivery  *histogram
+
+	mu     sync.Mutex
+	errors map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{
+		handshake: newHistogram(),
+		delivery:  newHistogram(),
+		errors:    make(map[string]int64),
+	}
+}
+
+// addError 按错误码统计服务端返回的错误帧
+func (s *stats) addError(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errors[code]++
+}
+
+func (s *stats) errorSummary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.errors) == 0 {
+		return "none"
+	}
+
+	codes := make([]string, 0, len(s.errors))
+	for code := range s.errors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%s=%d", code, s.errors[code]))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// report 输出当前的统计，dropped 是已经发送但是还没有送达的消息，压测结束时才是真正丢失的消息
+func (s *stats) report(elapsed time.Duration) string {
+	sent := s.sent.Load()
+	delivered := s.delivered.Load()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "elapsed=%s clients=%d connect_fails=%d disconnects=%d\n",
+		elapsed.Round(time.Second), s.connected.Load(), s.connectFails.Load(), s.disconnects.Load())
+	fmt.Fprintf(&b, "  messages sent=%d send_fails=%d delivered=%d undelivered=%d rate=%.1f/s\n",
+		sent, s.sendFails.Load(), delivered, sent-delivered, float64(delivered)/max(elapsed.Seconds(), 1))
+	fmt.Fprintf(&b, "  handshake %s\n", s.handshake)
+	fmt.Fprintf(&b, "  delivery  %s\n", s.delivery)
+	fmt.Fprintf(&b, "  server errors %s", s.errorSummary())
+
+	return b.String()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field 结构化日志中的一个字段，保持日志中的顺序
+type field struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// Entry 表示一条解析后的日志
+type Entry struct {
+	Time       time.Time
+	RawTime    string
+	Level      string
+	Logger     string
+	Caller     string
+	Message    string
+	Stacktrace string
+	Fields     []field
+}
+
+// Field 返回字段的字符串值，不存在时返回空字符串
+func (e Entry) Field(key string) string {
+	for _, f := range e.Fields {
+		if f.Key == key {
+			return valueString(f.Value)
+		}
+	}
+	return ""
+}
+
+// =============================================================================
+
+// zap 的 json 和 console 编码使用的 key，timestamp 和 message 兼容旧的日志
+var (
+	timeKeys    = []string{"ts", "time", "timestamp"}
+	levelKeys   = []string{"level"}
+	loggerKeys  = []string{"logger"}
+	callerKeys  = []string{"caller"}
+	messageKeys = []string{"msg", "message"}
+	stackKeys   = []string{"stacktrace"}
+)
+
+// callerRE 匹配 console 编码中的调用位置，比如 chat/chat.go:120
+var callerRE = regexp.MustCompile(`^\S+\.go:\d+$`)
+
+var errNotLog = errors.New("not a log line")
+
+// parseLine 解析 zap json 或者 console 编码的一行日志
+func parseLine(line string) (Entry, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		return parseJSON(line)
+	}
+	return parseConsole(line)
+}
+
+// parseJSON 解析 json 编码的日志，比如
+// {"level":"INFO","ts":"2024-01-01T00:00:00.000Z","caller":"mid/logger.go:24","msg":"request started","uuid":"..."}
+func parseJSON(line string) (Entry, error) {
+	fields, err := parseObject(line)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	var e Entry
+	for _, f := range fields {
+		switch {
+		case contains(timeKeys, f.Key) && e.RawTime == "":
+			e.RawTime = valueString(f.Value)
+			e.Time = parseTime(f.Value)
+			// epoch 时间转换为和 ISO8601 编码一致的格式
+			if !strings.HasPrefix(string(f.Value), `"`) && !e.Time.IsZero() {
+				e.RawTime = e.Time.UTC().Format("2006-01-02T15:04:05.000Z0700")
+			}
+		case contains(levelKeys, f.Key) && e.Level == "":
+			e.Level = strings.ToUpper(valueString(f.Value))
+		case contains(loggerKeys, f.Key) && e.Logger == "":
+			e.Logger = valueString(f.Value)
+		case contains(callerKeys, f.Key) && e.Caller == "":
+			e.Caller = valueString(f.Value)
+		case contains(messageKeys, f.Key) && e.Message == "":
+			e.Message = valueString(f.Value)
+		case contains(stackKeys, f.Key) && e.Stacktrace == "":
+			e.Stacktrace = valueString(f.Value)
+		default:
+			e.Fields = append(e.Fields, f)
+		}
+	}
+
+	if e.Level == "" {
+		return Entry{}, errNotLog
+	}
+
+	return e, nil
+}
+
+// parseConsole 解析 console 编码的日志，各部分使用 tab 分隔，比如
+// 2024-01-01T00:00:00.000Z	INFO	chat	chat/chat.go:120	add user	{"user": "..."}
+// logger 名字和结构化字段是可选的
+func parseConsole(line string) (Entry, error) {
+	parts := strings.Split(line, "\t")
+	if len(parts) < 3 {
+		return Entry{}, errNotLog
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		if t, err = time.Parse("2006-01-02T15:04:05.000Z0700", parts[0]); err != nil {
+			return Entry{}, errNotLog
+		}
+	}
+
+	e := Entry{
+		Time:    t,
+		RawTime: parts[0],
+		Level:   strings.ToUpper(parts[1]),
+	}
+	parts = parts[2:]
+
+	// 最后一部分是 json 对象时为结构化字段
+	if n := len(parts); n > 1 && strings.HasPrefix(parts[n-1], "{") {
+		if fields, err := parseObject(parts[n-1]); err == nil {
+			e.Fields = fields
+			parts = parts[:n-1]
+		}
+	}
+
+	// 调用位置之前的是 logger 名字，之后的是消息
+	for i, p := range parts {
+		if callerRE.MatchString(p) {
+			e.Logger = strings.Join(parts[:i], "\t")
+			e.Caller = p
+			parts = parts[i+1:]
+			break
+		}
+	}
+
+	e.Message = strings.Join(parts, "\t")
+
+	return e, nil
+}
+
+// parseObject 按顺序解析 json 对象的字段
+func parseObject(s string) ([]field, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, errNotLog
+	}
+
+	var fields []field
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errNotLog
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field{Key: key, Value: raw})
+	}
+
+	return fields, nil
+}
+
+// parseTime 支持 ISO8601 字符串和 epoch 秒
+func parseTime(raw json.RawMessage) time.Time {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z0700"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+		return time.Time{}
+	}
+
+	f, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9))
+}
+
+// valueString 字符串返回原始内容，其它类型返回紧凑的 json
+func valueString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -1,42 +1,329 @@
+// logfmt 把服务输出的 zap 日志（json 或者 console 编码）格式化为便于阅读的形式
+//
+// 使用方式：
+//
+//	tail -f logs/info.log | go run ./chat/api/tooling/logfmt -level warn
+//	go run ./chat/api/tooling/logfmt -uuid 4bf92f35 -group < logs/info.log
 package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"go.uber.org/zap/zapcore"
+	"io"
 	"os"
 	"strings"
+	"time"
 )
 
-// LogEntry 结构体表示日志条目
-type LogEntry struct {
-	Level     string `json:"level"`
-	Timestamp string `json:"timestamp"`
-	Message   string `json:"message"`
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "logfmt:", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	// 假设日志来自标准输入（例如 `tail -f log.json | go run main.go`）
-	scanner := bufio.NewScanner(os.Stdin)
+func run() error {
+	var (
+		level = flag.String("level", "", "只显示不低于该级别的日志：debug、info、warn、error")
+		trace = flag.String("uuid", "", "只显示该 trace uuid 的日志，支持前缀匹配")
+		user  = flag.String("user", "", "只显示该用户 ID 的日志")
+		grep  = flag.String("grep", "", "只显示消息中包含该字符串的日志")
+		since = flag.String("since", "", "只显示该时间之后的日志，RFC3339 格式或者相对时间，比如 10m")
+		until = flag.String("until", "", "只显示该时间之前的日志，RFC3339 格式或者相对时间，比如 1m")
+		group = flag.Bool("group", false, "读取全部日志后按 trace uuid 分组输出")
+		color = flag.String("color", "auto", "是否使用颜色：auto、always、never")
+	)
+	flag.Parse()
+
+	var f filter
+	var err error
+
+	if *level != "" {
+		if f.level, err = zapcore.ParseLevel(*level); err != nil {
+			return err
+		}
+		f.hasLevel = true
+	}
+	if f.since, err = parseTimeFlag(*since); err != nil {
+		return fmt.Errorf("since: %w", err)
+	}
+	if f.until, err = parseTimeFlag(*until); err != nil {
+		return fmt.Errorf("until: %w", err)
+	}
+	f.trace = *trace
+	f.user = *user
+	f.grep = *grep
+
+	p := printer{
+		w: bufio.NewWriter(os.Stdout),
+	}
+	defer p.w.Flush()
 
+	switch *color {
+	case "auto":
+		p.color = isTerminal(os.Stdout)
+	case "always":
+		p.color = true
+	case "never":
+	default:
+		return fmt.Errorf("unknown color mode %q", *color)
+	}
+
+	if *group {
+		return groupByTrace(os.Stdin, f, p)
+	}
+
+	return stream(os.Stdin, f, p)
+}
+
+// stream 逐行读取并输出，适合 tail -f
+// 无法解析的行（比如 console 编码的堆栈）跟随上一条日志输出
+func stream(r io.Reader, f filter, p printer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var shown bool
 	for scanner.Scan() {
-		line := scanner.Text() // 读取日志行
+		line := scanner.Text()
 
-		var log LogEntry
-		err := json.Unmarshal([]byte(line), &log)
+		e, err := parseLine(line)
 		if err != nil {
-			fmt.Println("解析失败:", err)
+			if shown || f.empty() {
+				p.raw(line)
+			}
 			continue
 		}
 
-		// 格式化日志输出
-		fmt.Printf("[%s] %s\n", log.Level, log.Timestamp)
-		fmt.Println("  " + strings.ReplaceAll(log.Message, "\n", "\n  ")) // 处理换行
-		fmt.Println("-----------------------------------")
+		shown = f.match(e)
+		if shown {
+			p.print(e)
+		}
+
+		// 交互使用时及时输出
+		p.w.Flush()
+	}
+
+	return scanner.Err()
+}
+
+// groupByTrace 读取全部日志后按 trace uuid 分组，组按第一次出现的顺序输出
+// 没有 uuid 的日志放在最后
+func groupByTrace(r io.Reader, f filter, p printer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var order []string
+	groups := make(map[string][]Entry)
+
+	var last *Entry
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		e, err := parseLine(line)
+		if err != nil {
+			if last != nil {
+				last.Stacktrace = strings.TrimPrefix(last.Stacktrace+"\n"+line, "\n")
+			}
+			continue
+		}
+
+		last = nil
+		if !f.match(e) {
+			continue
+		}
+
+		id := e.Field("uuid")
+		if _, exists := groups[id]; !exists && id != "" {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], e)
+		last = &groups[id][len(groups[id])-1]
 	}
 
-	// 检查扫描错误
 	if err := scanner.Err(); err != nil {
-		fmt.Println("读取日志时出错:", err)
+		return err
+	}
+
+	if _, exists := groups[""]; exists {
+		order = append(order, "")
+	}
+
+	for i, id := range order {
+		if i > 0 {
+			p.raw("")
+		}
+		p.header(id, groups[id])
+		for _, e := range groups[id] {
+			p.print(e)
+		}
+	}
+
+	return nil
+}
+
+// parseTimeFlag 支持 RFC3339 时间和相对于当前时间的时长
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// =============================================================================
+
+// filter 日志的过滤条件，零值不过滤
+type filter struct {
+	level    zapcore.Level
+	hasLevel bool
+	trace    string
+	user     string
+	grep     string
+	since    time.Time
+	until    time.Time
+}
+
+func (f filter) empty() bool {
+	return !f.hasLevel && f.trace == "" && f.user == "" && f.grep == "" && f.since.IsZero() && f.until.IsZero()
+}
+
+func (f filter) match(e Entry) bool {
+	if f.hasLevel {
+		lvl, err := zapcore.ParseLevel(e.Level)
+		if err == nil && lvl < f.level {
+			return false
+		}
+	}
+
+	if f.trace != "" && !strings.HasPrefix(e.Field("uuid"), f.trace) {
+		return false
+	}
+
+	if f.user != "" && e.Field("user") != f.user {
+		return false
+	}
+
+	if f.grep != "" && !strings.Contains(e.Message, f.grep) {
+		return false
+	}
+
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+
+	if !f.until.IsZero() && e.Time.After(f.until) {
+		return false
+	}
+
+	return true
+}
+
+// =============================================================================
+
+const (
+	colorReset  = "\x1b[0m"
+	colorGray   = "\x1b[90m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorBlue   = "\x1b[34m"
+	colorCyan   = "\x1b[36m"
+	colorBold   = "\x1b[1m"
+)
+
+type printer struct {
+	w     *bufio.Writer
+	color bool
+}
+
+func (p printer) paint(color string, s string) string {
+	if !p.color || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// print 输出一行：时间 级别 [logger] 调用位置 消息 key=value...
+// 有堆栈时在后面缩进输出
+func (p printer) print(e Entry) {
+	var b strings.Builder
+
+	b.WriteString(p.paint(colorGray, e.RawTime))
+	b.WriteString(" ")
+	b.WriteString(p.paint(levelColor(e.Level), fmt.Sprintf("%-5s", e.Level)))
+
+	if e.Logger != "" {
+		b.WriteString(" ")
+		b.WriteString(p.paint(colorBlue, "["+e.Logger+"]"))
+	}
+
+	if e.Caller != "" {
+		b.WriteString(" ")
+		b.WriteString(p.paint(colorGray, e.Caller))
+	}
+
+	b.WriteString(" ")
+	b.WriteString(p.paint(colorBold, e.Message))
+
+	for _, f := range e.Fields {
+		// 只有字符串需要加引号，对象和数组保持 json 格式
+		v := valueString(f.Value)
+		if strings.HasPrefix(string(f.Value), `"`) && (v == "" || strings.ContainsAny(v, " \t\n\"")) {
+			v = fmt.Sprintf("%q", v)
+		}
+
+		b.WriteString(" ")
+		b.WriteString(p.paint(colorCyan, f.Key+"="))
+		b.WriteString(v)
+	}
+
+	fmt.Fprintln(p.w, b.String())
+
+	if e.Stacktrace != "" {
+		fmt.Fprintln(p.w, "    "+strings.ReplaceAll(e.Stacktrace, "\n", "\n    "))
+	}
+}
+
+func (p printer) raw(line string) {
+	fmt.Fprintln(p.w, line)
+}
+
+func (p printer) header(id string, entries []Entry) {
+	title := "trace " + id
+	if id == "" {
+		title = "no trace"
+	}
+
+	var span string
+	if first, last := entries[0].Time, entries[len(entries)-1].Time; !first.IsZero() && !last.IsZero() {
+		span = ", " + last.Sub(first).String()
+	}
+
+	fmt.Fprintln(p.w, p.paint(colorBold, fmt.Sprintf("=== %s (%d lines%s)", title, len(entries), span)))
+}
+
+func levelColor(level string) string {
+	switch level {
+	case "DEBUG":
+		return colorGray
+	case "INFO":
+		return colorGreen
+	case "WARN":
+		return colorYellow
 	}
+	return colorRed
 }
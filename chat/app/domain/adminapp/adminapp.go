@@ -0,0 +1,198 @@
+// Package adminapp 提供在线连接、房间和隔离消息的管理接口
+package adminapp
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"net/http"
+)
+
+type app struct {
+	chat   *chat.Chat
+	levels *logger.Levels
+	auth   *auth.Authenticator
+}
+
+func newApp(c *chat.Chat, levels *logger.Levels, a *auth.Authenticator) *app {
+	return &app{
+		chat:   c,
+		levels: levels,
+		auth:   a,
+	}
+}
+
+func (a *app) querySessions(c *gin.Context) {
+	sessions := a.chat.Sessions()
+
+	c.JSON(http.StatusOK, sessionList{
+		Total: len(sessions),
+		Items: sessions,
+	})
+}
+
+// queryRooms 查询参数 userID 不为空时只返回该用户所在的房间
+func (a *app) queryRooms(c *gin.Context) {
+	var userID uuid.UUID
+	if v := c.Query("userID"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			c.Error(errs.Newf(errs.InvalidArgument, "invalid userID: %v", err))
+			return
+		}
+		userID = id
+	}
+
+	rooms := a.chat.Rooms(userID)
+
+	c.JSON(http.StatusOK, roomList{
+		Total: len(rooms),
+		Items: rooms,
+	})
+}
+
+func (a *app) kick(c *gin.Context) {
+	sessionID, err := uuid.Parse(c.Param("sessionID"))
+	if err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid sessionID: %v", err))
+		return
+	}
+
+	// reason 可以放在请求体中，也可以放在查询参数中
+	var k kick
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&k); err != nil {
+			c.Error(errs.Newf(errs.InvalidArgument, "invalid body: %v", err))
+			return
+		}
+	}
+	if k.Reason == "" {
+		k.Reason = c.DefaultQuery("reason", "kicked by admin")
+	}
+
+	if err := a.chat.Kick(c.Request.Context(), sessionID, k.Reason); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (a *app) announce(c *gin.Context) {
+	var an announcement
+	if err := c.ShouldBindJSON(&an); err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid body: %v", err))
+		return
+	}
+
+	if an.Msg == "" {
+		c.Error(errs.Newf(errs.InvalidArgument, "msg is required"))
+		return
+	}
+
+	sent := a.chat.Broadcast(c.Request.Context(), an.Msg)
+
+	c.JSON(http.StatusOK, announcementResult{
+		Sent: sent,
+	})
+}
+
+func (a *app) queryQuarantine(c *gin.Context) {
+	items, err := a.chat.Quarantined(c.Request.Context())
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, quarantineList{
+		Total: len(items),
+		Items: items,
+	})
+}
+
+func (a *app) releaseQuarantined(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid id: %v", err))
+		return
+	}
+
+	if err := a.chat.ReleaseQuarantined(c.Request.Context(), id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (a *app) discardQuarantined(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid id: %v", err))
+		return
+	}
+
+	if err := a.chat.DiscardQuarantined(c.Request.Context(), id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// issueToken 为用户签发调用 /v1 接口和握手使用的 token
+func (a *app) issueToken(c *gin.Context) {
+	var tr tokenRequest
+	if err := c.ShouldBindJSON(&tr); err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid body: %v", err))
+		return
+	}
+
+	if tr.UserID == uuid.Nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "userID is required"))
+		return
+	}
+
+	token, expiresAt, err := a.auth.Issue(tr.UserID)
+	if err != nil {
+		c.Error(errs.Newf(errs.FailedPrecondition, "%v", err))
+		return
+	}
+
+	logger.FromContext(c.Request.Context()).Infow("issue token", "user", tr.UserID, "expiresAt", expiresAt)
+
+	c.JSON(http.StatusOK, tokenResult{
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (a *app) queryLogLevels(c *gin.Context) {
+	global, components := a.levels.Snapshot()
+
+	c.JSON(http.StatusOK, logLevels{
+		Global:     global,
+		Components: components,
+	})
+}
+
+// setLogLevel component 为空时修改全局级别，level 为空时删除组件的级别
+func (a *app) setLogLevel(c *gin.Context) {
+	var ll logLevel
+	if err := c.ShouldBindJSON(&ll); err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid body: %v", err))
+		return
+	}
+
+	if err := a.levels.SetLevel(ll.Component, ll.Level); err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "%v", err))
+		return
+	}
+
+	logger.FromContext(c.Request.Context()).Infow("set log level", "component", ll.Component, "level", ll.Level)
+
+	a.queryLogLevels(c)
+}
@@ -0,0 +1,53 @@
+package adminapp
+
+import (
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"time"
+)
+
+type sessionList struct {
+	Total int            `json:"total"`
+	Items []chat.Session `json:"items"`
+}
+
+type roomList struct {
+	Total int         `json:"total"`
+	Items []chat.Room `json:"items"`
+}
+
+type kick struct {
+	Reason string `json:"reason"`
+}
+
+type announcement struct {
+	Msg string `json:"msg"`
+}
+
+type announcementResult struct {
+	Sent int `json:"sent"`
+}
+
+type quarantineList struct {
+	Total int                       `json:"total"`
+	Items []chat.QuarantinedMessage `json:"items"`
+}
+
+type tokenRequest struct {
+	UserID uuid.UUID `json:"userID"`
+}
+
+type tokenResult struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type logLevels struct {
+	Global     string            `json:"global"`
+	Components map[string]string `json:"components"`
+}
+
+type logLevel struct {
+	Component string `json:"component"`
+	Level     string `json:"level"`
+}
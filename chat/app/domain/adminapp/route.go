@@ -0,0 +1,34 @@
+package adminapp
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+)
+
+// Config 包含路由需要的配置
+type Config struct {
+	Chat   *chat.Chat
+	Levels *logger.Levels
+	// Auth 为用户签发 token
+	Auth  *auth.Authenticator
+	Token string
+}
+
+func Routes(app *gin.Engine, cfg Config) {
+	api := newApp(cfg.Chat, cfg.Levels, cfg.Auth)
+
+	admin := app.Group("/admin", mid.AdminToken(cfg.Token))
+	admin.GET("/sessions", api.querySessions)
+	admin.DELETE("/sessions/:sessionID", api.kick)
+	admin.POST("/announcements", api.announce)
+	admin.GET("/rooms", api.queryRooms)
+	admin.GET("/quarantine", api.queryQuarantine)
+	admin.POST("/quarantine/:id/release", api.releaseQuarantined)
+	admin.DELETE("/quarantine/:id", api.discardQuarantined)
+	admin.POST("/tokens", api.issueToken)
+	admin.GET("/log-levels", api.queryLogLevels)
+	admin.PUT("/log-levels", api.setLogLevel)
+}
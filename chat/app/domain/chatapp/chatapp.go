@@ -2,24 +2,42 @@ package chatapp
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
 	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"net/http"
+	"sync/atomic"
 )
 
 type app struct {
-	Chat *chat.Chat
+	Chat         *chat.Chat
+	shuttingDown *atomic.Bool
 }
 
-func NewApp() *app {
+// NewApp shuttingDown 可以为 nil
+func NewApp(c *chat.Chat, shuttingDown *atomic.Bool) *app {
+	if shuttingDown == nil {
+		shuttingDown = new(atomic.Bool)
+	}
+
 	return &app{
-		Chat: chat.NewChat(),
+		Chat:         c,
+		shuttingDown: shuttingDown,
 	}
 }
 
 func (a *app) connect(c *gin.Context) {
 	ctx := c.Request.Context()
 
+	// 排空期间就绪检查已经失败，负载均衡器摘除实例之前到达的连接也不再升级，客户端应该连接其他实例
+	if a.shuttingDown.Load() {
+		c.Error(errs.Newf(errs.Unavailable, "server is shutting down"))
+		return
+	}
+
 	usr, err := a.Chat.HandleShake(ctx, c.Writer, c.Request)
+	metrics.AddHandshake(err == nil)
 	if err != nil {
 		c.Error(errs.Newf(errs.FailedPrecondition, "handshake failed: %v", err))
 		return
@@ -31,6 +49,101 @@ func (a *app) connect(c *gin.Context) {
 
 }
 
+func (a *app) queryBlocks(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("userID"))
+	if err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid userID: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, relationList{
+		UserID: userID,
+		Items:  a.Chat.Blocked(userID),
+	})
+}
+
+func (a *app) block(c *gin.Context) {
+	userID, targetID, err := parseRelation(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.Chat.Block(c.Request.Context(), userID, targetID)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (a *app) unblock(c *gin.Context) {
+	userID, targetID, err := parseRelation(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.Chat.Unblock(c.Request.Context(), userID, targetID)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (a *app) queryMutes(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("userID"))
+	if err != nil {
+		c.Error(errs.Newf(errs.InvalidArgument, "invalid userID: %v", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, relationList{
+		UserID: userID,
+		Items:  a.Chat.Muted(userID),
+	})
+}
+
+func (a *app) mute(c *gin.Context) {
+	userID, targetID, err := parseRelation(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.Chat.Mute(c.Request.Context(), userID, targetID)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (a *app) unmute(c *gin.Context) {
+	userID, targetID, err := parseRelation(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	a.Chat.Unmute(c.Request.Context(), userID, targetID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseRelation 解析路径中的 userID 和 targetID
+func parseRelation(c *gin.Context) (uuid.UUID, uuid.UUID, error) {
+	userID, err := uuid.Parse(c.Param("userID"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errs.Newf(errs.InvalidArgument, "invalid userID: %v", err)
+	}
+
+	targetID, err := uuid.Parse(c.Param("targetID"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errs.Newf(errs.InvalidArgument, "invalid targetID: %v", err)
+	}
+
+	if userID == targetID {
+		return uuid.Nil, uuid.Nil, errs.Newf(errs.InvalidArgument, "userID and targetID must be different")
+	}
+
+	return userID, targetID, nil
+}
+
+// =============================================================================
+
 func (a *app) test(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"message": "Hello World",
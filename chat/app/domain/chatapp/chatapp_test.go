@@ -0,0 +1,155 @@
+package chatapp_test
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// request 发送请求并返回状态码，token 为空时不设置 Authorization
+func request(t *testing.T, srv *chattest.Server, method string, path string, token string) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.HTTP.URL+path, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := srv.HTTP.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var body json.RawMessage
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	return resp.StatusCode, body
+}
+
+func TestRelationsRequireOwner(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := uuid.New()
+	bob := uuid.New()
+	aliceToken := srv.Token(t, alice)
+	bobToken := srv.Token(t, bob)
+
+	// 篡改 token 中的用户 ID，签名不再匹配
+	tampered := srv.Token(t, alice)
+	tampered = "A" + tampered[1:]
+	if tampered == aliceToken {
+		tampered = "B" + tampered[1:]
+	}
+
+	paths := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/v1/users/" + alice.String() + "/blocks"},
+		{http.MethodPut, "/v1/users/" + alice.String() + "/blocks/" + bob.String()},
+		{http.MethodDelete, "/v1/users/" + alice.String() + "/blocks/" + bob.String()},
+		{http.MethodGet, "/v1/users/" + alice.String() + "/mutes"},
+		{http.MethodPut, "/v1/users/" + alice.String() + "/mutes/" + bob.String()},
+		{http.MethodDelete, "/v1/users/" + alice.String() + "/mutes/" + bob.String()},
+	}
+
+	tokens := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "no token", token: "", want: http.StatusUnauthorized},
+		{name: "garbage", token: "garbage", want: http.StatusUnauthorized},
+		{name: "tampered", token: tampered, want: http.StatusUnauthorized},
+		{name: "other user", token: bobToken, want: http.StatusForbidden},
+	}
+
+	for _, tk := range tokens {
+		t.Run(tk.name, func(t *testing.T) {
+			for _, p := range paths {
+				if code, body := request(t, srv, p.method, p.path, tk.token); code != tk.want {
+					t.Errorf("%s %s: got status %d (%s), want %d", p.method, p.path, code, body, tk.want)
+				}
+			}
+
+			if blocked := srv.Chat.Blocked(alice); len(blocked) != 0 {
+				t.Errorf("alice's blocks were changed: %v", blocked)
+			}
+			if muted := srv.Chat.Muted(alice); len(muted) != 0 {
+				t.Errorf("alice's mutes were changed: %v", muted)
+			}
+		})
+	}
+
+	t.Run("owner", func(t *testing.T) {
+		path := "/v1/users/" + alice.String() + "/blocks"
+
+		if code, body := request(t, srv, http.MethodPut, path+"/"+bob.String(), aliceToken); code != http.StatusNoContent {
+			t.Fatalf("block: got status %d (%s)", code, body)
+		}
+		if !slices.Contains(srv.Chat.Blocked(alice), bob) {
+			t.Fatalf("bob is not blocked")
+		}
+
+		code, body := request(t, srv, http.MethodGet, path, aliceToken)
+		if code != http.StatusOK {
+			t.Fatalf("query blocks: got status %d (%s)", code, body)
+		}
+		var list struct {
+			Items []uuid.UUID `json:"items"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil || !slices.Equal(list.Items, []uuid.UUID{bob}) {
+			t.Errorf("query blocks: got %s, want [%s]", body, bob)
+		}
+
+		if code, body := request(t, srv, http.MethodDelete, path+"/"+bob.String(), aliceToken); code != http.StatusNoContent {
+			t.Fatalf("unblock: got status %d (%s)", code, body)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		srv.Advance(t, 2*time.Hour)
+
+		code, body := request(t, srv, http.MethodGet, "/v1/users/"+alice.String()+"/blocks", aliceToken)
+		if code != http.StatusUnauthorized {
+			t.Errorf("expired token: got status %d (%s), want %d", code, body, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestConnectWhileDraining(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	srv.AssertOnline(t, alice.ID)
+
+	srv.ShuttingDown.Store(true)
+
+	if code, body := request(t, srv, http.MethodGet, "/v1/readiness", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness: got status %d (%s), want %d", code, body, http.StatusServiceUnavailable)
+	}
+
+	ws, resp, err := websocket.DefaultDialer.Dial(srv.URL, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatalf("dial while draining: upgrade succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial while draining: got %v, want status %d", err, http.StatusServiceUnavailable)
+	}
+
+	// 已有的连接不受影响
+	bob := uuid.New()
+	alice.Send(bob, "hi")
+	alice.ExpectError("failed_precondition")
+	srv.AssertOnline(t, alice.ID)
+}
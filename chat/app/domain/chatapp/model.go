@@ -6,3 +6,9 @@ type user struct {
 	ID   uuid.UUID `json:"id"`
 	Name string    `json:"name"`
 }
+
+// relationList 用户的屏蔽列表或者免打扰列表
+type relationList struct {
+	UserID uuid.UUID   `json:"userID"`
+	Items  []uuid.UUID `json:"items"`
+}
@@ -1,12 +1,37 @@
 package chatapp
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
+	"sync/atomic"
+)
 
-func Routes(app *gin.Engine) {
-	api := NewApp()
+// Config 包含路由需要的配置
+type Config struct {
+	Chat *chat.Chat
+	// Auth 校验 /v1 接口和握手的 token，为 nil 时只能使用客户端证书
+	Auth *auth.Authenticator
+	// ShuttingDown 为 true 时服务正在排空，拒绝新的 websocket 连接
+	ShuttingDown *atomic.Bool
+}
+
+func Routes(app *gin.Engine, cfg Config) {
+	api := NewApp(cfg.Chat, cfg.ShuttingDown)
 
-	app.GET("/connect", api.connect)
+	// 握手时带有 token 的连接使用 token 的用户 ID，token 不合法时在升级之前拒绝
+	app.GET("/connect", mid.Authenticate(cfg.Auth), api.connect)
 	app.GET("/test", api.test)
 	app.GET("/testerror", api.testError)
 	app.GET("/testpanic", api.testPanic)
+
+	// 屏蔽和免打扰，只能查看和修改自己的
+	v1 := app.Group("/v1", mid.Authenticate(cfg.Auth), mid.RequireUser("userID"))
+	v1.GET("/users/:userID/blocks", api.queryBlocks)
+	v1.PUT("/users/:userID/blocks/:targetID", api.block)
+	v1.DELETE("/users/:userID/blocks/:targetID", api.unblock)
+	v1.GET("/users/:userID/mutes", api.queryMutes)
+	v1.PUT("/users/:userID/mutes/:targetID", api.mute)
+	v1.DELETE("/users/:userID/mutes/:targetID", api.unmute)
 }
@@ -0,0 +1,82 @@
+// Package checkapp 提供存活检查和就绪检查
+package checkapp
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+type app struct {
+	log          *zap.SugaredLogger
+	build        string
+	chat         *chat.Chat
+	shuttingDown *atomic.Bool
+}
+
+func newApp(cfg Config) *app {
+	shuttingDown := cfg.ShuttingDown
+	if shuttingDown == nil {
+		shuttingDown = new(atomic.Bool)
+	}
+
+	return &app{
+		log:          cfg.Log,
+		build:        cfg.Build,
+		chat:         cfg.Chat,
+		shuttingDown: shuttingDown,
+	}
+}
+
+// liveness 只要进程还能处理请求就返回 200
+func (a *app) liveness(c *gin.Context) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unavailable"
+	}
+
+	c.JSON(http.StatusOK, info{
+		Status:     "up",
+		Build:      a.build,
+		Host:       host,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Users:      a.chat.Count(),
+		BuildInfo:  logger.Build(),
+	})
+}
+
+// readiness 服务正在关闭或者依赖不可用时返回 503，负载均衡器不再转发新的 websocket 连接
+func (a *app) readiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second)
+	defer cancel()
+
+	resp := readiness{
+		Status: "ok",
+		Checks: make(map[string]string),
+	}
+
+	if a.shuttingDown.Load() {
+		resp.Status = "shutting down"
+	}
+
+	resp.Checks["chat"] = "ok"
+	if err := a.chat.Check(ctx); err != nil {
+		a.log.Infow("readiness failure", "check", "chat", "err", err)
+		resp.Checks["chat"] = err.Error()
+		resp.Status = "unavailable"
+	}
+
+	if resp.Status != "ok" {
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,15 @@
+package checkapp
+
+type info struct {
+	Status     string            `json:"status"`
+	Build      string            `json:"build"`
+	Host       string            `json:"host"`
+	GOMAXPROCS int               `json:"GOMAXPROCS"`
+	Users      int               `json:"users"`
+	BuildInfo  map[string]string `json:"buildInfo"`
+}
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
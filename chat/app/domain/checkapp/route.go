@@ -0,0 +1,25 @@
+package checkapp
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"go.uber.org/zap"
+	"sync/atomic"
+)
+
+// Config 包含路由需要的配置
+type Config struct {
+	// Log 健康检查不经过中间件，需要直接注入 logger
+	Log   *zap.SugaredLogger
+	Build string
+	Chat  *chat.Chat
+	// ShuttingDown 服务开始关闭时设置为 true，就绪检查随即失败
+	ShuttingDown *atomic.Bool
+}
+
+func Routes(app *gin.Engine, cfg Config) {
+	api := newApp(cfg)
+
+	app.GET("/v1/liveness", api.liveness)
+	app.GET("/v1/readiness", api.readiness)
+}
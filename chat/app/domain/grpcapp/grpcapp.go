@@ -0,0 +1,251 @@
+package grpcapp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/api/proto/chatv1"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+type app struct {
+	chatv1.UnimplementedChatServiceServer
+
+	log          *zap.SugaredLogger
+	chat         *chat.Chat
+	auth         *auth.Authenticator
+	shuttingDown *atomic.Bool
+}
+
+// NewApp a 为 nil 时只能使用客户端证书，shuttingDown 可以为 nil
+func NewApp(log *zap.SugaredLogger, c *chat.Chat, a *auth.Authenticator, shuttingDown *atomic.Bool) *app {
+	if shuttingDown == nil {
+		shuttingDown = new(atomic.Bool)
+	}
+
+	return &app{
+		log:          log,
+		chat:         c,
+		auth:         a,
+		shuttingDown: shuttingDown,
+	}
+}
+
+// Connect 与 websocket 的 /connect 相同，会话加入 Chat 的注册表，可以与 websocket 的用户互相发送消息
+func (a *app) Connect(srv chatv1.ChatService_ConnectServer) error {
+	ctx := logger.NewContext(srv.Context(), a.log.With("method", "Connect"))
+
+	// 排空期间拒绝新的会话，客户端应该连接其他实例
+	if a.shuttingDown.Load() {
+		return toStatus(ctx, errs.Newf(errs.Unavailable, "server is shutting down"))
+	}
+
+	ctx, state, err := a.authenticate(ctx)
+	if err != nil {
+		return toStatus(ctx, err)
+	}
+
+	f, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+
+	join := f.GetJoin()
+	if join == nil {
+		return toStatus(ctx, errs.Newf(errs.InvalidArgument, "first frame must be join"))
+	}
+
+	id, err := parseOptionalID(join.GetUser().GetId())
+	if err != nil {
+		return toStatus(ctx, errs.Newf(errs.InvalidArgument, "invalid id: %v", err).WithField("id", "is not a valid uuid"))
+	}
+
+	s := newStream(srv)
+	usr, err := a.chat.Join(ctx, state, id, join.GetUser().GetName(), remoteAddr(ctx), s)
+	metrics.AddHandshake(err == nil)
+	if err != nil {
+		return toStatus(ctx, err)
+	}
+	defer a.chat.Leave(ctx, usr)
+
+	// Recv 不能与 select 一起使用，在单独的 goroutine 中读取，Connect 返回后流被取消，goroutine 随之退出
+	frames := make(chan *chatv1.ClientFrame)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			f, err := srv.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			select {
+			case frames <- f:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return s.err()
+
+		case err := <-recvErr:
+			// 客户端关闭了发送方向，会话正常结束
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+
+		case f := <-frames:
+			send := f.GetSend()
+			if send == nil {
+				s.sendError(errs.Newf(errs.InvalidArgument, "unexpected frame, expected send"))
+				continue
+			}
+
+			toID, err := uuid.Parse(send.GetToId())
+			if err != nil {
+				s.sendError(errs.Newf(errs.InvalidArgument, "invalid to_id: %v", err).WithField("toID", "is not a valid uuid"))
+				continue
+			}
+
+			// 多次超过限流时会话已经被断开，下一次循环返回断开的原因
+			a.chat.Receive(ctx, usr, toID, send.GetMsg(), send.GetTraceparent())
+		}
+	}
+}
+
+// SendMessage 以调用方的身份发送一条消息，发送者可以是 websocket 或者 gRPC 的会话
+// from_id 必须与客户端证书或者 token 的身份一致
+func (a *app) SendMessage(ctx context.Context, req *chatv1.SendMessageRequest) (*chatv1.SendMessageResponse, error) {
+	ctx = logger.NewContext(ctx, a.log.With("method", "SendMessage"))
+
+	ctx, state, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	fromID, err := parseOptionalID(req.GetFromId())
+	if err != nil {
+		return nil, toStatus(ctx, errs.Newf(errs.InvalidArgument, "invalid from_id: %v", err).WithField("fromID", "is not a valid uuid"))
+	}
+
+	toID, err := uuid.Parse(req.GetToId())
+	if err != nil {
+		return nil, toStatus(ctx, errs.Newf(errs.InvalidArgument, "invalid to_id: %v", err).WithField("toID", "is not a valid uuid"))
+	}
+
+	at, err := a.chat.Send(ctx, state, fromID, toID, req.GetMsg(), req.GetTraceparent())
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	return &chatv1.SendMessageResponse{At: timestamppb.New(at)}, nil
+}
+
+// GetHistory 服务端不保存消息
+func (a *app) GetHistory(ctx context.Context, req *chatv1.GetHistoryRequest) (*chatv1.GetHistoryResponse, error) {
+	return nil, toStatus(ctx, errs.Newf(errs.Unimplemented, "message history is not stored"))
+}
+
+// ListRooms 返回用户所在的房间，与管理接口的房间列表相同
+func (a *app) ListRooms(ctx context.Context, req *chatv1.ListRoomsRequest) (*chatv1.ListRoomsResponse, error) {
+	ctx = logger.NewContext(ctx, a.log.With("method", "ListRooms"))
+
+	userID, err := uuid.Parse(req.GetUserId())
+	if err != nil {
+		return nil, toStatus(ctx, errs.Newf(errs.InvalidArgument, "invalid user_id: %v", err).WithField("userID", "is not a valid uuid"))
+	}
+
+	rooms := a.chat.Rooms(userID)
+
+	resp := chatv1.ListRoomsResponse{Rooms: make([]*chatv1.Room, 0, len(rooms))}
+	for _, r := range rooms {
+		resp.Rooms = append(resp.Rooms, toRoom(r))
+	}
+
+	return &resp, nil
+}
+
+// =============================================================================
+
+// toStatus 把错误转换为 gRPC status，状态码由 errs.ErrCode.GRPCCode 转换
+// 不是 *errs.Error 的错误和 InternalOnlyLog 只记录日志，客户端只收到 internal error
+func toStatus(ctx context.Context, err error) error {
+	var appErr *errs.Error
+	if !errors.As(err, &appErr) || appErr.Code == errs.InternalOnlyLog {
+		logger.FromContext(ctx).Errorw("grpc", "err", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	return status.Error(codes.Code(appErr.GRPCCode()), appErr.Message)
+}
+
+// authenticate 返回客户端的 TLS 连接状态，由 chat 使用其中校验通过的客户端证书
+// 没有客户端证书时校验 metadata 中的 authorization: Bearer <token>，把身份放入返回的 ctx，与 mid.Authenticate 相同
+// token 不合法时返回 errs.Unauthenticated
+func (a *app) authenticate(ctx context.Context) (context.Context, *tls.ConnectionState, error) {
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+
+	if state != nil && len(state.VerifiedChains) > 0 {
+		return ctx, state, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		bearer, found := strings.CutPrefix(v, "Bearer ")
+		if !found {
+			continue
+		}
+
+		userID, err := a.auth.Verify(bearer)
+		if err != nil {
+			return ctx, nil, errs.Newf(errs.Unauthenticated, "%v", err)
+		}
+
+		return auth.NewContext(ctx, auth.Identity{UserID: userID, Method: auth.MethodToken}), state, nil
+	}
+
+	return ctx, state, nil
+}
+
+// parseOptionalID 空字符串返回 uuid.Nil，由证书或者 token 决定 ID
+func parseOptionalID(s string) (uuid.UUID, error) {
+	if s == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.Parse(s)
+}
+
+// remoteAddr 返回客户端的地址，用于管理接口的会话列表
+func remoteAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	return p.Addr.String()
+}
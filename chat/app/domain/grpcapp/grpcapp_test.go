@@ -0,0 +1,382 @@
+package grpcapp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/api/proto/chatv1"
+	"github.com/zhangpetergo/chat/chat/app/domain/grpcapp"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dial 在 chattest 的 Chat 上启动 gRPC 服务，返回连接到它的客户端，测试结束时关闭
+func dial(t *testing.T, srv *chattest.Server) chatv1.ChatServiceClient {
+	t.Helper()
+
+	return serve(t, srv, nil, insecure.NewCredentials())
+}
+
+// dialCert 使用 TLS 启动 gRPC 服务，客户端使用证书 cert，服务需要 chattest.Config.ClientCerts
+func dialCert(t *testing.T, srv *chattest.Server, cert tls.Certificate) chatv1.ChatServiceClient {
+	t.Helper()
+
+	// 使用 httptest 服务的证书和 chattest 的客户端 CA
+	serverTLS := srv.HTTP.TLS.Clone()
+	serverTLS.NextProtos = []string{"h2"}
+
+	clientTLS := srv.HTTP.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	clientTLS.ServerName = "example.com"
+	clientTLS.Certificates = []tls.Certificate{cert}
+
+	return serve(t, srv, credentials.NewTLS(serverTLS), credentials.NewTLS(clientTLS))
+}
+
+func serve(t *testing.T, srv *chattest.Server, serverCreds credentials.TransportCredentials, clientCreds credentials.TransportCredentials) chatv1.ChatServiceClient {
+	t.Helper()
+
+	var opts []grpc.ServerOption
+	if serverCreds != nil {
+		opts = append(opts, grpc.Creds(serverCreds))
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(opts...)
+	grpcapp.Register(s, grpcapp.Config{
+		Log:          zap.NewNop().Sugar(),
+		Chat:         srv.Chat,
+		Auth:         srv.Auth,
+		ShuttingDown: srv.ShuttingDown,
+	})
+	go s.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(clientCreds))
+	if err != nil {
+		t.Fatalf("grpc client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+
+	return chatv1.NewChatServiceClient(conn)
+}
+
+// withToken 返回在 metadata 中带有 token 的 context
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// connect 以 name 的身份打开 Connect 流，等待 Welcome
+func connect(t *testing.T, c chatv1.ChatServiceClient, id uuid.UUID, name string) chatv1.ChatService_ConnectClient {
+	t.Helper()
+
+	stream := join(t, context.Background(), c, id.String(), name)
+
+	w := recv(t, stream).GetWelcome()
+	if w == nil || w.GetUser().GetId() != id.String() || w.GetUser().GetName() != name {
+		t.Fatalf("got welcome %v, want %s %s", w, id, name)
+	}
+
+	return stream
+}
+
+// join 打开 Connect 流并发送 Join，不等待 Welcome，id 可以为空
+func join(t *testing.T, ctx context.Context, c chatv1.ChatServiceClient, id string, name string) chatv1.ChatService_ConnectClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	stream, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	f := chatv1.ClientFrame{Frame: &chatv1.ClientFrame_Join{Join: &chatv1.Join{
+		User: &chatv1.User{Id: id, Name: name},
+	}}}
+	if err := stream.Send(&f); err != nil {
+		t.Fatalf("send join: %v", err)
+	}
+
+	return stream
+}
+
+// recv 在超时时间内等待下一帧
+func recv(t *testing.T, stream chatv1.ChatService_ConnectClient) *chatv1.ServerFrame {
+	t.Helper()
+
+	type result struct {
+		f   *chatv1.ServerFrame
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		f, err := stream.Recv()
+		ch <- result{f: f, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("recv: %v", r.err)
+		}
+		return r.f
+	case <-time.After(2 * time.Second):
+		t.Fatal("recv: no frame")
+	}
+
+	return nil
+}
+
+func send(t *testing.T, stream chatv1.ChatService_ConnectClient, to uuid.UUID, msg string) {
+	t.Helper()
+
+	f := chatv1.ClientFrame{Frame: &chatv1.ClientFrame_Send{Send: &chatv1.Send{ToId: to.String(), Msg: msg}}}
+	if err := stream.Send(&f); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func wantCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Fatalf("got %v, want %s", err, want)
+	}
+}
+
+// =============================================================================
+
+func TestConnectSharesRegistry(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	c := dial(t, srv)
+
+	aliceID := uuid.New()
+	alice := connect(t, c, aliceID, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, aliceID, bob.ID)
+
+	// gRPC 的会话发给 websocket 的用户
+	send(t, alice, bob.ID, "hi")
+	bob.ExpectMessage(aliceID, "hi")
+
+	// websocket 的用户发给 gRPC 的会话
+	bob.Send(aliceID, "hello")
+	m := recv(t, alice).GetMessage()
+	if m.GetFrom().GetId() != bob.ID.String() || m.GetTo().GetId() != aliceID.String() || m.GetMsg() != "hello" || m.GetAt() == nil {
+		t.Errorf("got message %v", m)
+	}
+
+	// 错误作为错误帧发送，会话继续
+	send(t, alice, uuid.New(), "hi")
+	if e := recv(t, alice).GetError(); e.GetCode() != "failed_precondition" {
+		t.Errorf("got error %v, want failed_precondition", e)
+	}
+	f := chatv1.ClientFrame{Frame: &chatv1.ClientFrame_Send{Send: &chatv1.Send{ToId: "bob", Msg: "hi"}}}
+	if err := alice.Send(&f); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if e := recv(t, alice).GetError(); e.GetCode() != "invalid_argument" {
+		t.Errorf("got error %v, want invalid_argument", e)
+	}
+
+	// 同一个用户不能同时有 websocket 和 gRPC 的会话
+	stream, err := c.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	stream.Send(&chatv1.ClientFrame{Frame: &chatv1.ClientFrame_Join{Join: &chatv1.Join{
+		User: &chatv1.User{Id: bob.ID.String(), Name: "bob"},
+	}}})
+	_, err = stream.Recv()
+	wantCode(t, err, codes.AlreadyExists)
+
+	// 系统公告也推送给 gRPC 的会话
+	srv.Chat.Broadcast(context.Background(), "maintenance")
+	if s := recv(t, alice).GetSystem(); s.GetSystem() != "maintenance" {
+		t.Errorf("got system %v, want maintenance", s)
+	}
+	bob.ExpectSystem("maintenance")
+
+	// 客户端关闭流后移除会话
+	alice.CloseSend()
+	srv.AssertOffline(t, aliceID)
+}
+
+func TestConnectKick(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	c := dial(t, srv)
+
+	aliceID := uuid.New()
+	alice := connect(t, c, aliceID, "alice")
+
+	var sessionID uuid.UUID
+	for _, s := range srv.Chat.Sessions() {
+		if s.UserID == aliceID {
+			sessionID = s.SessionID
+		}
+	}
+	if err := srv.Chat.Kick(context.Background(), sessionID, "spam"); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+
+	_, err := alice.Recv()
+	wantCode(t, err, codes.Aborted)
+	if msg := status.Convert(err).Message(); msg != "spam" {
+		t.Errorf("got reason %q, want spam", msg)
+	}
+	srv.AssertOffline(t, aliceID)
+}
+
+func TestUnary(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	c := dial(t, srv)
+	ctx := context.Background()
+
+	aliceID := uuid.New()
+	alice := connect(t, c, aliceID, "alice")
+	bob := srv.Connect(t, "bob")
+
+	bobCtx := withToken(ctx, srv.Token(t, bob.ID))
+
+	resp, err := c.SendMessage(bobCtx, &chatv1.SendMessageRequest{FromId: bob.ID.String(), ToId: aliceID.String(), Msg: "hi"})
+	if err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if resp.GetAt() == nil {
+		t.Error("send message: got no time")
+	}
+	if m := recv(t, alice).GetMessage(); m.GetFrom().GetId() != bob.ID.String() || m.GetMsg() != "hi" {
+		t.Errorf("got message %v", m)
+	}
+
+	// 错误码由 errs.ErrCode.GRPCCode 转换
+	mallory := uuid.New()
+	_, err = c.SendMessage(withToken(ctx, srv.Token(t, mallory)), &chatv1.SendMessageRequest{ToId: aliceID.String(), Msg: "hi"})
+	wantCode(t, err, codes.FailedPrecondition)
+	_, err = c.SendMessage(bobCtx, &chatv1.SendMessageRequest{FromId: bob.ID.String(), ToId: aliceID.String()})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = c.SendMessage(bobCtx, &chatv1.SendMessageRequest{FromId: bob.ID.String(), ToId: "alice", Msg: "hi"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	rooms, err := c.ListRooms(ctx, &chatv1.ListRoomsRequest{UserId: aliceID.String()})
+	if err != nil {
+		t.Fatalf("list rooms: %v", err)
+	}
+	if len(rooms.GetRooms()) != 1 || len(rooms.GetRooms()[0].GetMembers()) != 2 {
+		t.Fatalf("got rooms %v, want one room with two members", rooms.GetRooms())
+	}
+	for _, m := range rooms.GetRooms()[0].GetMembers() {
+		if !m.GetOnline() {
+			t.Errorf("member %s: got online false, want true", m.GetName())
+		}
+	}
+
+	_, err = c.GetHistory(ctx, &chatv1.GetHistoryRequest{UserId: aliceID.String(), PeerId: bob.ID.String()})
+	wantCode(t, err, codes.Unimplemented)
+}
+
+func TestSendMessageIdentity(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	c := dial(t, srv)
+	ctx := context.Background()
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+
+	// 没有证书和 token 时不能以任何人的身份发送
+	_, err := c.SendMessage(ctx, &chatv1.SendMessageRequest{FromId: alice.ID.String(), ToId: bob.ID.String(), Msg: "hi"})
+	wantCode(t, err, codes.Unauthenticated)
+
+	_, err = c.SendMessage(withToken(ctx, "garbage"), &chatv1.SendMessageRequest{FromId: alice.ID.String(), ToId: bob.ID.String(), Msg: "hi"})
+	wantCode(t, err, codes.Unauthenticated)
+
+	// from_id 必须是 token 的用户
+	bobCtx := withToken(ctx, srv.Token(t, bob.ID))
+	_, err = c.SendMessage(bobCtx, &chatv1.SendMessageRequest{FromId: alice.ID.String(), ToId: bob.ID.String(), Msg: "hi"})
+	wantCode(t, err, codes.PermissionDenied)
+	bob.ExpectNothing(100 * time.Millisecond)
+
+	// from_id 为空时使用 token 的用户
+	if _, err := c.SendMessage(bobCtx, &chatv1.SendMessageRequest{ToId: alice.ID.String(), Msg: "hi"}); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	alice.ExpectMessage(bob.ID, "hi")
+}
+
+func TestConnectToken(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	c := dial(t, srv)
+
+	aliceID := uuid.New()
+	ctx := withToken(context.Background(), srv.Token(t, aliceID))
+
+	// Join 的 id 必须是 token 的用户
+	_, err := join(t, ctx, c, uuid.NewString(), "mallory").Recv()
+	wantCode(t, err, codes.PermissionDenied)
+
+	_, err = join(t, withToken(context.Background(), "garbage"), c, aliceID.String(), "alice").Recv()
+	wantCode(t, err, codes.Unauthenticated)
+	srv.AssertCount(t, 0)
+
+	// id 为空时使用 token 的用户
+	w := recv(t, join(t, ctx, c, "", "alice")).GetWelcome()
+	if w.GetUser().GetId() != aliceID.String() || w.GetUser().GetName() != "alice" {
+		t.Fatalf("got welcome %v, want alice %s", w, aliceID)
+	}
+	srv.AssertOnline(t, aliceID)
+}
+
+func TestCertIdentity(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{ClientCerts: true})
+	ctx := context.Background()
+
+	carolID := uuid.New()
+	c := dialCert(t, srv, srv.ClientCert(t, "carol", carolID))
+
+	// 身份由客户端证书决定，Join 的 id 与证书不一致时拒绝
+	_, err := join(t, ctx, c, uuid.NewString(), "mallory").Recv()
+	wantCode(t, err, codes.PermissionDenied)
+
+	w := recv(t, join(t, ctx, c, "", "ignored")).GetWelcome()
+	if w.GetUser().GetId() != carolID.String() || w.GetUser().GetName() != "carol" {
+		t.Fatalf("got welcome %v, want carol %s", w, carolID)
+	}
+	srv.AssertOnline(t, carolID)
+
+	dave := srv.Connect(t, "dave")
+
+	// 证书的持有者以自己的身份发送，from_id 不一致时拒绝，token 被忽略
+	_, err = c.SendMessage(withToken(ctx, srv.Token(t, dave.ID)), &chatv1.SendMessageRequest{FromId: dave.ID.String(), ToId: carolID.String(), Msg: "hi"})
+	wantCode(t, err, codes.PermissionDenied)
+
+	if _, err := c.SendMessage(ctx, &chatv1.SendMessageRequest{ToId: dave.ID.String(), Msg: "hi"}); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	dave.ExpectMessage(carolID, "hi")
+
+	// 绑定了证书的 ID 不能通过 token 使用，与 websocket 的 checkCertless 相同
+	plain := serve(t, srv, nil, insecure.NewCredentials())
+	_, err = plain.SendMessage(withToken(ctx, srv.Token(t, carolID)), &chatv1.SendMessageRequest{ToId: dave.ID.String(), Msg: "hi"})
+	wantCode(t, err, codes.PermissionDenied)
+	dave.ExpectNothing(100 * time.Millisecond)
+}
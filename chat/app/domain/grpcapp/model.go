@@ -0,0 +1,56 @@
+package grpcapp
+
+import (
+	"github.com/zhangpetergo/chat/chat/api/proto/chatv1"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/client"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toUser(u client.User) *chatv1.User {
+	return &chatv1.User{
+		Id:   u.ID.String(),
+		Name: u.Name,
+	}
+}
+
+func toMessage(m client.Message) *chatv1.Message {
+	return &chatv1.Message{
+		From:        toUser(m.From),
+		To:          toUser(m.To),
+		Msg:         m.Msg,
+		At:          timestamppb.New(m.At),
+		Muted:       m.Muted,
+		Traceparent: m.Traceparent,
+	}
+}
+
+func toError(e client.Error) *chatv1.Error {
+	return &chatv1.Error{
+		Code:       e.Code,
+		Message:    e.Message,
+		Reason:     e.Reason,
+		RetryAfter: int32(e.RetryAfter),
+	}
+}
+
+func toSystem(s client.System) *chatv1.System {
+	return &chatv1.System{
+		System: s.System,
+		At:     timestamppb.New(s.At),
+	}
+}
+
+func toRoom(r chat.Room) *chatv1.Room {
+	room := chatv1.Room{
+		Id:            r.ID.String(),
+		Members:       make([]*chatv1.RoomMember, 0, len(r.Members)),
+		CreatedAt:     timestamppb.New(r.CreatedAt),
+		LastMessageAt: timestamppb.New(r.LastMessageAt),
+	}
+	for _, m := range r.Members {
+		room.Members = append(room.Members, &chatv1.RoomMember{Id: m.ID.String(), Name: m.Name, Online: m.Online})
+	}
+
+	return &room
+}
@@ -0,0 +1,25 @@
+package grpcapp
+
+import (
+	"github.com/zhangpetergo/chat/chat/api/proto/chatv1"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"sync/atomic"
+)
+
+// Config 包含注册服务需要的配置
+type Config struct {
+	Log  *zap.SugaredLogger
+	Chat *chat.Chat
+	// Auth 校验 metadata 中的 token，为 nil 时只能使用客户端证书
+	Auth *auth.Authenticator
+	// ShuttingDown 为 true 时服务正在排空，拒绝新的 Connect
+	ShuttingDown *atomic.Bool
+}
+
+// Register 在 s 上注册 chat.v1.ChatService，与 websocket 共用 cfg.Chat 的注册表
+func Register(s *grpc.Server, cfg Config) {
+	chatv1.RegisterChatServiceServer(s, NewApp(cfg.Log, cfg.Chat, cfg.Auth, cfg.ShuttingDown))
+}
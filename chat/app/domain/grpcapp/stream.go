@@ -0,0 +1,94 @@
+package grpcapp
+
+import (
+	"fmt"
+	"github.com/zhangpetergo/chat/chat/api/proto/chatv1"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// stream 把 Connect 的流作为 chat.Stream 加入注册表
+// gRPC 的流同一时间只允许一个写入者，Chat 的 writeLoop 和 Connect 发送的错误帧使用 mu 串行写入
+type stream struct {
+	srv chatv1.ChatService_ConnectServer
+
+	mu sync.Mutex
+
+	// done 会话结束时关闭，reason 是服务端断开的原因，在关闭 done 之前写入，只在 done 关闭之后读取
+	done   chan struct{}
+	once   sync.Once
+	reason string
+}
+
+func newStream(srv chatv1.ChatService_ConnectServer) *stream {
+	return &stream{
+		srv:  srv,
+		done: make(chan struct{}),
+	}
+}
+
+// Welcome 实现 chat.Stream，对应 websocket 的 WELCOME
+func (s *stream) Welcome(sess chat.Session) error {
+	return s.send(&chatv1.ServerFrame{Frame: &chatv1.ServerFrame_Welcome{Welcome: &chatv1.Welcome{
+		User:      &chatv1.User{Id: sess.UserID.String(), Name: sess.Name},
+		SessionId: sess.SessionID.String(),
+	}}})
+}
+
+// Send 实现 chat.Stream，把 websocket 的 JSON 帧转换为 ServerFrame
+func (s *stream) Send(data []byte) error {
+	e, err := client.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	var f chatv1.ServerFrame
+	switch e.Kind {
+	case client.EventMessage:
+		f.Frame = &chatv1.ServerFrame_Message{Message: toMessage(*e.Message)}
+	case client.EventError:
+		f.Frame = &chatv1.ServerFrame_Error{Error: toError(*e.Error)}
+	case client.EventSystem:
+		f.Frame = &chatv1.ServerFrame_System{System: toSystem(*e.System)}
+	default:
+		return fmt.Errorf("unexpected frame %s", e.Kind)
+	}
+
+	return s.send(&f)
+}
+
+// Close 实现 chat.Stream，只记录第一次的原因
+func (s *stream) Close(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.done)
+	})
+}
+
+// err 会话被服务端断开时 Connect 返回的错误，done 关闭之后调用
+func (s *stream) err() error {
+	if s.reason == "" {
+		return status.Error(codes.Aborted, "session closed")
+	}
+	return status.Error(codes.Aborted, s.reason)
+}
+
+// sendError 向客户端发送错误帧，用于 Chat 之外的校验，比如无法解析的 to_id
+func (s *stream) sendError(appErr *errs.Error) {
+	s.send(&chatv1.ServerFrame{Frame: &chatv1.ServerFrame_Error{Error: &chatv1.Error{
+		Code:    appErr.Code.String(),
+		Message: appErr.Message,
+		Reason:  appErr.Reason,
+	}}})
+}
+
+func (s *stream) send(f *chatv1.ServerFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.srv.Send(f)
+}
@@ -0,0 +1,152 @@
+// Package auth 签发和校验用户的 token，并在 context 中保存请求的身份
+//
+// token 的格式是 base64url(userID || expiresAt) "." base64url(HMAC-SHA256)，服务端不保存 token
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/foundation/clock"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDisabled 没有配置密钥，不能签发和校验 token
+	ErrDisabled = errors.New("token auth disabled")
+	// ErrInvalidToken token 格式不正确或者签名不匹配
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpired token 已经过期
+	ErrExpired = errors.New("token expired")
+)
+
+// payloadSize userID 16 字节加上过期时间 8 字节
+const payloadSize = 16 + 8
+
+// Config Authenticator 的配置
+type Config struct {
+	// Secret HMAC 的密钥，为空时不能签发和校验 token
+	Secret string
+	// TTL token 的有效期
+	TTL time.Duration
+	// Clock 为 nil 时使用系统时间
+	Clock clock.Clock
+}
+
+// Authenticator 签发和校验 token
+type Authenticator struct {
+	secret []byte
+	ttl    time.Duration
+	clock  clock.Clock
+}
+
+// New 创建 Authenticator
+func New(cfg Config) *Authenticator {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real{}
+	}
+
+	return &Authenticator{
+		secret: []byte(cfg.Secret),
+		ttl:    cfg.TTL,
+		clock:  cfg.Clock,
+	}
+}
+
+// Issue 为用户签发 token，返回 token 和过期时间，a 为 nil 时返回 ErrDisabled
+func (a *Authenticator) Issue(userID uuid.UUID) (string, time.Time, error) {
+	if a == nil || len(a.secret) == 0 {
+		return "", time.Time{}, ErrDisabled
+	}
+
+	// token 只精确到秒
+	expiresAt := a.clock.Now().Add(a.ttl).Truncate(time.Second)
+
+	payload := make([]byte, payloadSize)
+	copy(payload, userID[:])
+	binary.BigEndian.PutUint64(payload[16:], uint64(expiresAt.Unix()))
+
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(payload) + "." + enc.EncodeToString(a.sign(payload))
+
+	return token, expiresAt, nil
+}
+
+// Verify 校验 token 并返回 token 所属的用户，a 为 nil 时返回 ErrDisabled
+func (a *Authenticator) Verify(token string) (uuid.UUID, error) {
+	if a == nil || len(a.secret) == 0 {
+		return uuid.Nil, ErrDisabled
+	}
+
+	enc := base64.RawURLEncoding
+
+	p, s, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil || len(payload) != payloadSize {
+		return uuid.Nil, ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+		return uuid.Nil, ErrInvalidToken
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	if !a.clock.Now().Before(expiresAt) {
+		return uuid.Nil, ErrExpired
+	}
+
+	userID, err := uuid.FromBytes(bytes.Clone(payload[:16]))
+	if err != nil {
+		return uuid.Nil, ErrInvalidToken
+	}
+
+	return userID, nil
+}
+
+func (a *Authenticator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// =============================================================================
+
+// Method 确定身份的方式
+type Method string
+
+const (
+	// MethodCert 由校验通过的客户端证书确定
+	MethodCert Method = "cert"
+	// MethodToken 由 Authenticator 签发的 token 确定
+	MethodToken Method = "token"
+)
+
+// Identity 请求的身份
+type Identity struct {
+	UserID uuid.UUID
+	Method Method
+}
+
+type ctxKey int
+
+const identityKey ctxKey = 1
+
+// NewContext 返回保存了身份的 context
+func NewContext(ctx context.Context, ident Identity) context.Context {
+	return context.WithValue(ctx, identityKey, ident)
+}
+
+// FromContext 返回 context 中的身份，没有时返回 false
+func FromContext(ctx context.Context) (Identity, bool) {
+	ident, ok := ctx.Value(identityKey).(Identity)
+	return ident, ok
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"sort"
+)
+
+// Sessions 返回所有在线用户的会话信息，按照连接时间排序
+func (c *Chat) Sessions() []Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(c.users))
+	for _, usr := range c.users {
+		sessions = append(sessions, usr.session())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+
+	return sessions
+}
+
+// Kick 断开指定的会话，reason 会在关闭帧中发送给客户端
+func (c *Chat) Kick(ctx context.Context, sessionID uuid.UUID, reason string) error {
+	usr, exists := c.findSession(sessionID)
+	if !exists {
+		return errs.Newf(errs.NotFound, "session %s not found", sessionID)
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("kick session", "user", usr.ID, "session", sessionID, "reason", reason)
+
+	c.disconnect(ctx, usr, websocket.ClosePolicyViolation, reason)
+
+	return nil
+}
+
+// Broadcast 向所有在线用户发送系统公告，返回成功放入发送队列的用户数
+func (c *Chat) Broadcast(ctx context.Context, msg string) int {
+	m := systemMessage{
+		System: msg,
+		At:     c.cfg.Clock.Now().UTC(),
+	}
+
+	var sent int
+	for _, usr := range c.connections() {
+		if err := usr.enqueueValue(m); err != nil {
+			logger.ForComponent(ctx, logComponent).Infow("chat-broadcast", "user", usr.ID, "err", err)
+			continue
+		}
+		sent++
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("broadcast", "sent", sent)
+
+	return sent
+}
+
+// Quarantined 返回所有等待审核的隔离消息
+func (c *Chat) Quarantined(ctx context.Context) ([]QuarantinedMessage, error) {
+	return c.cfg.Quarantine.List(ctx)
+}
+
+// ReleaseQuarantined 审核通过，把隔离的消息投递给接收者，不再经过内容审核
+// 接收者不在线时返回 errs.FailedPrecondition，消息继续保留
+func (c *Chat) ReleaseQuarantined(ctx context.Context, id uuid.UUID) error {
+	m, err := c.cfg.Quarantine.Take(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.deliver(ctx, User{ID: m.FromID, Name: m.FromName}, m.ToID, m.Msg); err != nil {
+		if putErr := c.cfg.Quarantine.Put(ctx, m); putErr != nil {
+			logger.ForComponent(ctx, logComponent).Errorw("chat-quarantine", "id", id, "err", putErr)
+		}
+		return err
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("release quarantined message", "id", id, "from", m.FromID, "to", m.ToID)
+
+	return nil
+}
+
+// DiscardQuarantined 审核不通过，删除隔离的消息
+func (c *Chat) DiscardQuarantined(ctx context.Context, id uuid.UUID) error {
+	m, err := c.cfg.Quarantine.Take(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("discard quarantined message", "id", id, "from", m.FromID, "to", m.ToID)
+
+	return nil
+}
+
+func (c *Chat) findSession(sessionID uuid.UUID) (User, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, usr := range c.users {
+		if usr.SessionID == sessionID {
+			return usr, true
+		}
+	}
+
+	return User{}, false
+}
+
+// Count 返回在线用户的数量
+func (c *Chat) Count() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.users)
+}
+
+// Check 检查用户注册表是否可以正常访问，用于就绪检查
+func (c *Chat) Check(ctx context.Context) error {
+	ch := make(chan struct{}, 1)
+	go func() {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		ch <- struct{}{}
+	}()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return errs.Newf(errs.Unavailable, "chat registry is not responding: %v", ctx.Err())
+	}
+}
+
+// Snapshot 聊天服务内部状态的快照，用于 expvar
+type Snapshot struct {
+	Users           int            `json:"users"`
+	QueueDepthTotal int            `json:"queueDepthTotal"`
+	QueueDepthMax   int            `json:"queueDepthMax"`
+	QueueDepths     map[string]int `json:"queueDepths"`
+	Rooms           int            `json:"rooms"`
+	RoomsOnline     map[string]int `json:"roomsOnline"`
+}
+
+// Snapshot 返回当前在线用户、每个会话待发送队列长度和房间的快照
+// RoomsOnline 是每个房间在线的成员数，房间在两个成员都离线后删除，所以至少为 1
+func (c *Chat) Snapshot() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := Snapshot{
+		Users:       len(c.users),
+		QueueDepths: make(map[string]int, len(c.users)),
+	}
+
+	for _, usr := range c.users {
+		depth := usr.queue.len()
+
+		s.QueueDepths[usr.SessionID.String()] = depth
+		s.QueueDepthTotal += depth
+		s.QueueDepthMax = max(s.QueueDepthMax, depth)
+	}
+
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	s.Rooms = len(c.rooms)
+	s.RoomsOnline = make(map[string]int, len(c.rooms))
+	for id, r := range c.rooms {
+		var online int
+		for _, m := range r.members {
+			if _, exists := c.users[m.ID]; exists {
+				online++
+			}
+		}
+		s.RoomsOnline[id.String()] = online
+	}
+
+	return s
+}
@@ -2,42 +2,146 @@ package chat
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"github.com/zhangpetergo/chat/chat/foundation/clock"
 	"github.com/zhangpetergo/chat/chat/foundation/logger"
-	"github.com/zhangpetergo/chat/chat/foundation/web"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
 	"go.uber.org/zap"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 var ErrUserExists = fmt.Errorf("user already exists")
 var ErrUserNotExists = fmt.Errorf("user not exists")
+var ErrTooManyConnections = errors.New("too many connections")
+
+var errQueueFull = errors.New("send queue full")
+var errSessionClosed = errors.New("session closed")
+
+// logComponent chat 组件的 logger 名字，可以单独设置日志级别
+const logComponent = "chat"
 
 type Chat struct {
-	users map[uuid.UUID]User
-	mu    sync.RWMutex
+	log *zap.SugaredLogger
+	// cfg 不能修改的配置，可以修改的配置在 current 中
+	cfg     Config
+	current atomic.Pointer[Settings]
+	users   map[uuid.UUID]User
+	mu      sync.RWMutex
+	// certIDs 曾经通过客户端证书连接过的 ID，由 mu 保护
+	certIDs map[uuid.UUID]struct{}
+	// mailboxes 开启断线续传的用户，包括 ResumeWindow 内离线的用户，由 mu 保护
+	mailboxes map[uuid.UUID]*mailbox
+	limiter   *rate.Keyed
+
+	relMu  sync.RWMutex
+	blocks relations
+	mutes  relations
+
+	// roomsMu 在 mu 之后加锁
+	roomsMu sync.Mutex
+	rooms   map[uuid.UUID]*room
+
+	// stop 关闭时停止 ping
+	stop     chan struct{}
+	stopOnce sync.Once
+	// pingInterval 修改 PingInterval 时通知 ping 的 goroutine
+	pingInterval chan time.Duration
 }
 
-func NewChat() *Chat {
+// NewChat 创建 Chat，log 用于 ping 等不属于任何请求的后台任务
+func NewChat(log *zap.SugaredLogger, cfg Config) *Chat {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real{}
+	}
+	if cfg.Quarantine == nil {
+		cfg.Quarantine = NewMemoryQuarantine(DefaultQuarantineSize)
+	}
+
 	c := Chat{
-		users: make(map[uuid.UUID]User),
+		log:       log.Named(logComponent),
+		cfg:       cfg,
+		users:     make(map[uuid.UUID]User),
+		certIDs:   make(map[uuid.UUID]struct{}),
+		mailboxes: make(map[uuid.UUID]*mailbox),
+		limiter:   rate.NewKeyed(cfg.MessageRate, cfg.MessageBurst),
+		blocks:    make(relations),
+		mutes:     make(relations),
+		rooms:     make(map[uuid.UUID]*room),
+		stop:      make(chan struct{}),
+
+		pingInterval: make(chan time.Duration, 1),
 	}
+
+	s := cfg.Settings
+	c.current.Store(&s)
+	c.cfg.Settings = Settings{}
+
 	c.Ping()
 	return &c
 }
 
+// settings 返回当前的配置，返回的值不能修改
+func (c *Chat) settings() *Settings {
+	return c.current.Load()
+}
+
+// Reconfigure 在运行时修改配置，已有的连接立即使用新的配置
+// 调用方需要保证配置合法
+func (c *Chat) Reconfigure(ctx context.Context, s Settings) {
+	old := c.current.Swap(&s)
+
+	if s.MessageRate != old.MessageRate || s.MessageBurst != old.MessageBurst {
+		c.limiter.SetLimit(s.MessageRate, s.MessageBurst)
+	}
+
+	if s.PingInterval != old.PingInterval {
+		// 只保留最新的间隔
+		select {
+		case <-c.pingInterval:
+		default:
+		}
+		c.pingInterval <- s.PingInterval
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("reconfigure", "filters", len(s.Filters), "maxConnections", s.MaxConnections)
+}
+
+// Stop 停止 ping 等后台任务，不会断开已有的连接
+func (c *Chat) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
 // HandleShake 如果 func 需要 struct 的成员变量，那么 func 必须是 struct 的方法
-// 比如说使用 logger.Log，那么 handleShake 必须是 app 的方法
-// 只不过这里的 logger 是全局变量，如果使用依赖注入，那么需要app
-func (c *Chat) HandleShake(ctx context.Context, w http.ResponseWriter, r *http.Request) (User, error) {
+// 日志使用 ctx 中由中间件放入的 logger
+func (c *Chat) HandleShake(ctx context.Context, w http.ResponseWriter, r *http.Request) (usr User, err error) {
+	ctx, span := c.cfg.Tracer.Start(ctx, "chat.handshake")
+	defer func() {
+		span.SetAttributes("chat.user", usr.ID.String(), "chat.session", usr.SessionID.String())
+		span.SetError(err)
+		span.End()
+	}()
 
-	var ws websocket.Upgrader
+	ws := websocket.Upgrader{
+		CheckOrigin:       c.checkOrigin,
+		Subprotocols:      subprotocols,
+		EnableCompression: c.cfg.Compression,
+	}
 	// client connect websocket
 	// 升级http协议为websocket协议
 	conn, err := ws.Upgrade(w, r, nil)
@@ -45,6 +149,22 @@ func (c *Chat) HandleShake(ctx context.Context, w http.ResponseWriter, r *http.R
 		return User{}, errs.Newf(errs.FailedPrecondition, "websocket upgrade failed: %v", err)
 	}
 
+	// 超过最大帧大小时，连接会被关闭
+	conn.SetReadLimit(c.cfg.MaxFrameSize)
+
+	// 是否压缩由 write 按帧的大小决定，握手阶段的帧都很小
+	if c.cfg.Compression {
+		if c.cfg.CompressionLevel != 0 {
+			if err := conn.SetCompressionLevel(c.cfg.CompressionLevel); err != nil {
+				conn.Close()
+				return User{}, fmt.Errorf("set compression level: %w", err)
+			}
+		}
+		conn.EnableWriteCompression(false)
+	}
+
+	enc := encodingFor(conn.Subprotocol())
+
 	// 服务器向客户端发送握手消息
 	if err := conn.WriteMessage(websocket.TextMessage, []byte("HELLO")); err != nil {
 		return User{}, err
@@ -52,27 +172,72 @@ func (c *Chat) HandleShake(ctx context.Context, w http.ResponseWriter, r *http.R
 
 	// 等待客户端发送 UUID,name
 	// 不能一直等待，设置超时时间
-	//conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+	hsCtx, cancel := clock.WithTimeout(ctx, c.cfg.Clock, c.settings().HandshakeTimeout)
 	defer cancel()
 
-	usr := User{
-		Conn: conn,
+	now := c.cfg.Clock.Now()
+	usr = User{
+		Conn:        conn,
+		SessionID:   uuid.New(),
+		ConnectedAt: now,
+		RemoteAddr:  r.RemoteAddr,
+		enc:         enc,
+		conn:        wsTransport{conn: conn, compression: c.cfg.Compression, threshold: c.cfg.CompressionThreshold},
+		lastActive:  new(atomic.Int64),
+		violations:  new(violations),
+		queue:       newQueue(c.cfg.SendQueueSize),
 	}
+	usr.lastActive.Store(now.UnixNano())
 
-	msg, err := c.readMessage(ctx, usr)
+	msg, err := c.readMessage(hsCtx, usr)
 	if err != nil {
+		// 超时后读取的 goroutine 还在等待，关闭连接让它退出
+		conn.Close()
 		return User{}, fmt.Errorf("read message: %w", err)
 	}
 
-	err = json.Unmarshal(msg, &usr)
+	var hs handshake
+	err = enc.unmarshal(msg, &hs)
 	if err != nil {
 		return User{}, fmt.Errorf("unmarshal: %w", err)
 	}
+	usr.ID = hs.ID
+	usr.Name = hs.Name
+
+	// 使用 mTLS 时身份由客户端证书决定，其次是 token
+	err = authenticate(ctx, &usr, r.TLS)
+
+	// 会话的 logger 自动带上用户 ID 和会话 ID
+	usr.log = logger.ForComponent(ctx, logComponent).With("user", usr.ID, "session", usr.SessionID)
+	ctx = logger.NewContext(ctx, usr.log)
+
+	if err == nil {
+		err = c.validateUser(usr)
+	}
+	if err == nil {
+		err = c.checkCertless(usr)
+	}
+	if err != nil {
+		defer conn.Close()
+		if err := writeValue(conn, enc, errorMessage{Error: errs.NewError(err)}); err != nil {
+			return User{}, fmt.Errorf("write message: %w", err)
+		}
+		return User{}, fmt.Errorf("validate user: %w", err)
+	}
 
 	// 添加用户
-	if err := c.addUser(ctx, usr); err != nil {
+	c.evictCertless(ctx, usr)
+	res, err := c.addUser(ctx, usr, hs.Resume)
+	if err != nil {
 		defer conn.Close()
+
+		if errors.Is(err, ErrTooManyConnections) {
+			if err := writeValue(conn, enc, errorMessage{Error: errs.Newf(errs.ResourceExhausted, "too many connections")}); err != nil {
+				return User{}, fmt.Errorf("write message: %w", err)
+			}
+			return User{}, fmt.Errorf("add User: %w", err)
+		}
+
 		// 用户已经存在
 		if err := conn.WriteMessage(websocket.TextMessage, []byte("Already connected")); err != nil {
 			return User{}, fmt.Errorf("write message: %w", err)
@@ -81,19 +246,55 @@ func (c *Chat) HandleShake(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 
 	// 服务器向客户端发送 WELCOME name
+	// 这时 writeLoop 还没有启动，可以直接写入连接，保证 WELCOME 是第一条消息
 	v := fmt.Sprintf("WELCOME %s", usr.Name)
 	if err := conn.WriteMessage(websocket.TextMessage, []byte(v)); err != nil {
+		c.removeUser(ctx, usr)
 		return User{}, fmt.Errorf("write message: %w", err)
 	}
 
-	logger.Log.With(zap.String("uuid", web.GetTraceID(ctx).String())).Infow("handshake completed", "User", usr)
+	// 开启断线续传时告诉客户端续传 token，然后补发断开期间的消息
+	// 补发的消息在 addUser 时取出，之后的消息放入待发送队列，不会重复
+	if res != nil {
+		if err := writeValue(conn, enc, resumeMessage{Resume: res.info}); err != nil {
+			c.removeUser(ctx, usr)
+			return User{}, fmt.Errorf("write message: %w", err)
+		}
+		for _, m := range res.replay {
+			if err := writeValue(conn, enc, m); err != nil {
+				c.removeUser(ctx, usr)
+				return User{}, fmt.Errorf("write message: %w", err)
+			}
+		}
+		usr.log.Infow("resume", "resumed", res.info.Resumed, "replayed", len(res.replay), "gap", res.info.Gap)
+	}
+
+	go c.writeLoop(ctx, usr)
+
+	usr.log.Infow("handshake completed", "User", usr)
 
 	return usr, nil
 }
 
+// checkOrigin 校验浏览器发起握手时的 Origin，同源和没有 Origin 的请求始终允许
+func (c *Chat) checkOrigin(r *http.Request) bool {
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return true
+	}
+
+	if u, err := url.Parse(o); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return c.cfg.Origins != nil && c.cfg.Origins.Allowed(o)
+}
+
 // =============================================================================
 
 func (c *Chat) Listen(ctx context.Context, usr User) {
+	ctx = logger.NewContext(ctx, usr.log)
+
 	for {
 
 		msg, err := c.readMessage(ctx, usr)
@@ -107,34 +308,132 @@ func (c *Chat) Listen(ctx context.Context, usr User) {
 			continue
 		}
 
-		var inMsg inMessage
-		err = json.Unmarshal(msg, &inMsg)
-		if err != nil {
-			logger.Log.Infow("chat-listen-unmarshal", "uuid", web.GetTraceID(ctx).String(), "err", err)
+		alive, admitted := c.admit(ctx, usr)
+		if !alive {
+			return
+		}
+		if !admitted {
 			continue
 		}
-		// 发送信息到对应的用户
-		err = c.sendMessage(inMsg)
+
+		var inMsg inMessage
+		err = usr.enc.unmarshal(msg, &inMsg)
 		if err != nil {
-			logger.Log.Infow("chat-listen-send", "uuid", web.GetTraceID(ctx).String(), "err", err)
+			logger.ForComponent(ctx, logComponent).Infow("chat-listen-unmarshal", "err", err)
+			metrics.AddMessageDropped(metrics.DropInvalid)
+			c.sendError(ctx, usr, errs.Newf(errs.InvalidArgument, "malformed message"))
+			continue
 		}
 
+		c.routeMessage(ctx, usr, inMsg)
+	}
+}
+
+// admit 记录用户的活动并按用户限流，admitted 为 false 时丢弃这条消息
+// ViolationWindow 内多次超过限制的用户会被断开连接，这时 alive 也为 false
+func (c *Chat) admit(ctx context.Context, usr User) (alive bool, admitted bool) {
+	now := c.cfg.Clock.Now()
+	usr.lastActive.Store(now.UnixNano())
+
+	if c.limiter.AllowAt(usr.ID.String(), now) {
+		return true, true
+	}
+
+	s := c.settings()
+	v := usr.violations
+	if now.Sub(v.window) > s.ViolationWindow {
+		v.window = now
+		v.count = 0
+	}
+	v.count++
+
+	logger.ForComponent(ctx, logComponent).Infow("chat-listen-ratelimit", "violations", v.count)
+	metrics.AddMessageDropped(metrics.DropRateLimited)
+
+	if s.MaxViolations > 0 && v.count >= s.MaxViolations {
+		c.disconnect(ctx, usr, websocket.ClosePolicyViolation, "rate limit exceeded")
+		return false, false
+	}
+
+	appErr := errs.Newf(errs.TooManyRequests, "rate limit exceeded, message dropped").
+		WithReason("rate_limited").
+		WithRetryAfter(c.limiter.RetryAfterAt(usr.ID.String(), now))
+	c.sendError(ctx, usr, appErr)
+	return true, false
+}
+
+// routeMessage 校验并投递一条消息，失败时把错误帧发送给用户
+func (c *Chat) routeMessage(ctx context.Context, usr User, inMsg inMessage) {
+	var appErr *errs.Error
+	if err := c.route(ctx, usr, inMsg); errors.As(err, &appErr) {
+		c.sendError(ctx, usr, appErr)
+	}
+}
+
+// route 校验并投递一条消息，每条消息都有自己的 span
+// 客户端在消息中携带 traceparent 时使用它作为父 span，否则使用连接的 span
+func (c *Chat) route(ctx context.Context, usr User, inMsg inMessage) error {
+	opts := []tracer.Option{
+		tracer.WithKind(tracer.KindProducer),
+		tracer.WithAttributes("chat.from", inMsg.FromID.String(), "chat.to", inMsg.ToID.String(), "chat.session", usr.SessionID.String()),
 	}
+	if sc, err := tracer.ParseTraceparent(inMsg.Traceparent); err == nil {
+		opts = append(opts, tracer.WithParent(sc))
+	}
+
+	ctx, span := c.cfg.Tracer.Start(ctx, "chat.route", opts...)
+	defer span.End()
+
+	if err := c.validateMessage(usr, inMsg); err != nil {
+		logger.ForComponent(ctx, logComponent).Infow("chat-listen-validate", "err", err)
+		metrics.AddMessageDropped(metrics.DropInvalid)
+		span.SetError(err)
+		return errs.NewError(err)
+	}
+
+	// 发送信息到对应的用户
+	err := c.sendMessage(ctx, inMsg)
+	if err != nil {
+		logger.ForComponent(ctx, logComponent).Infow("chat-listen-send", "err", err)
+		span.SetError(err)
+	}
+
+	return err
 }
 
 func (c *Chat) isCriticalError(ctx context.Context, err error) bool {
 	switch err.(type) {
 	case *websocket.CloseError:
-		logger.Log.Infow("chat-isCriticalError", "uuid", web.GetTraceID(ctx).String(), "status", "client disconnected")
+		logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "status", "client disconnected")
 		return true
 
 	default:
 		if errors.Is(err, context.Canceled) {
-			logger.Log.Infow("chat-isCriticalError", "uuid", web.GetTraceID(ctx).String(), "status", "client canceled")
+			logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "status", "client canceled")
+			return true
+		}
+
+		// 帧超过最大长度时 gorilla/websocket 已经关闭了连接
+		if errors.Is(err, websocket.ErrReadLimit) {
+			logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "status", "frame too large")
 			return true
 		}
 
-		logger.Log.Infow("chat-isCriticalError", "uuid", web.GetTraceID(ctx).String(), "err", err)
+		// 连接已经被服务端关闭，比如被踢下线或者 ping 失败，继续读取会导致 gorilla/websocket panic
+		if errors.Is(err, net.ErrClosed) {
+			logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "status", "connection closed")
+			return true
+		}
+
+		// 客户端没有发送关闭帧就断开了，比如 connection reset 或者 TLS 连接被截断
+		// gorilla/websocket 读取失败后连接不能再使用
+		var netErr net.Error
+		if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "status", "connection lost", "err", err)
+			return true
+		}
+
+		logger.ForComponent(ctx, logComponent).Infow("chat-isCriticalError", "err", err)
 		return false
 	}
 }
@@ -152,8 +451,8 @@ func (c *Chat) readMessage(ctx context.Context, usr User) ([]byte, error) {
 	ch := make(chan response, 1)
 	go func() {
 
-		logger.Log.Infow("chat-readMessage", "uuid", web.GetTraceID(ctx).String(), "status", "started")
-		defer logger.Log.Infow("chat-readMessage", "uuid", web.GetTraceID(ctx).String(), "status", "completed")
+		logger.ForComponent(ctx, logComponent).Infow("chat-readMessage", "status", "started")
+		defer logger.ForComponent(ctx, logComponent).Infow("chat-readMessage", "status", "completed")
 		_, msg, err := usr.Conn.ReadMessage()
 
 		if err != nil {
@@ -169,28 +468,90 @@ func (c *Chat) readMessage(ctx context.Context, usr User) ([]byte, error) {
 	var resp response
 	select {
 	case <-ctx.Done():
-		c.removeUser(ctx, usr.ID)
-		return nil, ctx.Err()
+		c.removeUser(ctx, usr)
+		// 使用 clock.WithTimeout 超时时 ctx.Err 是 context.Canceled，Cause 才是 context.DeadlineExceeded
+		return nil, context.Cause(ctx)
 	case resp = <-ch:
 		if resp.err != nil {
-			c.removeUser(ctx, usr.ID)
+			c.removeUser(ctx, usr)
+			// 客户端正常关闭时不再需要断线续传
+			if websocket.IsCloseError(resp.err, websocket.CloseNormalClosure) {
+				c.dropMailbox(usr.ID)
+			}
 			return nil, resp.err
 		}
 	}
 	return resp.message, nil
 }
 
-func (c *Chat) sendMessage(msg inMessage) error {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *Chat) sendMessage(ctx context.Context, msg inMessage) error {
 	// 如果用户不存在，返回错误
-	from, exists := c.users[msg.FromID]
+	from, exists := c.lookup(msg.FromID)
 	if !exists {
 		return ErrUserNotExists
 	}
-	to, exists := c.users[msg.ToID]
-	if !exists {
-		return ErrUserNotExists
+
+	// 投递之前进行内容审核，过滤器可能很慢，审核时不持有锁
+	if filters := c.settings().Filters; len(filters) > 0 {
+		fm, d, by := c.moderate(ctx, filters, FilterMessage{FromID: msg.FromID, ToID: msg.ToID, Msg: msg.Msg})
+
+		logger.ForComponent(ctx, logComponent).Infow("chat-moderation", "from", msg.FromID, "to", msg.ToID,
+			"action", d.Action.String(), "filter", by, "reason", d.Reason)
+
+		switch d.Action {
+		case Quarantine:
+			// 隔离的消息不投递，保存下来等待人工审核，发送者不会知道消息被隔离
+			metrics.AddMessageDropped(metrics.DropQuarantined)
+			c.quarantine(ctx, from, msg, by, d.Reason)
+			return nil
+
+		case Reject:
+			// 不把命中的词或者规则告诉发送者，避免被用来试探过滤规则
+			metrics.AddMessageDropped(metrics.DropRejected)
+			return errs.Newf(errs.InvalidArgument, "message rejected by moderation").WithReason("moderation_rejected")
+		}
+
+		msg.Msg = fm.Msg
+	}
+
+	return c.deliver(ctx, User{ID: from.ID, Name: from.Name}, msg.ToID, msg.Msg)
+}
+
+// quarantine 把消息保存到 QuarantineSink
+func (c *Chat) quarantine(ctx context.Context, from User, msg inMessage, filter string, reason string) {
+	m := QuarantinedMessage{
+		ID:       uuid.New(),
+		FromID:   from.ID,
+		FromName: from.Name,
+		ToID:     msg.ToID,
+		Msg:      msg.Msg,
+		Filter:   filter,
+		Reason:   reason,
+		At:       c.cfg.Clock.Now().UTC(),
+	}
+
+	if err := c.cfg.Quarantine.Put(ctx, m); err != nil {
+		logger.ForComponent(ctx, logComponent).Errorw("chat-quarantine", "from", msg.FromID, "to", msg.ToID, "err", err)
+		return
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("chat-quarantine", "id", m.ID, "from", msg.FromID, "to", msg.ToID, "filter", filter)
+}
+
+// deliver 把消息放入接收者的待发送队列，from 只使用 ID 和 Name
+// 接收者开启了断线续传时消息同时放入续传的缓冲区，接收者在 ResumeWindow 内离线时只放入缓冲区
+func (c *Chat) deliver(ctx context.Context, from User, toID uuid.UUID, text string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.cfg.Clock.Now()
+
+	// 接收者不在线和屏蔽了发送者返回同样的错误，避免泄露屏蔽关系
+	to, online := c.users[toID]
+	mb := c.mailboxFor(toID, now)
+	if (!online && mb == nil) || c.isBlocked(toID, from.ID) {
+		metrics.AddMessageDropped(metrics.DropUndeliverable)
+		return errs.Newf(errs.FailedPrecondition, "message could not be delivered")
 	}
 
 	// 构建消息
@@ -203,45 +564,116 @@ func (c *Chat) sendMessage(msg inMessage) error {
 			ID:   to.ID,
 			Name: to.Name,
 		},
-		Msg: msg.Msg,
+		Msg:   text,
+		At:    now.UTC(),
+		Muted: c.isMuted(toID, from.ID),
+	}
+
+	// 把追踪上下文放入消息信封，接收者的投递会关联到发送者的 span
+	sc := tracer.SpanFromContext(ctx).Context()
+	m.Traceparent = sc.Traceparent()
+
+	// 持有 mb.mu 直到放入队列，队列中消息的顺序与序号一致
+	if mb != nil {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+
+		if !online {
+			m.To = User{ID: toID, Name: mb.name}
+		}
+		m = mb.add(m, c.cfg.ResumeBuffer)
+	}
+
+	if !online {
+		metrics.AddMessageRouted()
+		c.touchRoom(from, m.To, m.At)
+		return nil
 	}
 
-	if err := to.Conn.WriteJSON(m); err != nil {
+	// 按接收者协商的编码
+	data, err := to.enc.marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if err := to.enqueue(frame{messageType: to.enc.messageType, data: data, sc: sc, queuedAt: m.At}); err != nil {
+		// 发送者会收到错误，不能在重新连接时补发
+		if mb != nil {
+			mb.undo(m.Seq)
+		}
+		metrics.AddMessageDropped(metrics.DropQueueFull)
 		return fmt.Errorf("write message: %w", err)
 	}
+	metrics.AddMessageRouted()
+	c.touchRoom(from, to, m.At)
 
 	return nil
 }
 
+// lookup 返回用户当前的会话
+func (c *Chat) lookup(id uuid.UUID) (User, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	usr, exists := c.users[id]
+	return usr, exists
+}
+
+// sendError 向用户发送错误帧
+func (c *Chat) sendError(ctx context.Context, usr User, appErr *errs.Error) {
+	if err := usr.enqueueValue(errorMessage{Error: appErr}); err != nil {
+		logger.ForComponent(ctx, logComponent).Infow("chat-sendError", "err", err)
+	}
+}
+
 // 创建所有连接的副本
-func (c *Chat) connections() map[uuid.UUID]*websocket.Conn {
+func (c *Chat) connections() map[uuid.UUID]User {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	// 创建所有连接的副本
-	m := make(map[uuid.UUID]*websocket.Conn, len(c.users))
+	m := make(map[uuid.UUID]User, len(c.users))
 	for k, v := range c.users {
-		m[k] = v.Conn
+		m[k] = v
 	}
 	return m
 }
 
+// Ping 每隔 PingInterval 向所有连接发送 ping，并断开空闲超时的连接
 func (c *Chat) Ping() {
-	ticker := time.NewTicker(time.Second * 10)
+	ticker := c.cfg.Clock.NewTicker(c.settings().PingInterval)
 	go func() {
+		defer ticker.Stop()
 
-		ctx := context.Background()
+		ctx := logger.NewContext(context.Background(), c.log)
 		for {
 
-			<-ticker.C
+			select {
+			case <-ticker.C():
+			case d := <-c.pingInterval:
+				logger.ForComponent(ctx, logComponent).Infow("ping", "interval", d)
+				ticker.Reset(d)
+				continue
+			case <-c.stop:
+				return
+			}
+
+			logger.ForComponent(ctx, logComponent).Infow("ping")
 
-			logger.Log.Infow("ping", "uuid", web.GetTraceID(ctx).String())
+			c.sweepMailboxes()
 
 			// 如何取消每次ping的时候的加锁操作
 			m := c.connections()
-			for k, conn := range m {
-				if err := conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-					logger.Log.Error("ping failed", zap.Error(err))
-					c.removeUser(ctx, k)
+			for _, usr := range m {
+				if c.idle(usr) {
+					usr.log.Infow("idle timeout", "lastActive", usr.session().LastActiveAt)
+					c.disconnect(ctx, usr, websocket.ClosePolicyViolation, "idle timeout")
+					continue
+				}
+
+				if err := usr.conn.ping(time.Now().Add(c.settings().WriteWait)); err != nil {
+					usr.log.Errorw("ping failed", "err", err)
+					metrics.AddPingFailure()
+					c.removeUser(ctx, usr)
 				}
 			}
 
@@ -250,34 +682,186 @@ func (c *Chat) Ping() {
 
 }
 
+// idle 判断连接是否超过 IdleTimeout 没有发送消息
+func (c *Chat) idle(usr User) bool {
+	timeout := c.settings().IdleTimeout
+	if timeout <= 0 {
+		return false
+	}
+
+	return clock.Since(c.cfg.Clock, usr.session().LastActiveAt) > timeout
+}
+
 // -------------------------------------------------------------------------
 
-// addUser 添加用户，如果用户已经存在，返回错误
-func (c *Chat) addUser(ctx context.Context, usr User) error {
+// addUser 添加用户，如果用户已经存在或者连接数已经达到上限，返回错误
+// resume 不为 nil 时恢复或者创建用户的续传会话，返回需要补发的消息
+func (c *Chat) addUser(ctx context.Context, usr User, resume *resumeRequest) (*resumed, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	// 如果用户已经存在，返回错误
 	if _, exists := c.users[usr.ID]; exists {
-		return fmt.Errorf("user already exists")
+		return nil, ErrUserExists
+	}
+	if max := c.settings().MaxConnections; max > 0 && len(c.users) >= max {
+		return nil, ErrTooManyConnections
 	}
 	// 添加用户
 	c.users[usr.ID] = usr
-	logger.Log.Infow("add user", "uuid", web.GetTraceID(ctx), "user", usr)
-	return nil
+	if usr.CertSubject != "" {
+		c.certIDs[usr.ID] = struct{}{}
+	}
+	res := c.attachMailbox(usr, resume)
+	metrics.AddConnection()
+	logger.ForComponent(ctx, logComponent).Infow("add user", "user", usr)
+	return res, nil
 }
 
-// removeUser 移除用户，如果用户不存在，返回错误
-func (c *Chat) removeUser(ctx context.Context, userID uuid.UUID) {
+// removeUser 移除用户的会话，如果用户不存在或者已经是新的会话，直接返回
+func (c *Chat) removeUser(ctx context.Context, usr User) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// 如果用户不存在，返回错误
-	conn, exists := c.users[userID]
-	if !exists {
+	// 如果用户不存在，直接返回
+	cur, exists := c.users[usr.ID]
+	if !exists || cur.SessionID != usr.SessionID {
 		return
 	}
-	delete(c.users, userID)
-	logger.Log.Infow("remove user", "uuid", web.GetTraceID(ctx).String(), "user", userID)
-	// 关闭连接
-	conn.Conn.Close()
+	delete(c.users, usr.ID)
+	c.detachMailbox(usr.ID)
+	c.pruneRooms(usr.ID)
+	metrics.RemoveConnection()
+	logger.ForComponent(ctx, logComponent).Infow("remove user", "user", usr.ID, "session", usr.SessionID)
+	// 关闭连接，丢弃待发送队列中剩余的帧
+	cur.queue.close()
+	cur.conn.close()
+}
+
+// disconnect 向客户端发送关闭帧后移除用户
+func (c *Chat) disconnect(ctx context.Context, usr User, code int, reason string) {
+	reason = truncateReason(reason)
+
+	if err := usr.conn.closeWith(code, reason, time.Now().Add(c.settings().WriteWait)); err != nil {
+		logger.ForComponent(ctx, logComponent).Infow("chat-disconnect", "user", usr.ID, "err", err)
+	}
+
+	c.removeUser(ctx, usr)
+	c.dropMailbox(usr.ID)
+}
+
+// truncateReason 关闭帧的内容最多 125 字节，去掉 2 字节的关闭码后原因最多 123 字节
+// 在字符的边界截断，关闭帧的原因必须是合法的 UTF-8
+func truncateReason(reason string) string {
+	const max = 123
+	if len(reason) <= max {
+		return reason
+	}
+
+	i := max
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+
+	return reason[:i]
+}
+
+// writeLoop 把待发送队列中的帧依次写入连接，直到会话结束
+func (c *Chat) writeLoop(ctx context.Context, usr User) {
+	for {
+		select {
+		case f := <-usr.queue.ch:
+			usr.queue.popped()
+
+			// 慢速客户端的队列中积压太久的消息已经没有意义
+			if c.expired(f) {
+				logger.ForComponent(ctx, logComponent).Infow("chat-writeLoop", "status", "message expired", "queuedAt", f.queuedAt)
+				metrics.AddMessageDropped(metrics.DropExpired)
+				continue
+			}
+
+			if err := c.write(ctx, usr, f); err != nil {
+				logger.ForComponent(ctx, logComponent).Infow("chat-writeLoop", "err", err)
+				c.removeUser(ctx, usr)
+				return
+			}
+
+		case <-usr.queue.done:
+			// 会话结束时 removeUser 已经丢弃了队列中剩余的帧
+			return
+		}
+	}
+}
+
+// expired 判断帧在队列中是否超过了 MessageTTL，只有消息会设置放入队列的时间
+func (c *Chat) expired(f frame) bool {
+	ttl := c.settings().MessageTTL
+	if ttl <= 0 || f.queuedAt.IsZero() {
+		return false
+	}
+
+	return clock.Since(c.cfg.Clock, f.queuedAt) > ttl
+}
+
+// write 把一个帧写入连接，带有追踪上下文的帧会创建投递的 span
+// 投递的 span 是发送者路由消息的子 span，同时关联接收者连接的 span
+func (c *Chat) write(ctx context.Context, usr User, f frame) error {
+	if !f.sc.IsValid() {
+		return usr.conn.write(f)
+	}
+
+	_, span := c.cfg.Tracer.Start(ctx, "chat.deliver",
+		tracer.WithKind(tracer.KindConsumer),
+		tracer.WithParent(f.sc),
+		tracer.WithAttributes("chat.to", usr.ID.String(), "chat.session", usr.SessionID.String()))
+	defer span.End()
+
+	span.AddLink(tracer.SpanFromContext(ctx).Context())
+
+	err := usr.conn.write(f)
+	span.SetError(err)
+
+	return err
+}
+
+// -------------------------------------------------------------------------
+
+// enqueue 把帧放入待发送队列，队列满时直接返回错误，避免慢速客户端阻塞发送者
+func (u User) enqueue(f frame) error {
+	return u.queue.push(f)
+}
+
+// enqueueValue 按会话的编码把消息放入待发送队列
+func (u User) enqueueValue(v any) error {
+	data, err := u.enc.marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return u.enqueue(frame{messageType: u.enc.messageType, data: data})
+}
+
+// writeValue 在 writeLoop 启动之前按编码直接写入连接，只用于握手
+func writeValue(conn *websocket.Conn, enc *encoding, v any) error {
+	data, err := enc.marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	return conn.WriteMessage(enc.messageType, data)
+}
+
+// session 返回会话的信息
+func (u User) session() Session {
+	return Session{
+		SessionID:     u.SessionID,
+		UserID:        u.ID,
+		Name:          u.Name,
+		ConnectedAt:   u.ConnectedAt,
+		LastActiveAt:  time.Unix(0, u.lastActive.Load()),
+		RemoteAddr:    u.RemoteAddr,
+		CertSubject:   u.CertSubject,
+		Encoding:      u.enc.name,
+		QueueDepth:    u.queue.len(),
+		QueueCapacity: u.queue.cap(),
+	}
 }
@@ -0,0 +1,278 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSend(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	alice.Send(bob.ID, "hi")
+	msg := bob.ExpectMessage(alice.ID, "hi")
+	if msg.From.Name != "alice" || msg.To.ID != bob.ID || msg.To.Name != "bob" {
+		t.Errorf("got message from %v to %v", msg.From, msg.To)
+	}
+	if !msg.At.Equal(srv.Clock.Now()) {
+		t.Errorf("message time: got %s, want %s", msg.At, srv.Clock.Now())
+	}
+
+	bob.Send(alice.ID, "hello")
+	alice.ExpectMessage(bob.ID, "hello")
+
+	// 接收者不在线
+	alice.Send(uuid.New(), "hi")
+	alice.ExpectError("failed_precondition")
+
+	// 不能冒充其他用户发送
+	alice.SendJSON(map[string]any{"fromID": bob.ID, "toID": bob.ID, "msg": "hi"})
+	alice.ExpectError("permission_denied")
+
+	bob.ExpectNothing(50 * time.Millisecond)
+}
+
+func TestBlock(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	ctx := context.Background()
+	srv.Chat.Block(ctx, bob.ID, alice.ID)
+
+	// 被屏蔽和接收者不在线返回同样的错误
+	alice.Send(bob.ID, "hi")
+	alice.ExpectError("failed_precondition")
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	// 屏蔽是单向的
+	bob.Send(alice.ID, "hi")
+	alice.ExpectMessage(bob.ID, "hi")
+
+	srv.Chat.Unblock(ctx, bob.ID, alice.ID)
+
+	alice.Send(bob.ID, "hi again")
+	bob.ExpectMessage(alice.ID, "hi again")
+}
+
+func TestIdle(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{
+		Chat: func(cfg *chat.Config) {
+			cfg.PingInterval = 10 * time.Second
+			cfg.IdleTimeout = 30 * time.Second
+		},
+	})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	// 发送消息的用户不是空闲的
+	srv.Advance(t, 20*time.Second)
+	bob.Send(alice.ID, "ping")
+	alice.ExpectMessage(bob.ID, "ping")
+
+	srv.Advance(t, 20*time.Second)
+
+	if reason := alice.ExpectClose(websocket.ClosePolicyViolation); reason != "idle timeout" {
+		t.Errorf("close reason: got %q, want %q", reason, "idle timeout")
+	}
+	srv.AssertOffline(t, alice.ID)
+	srv.AssertOnline(t, bob.ID)
+}
+
+func TestKick(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	var sessionID uuid.UUID
+	for _, s := range srv.Chat.Sessions() {
+		if s.UserID == alice.ID {
+			sessionID = s.SessionID
+		}
+	}
+
+	ctx := context.Background()
+	if err := srv.Chat.Kick(ctx, sessionID, "spam"); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+
+	if reason := alice.ExpectClose(websocket.ClosePolicyViolation); reason != "spam" {
+		t.Errorf("close reason: got %q, want %q", reason, "spam")
+	}
+	srv.AssertOffline(t, alice.ID)
+
+	bob.Send(alice.ID, "hi")
+	bob.ExpectError("failed_precondition")
+
+	// 会话已经不存在
+	if err := srv.Chat.Kick(ctx, sessionID, "spam"); err == nil {
+		t.Errorf("kick a closed session: got nil error")
+	}
+
+	// 被踢下线后可以重新连接
+	again := srv.Dial(t, nil)
+	again.Handshake(alice.ID, "alice")
+	srv.AssertOnline(t, alice.ID)
+}
+
+func TestKickLongReason(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	srv.AssertOnline(t, alice.ID)
+
+	// 每个字符 3 字节，123 字节的位置在一个字符的中间
+	reason := strings.Repeat("违", 30) + "规"
+	sessionID := srv.Chat.Sessions()[0].SessionID
+	if err := srv.Chat.Kick(context.Background(), sessionID, "x"+reason+reason); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+
+	got := alice.ExpectClose(websocket.ClosePolicyViolation)
+	if !utf8.ValidString(got) {
+		t.Fatalf("close reason is not valid UTF-8: %q", got)
+	}
+	if len(got) > 123 {
+		t.Errorf("close reason has %d bytes, want at most 123", len(got))
+	}
+	if want := "x" + strings.Repeat("违", 30) + "规" + strings.Repeat("违", 9); got != want {
+		t.Errorf("close reason: got %q, want %q", got, want)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	carol := srv.Connect(t, "carol")
+	srv.AssertOnline(t, alice.ID, bob.ID, carol.ID)
+
+	if rooms := srv.Chat.Rooms(uuid.Nil); len(rooms) != 0 {
+		t.Fatalf("rooms before any message: %v", rooms)
+	}
+
+	alice.Send(bob.ID, "hi")
+	bob.ExpectMessage(alice.ID, "hi")
+	bob.Send(alice.ID, "hi")
+	alice.ExpectMessage(bob.ID, "hi")
+	srv.Advance(t, time.Second)
+	carol.Send(alice.ID, "hey")
+	alice.ExpectMessage(carol.ID, "hey")
+
+	rooms := srv.Chat.Rooms(alice.ID)
+	if len(rooms) != 2 {
+		t.Fatalf("alice's rooms: got %d, want 2", len(rooms))
+	}
+
+	// 最近的会话在前面
+	if rooms[0].ID != chat.RoomID(carol.ID, alice.ID) || rooms[1].ID != chat.RoomID(alice.ID, bob.ID) {
+		t.Errorf("got rooms %v", rooms)
+	}
+	if chat.RoomID(alice.ID, bob.ID) != chat.RoomID(bob.ID, alice.ID) {
+		t.Errorf("room id depends on the order of the members")
+	}
+
+	if rooms := srv.Chat.Rooms(bob.ID); len(rooms) != 1 || len(rooms[0].Members) != 2 {
+		t.Fatalf("bob's rooms: got %v", rooms)
+	}
+	if rooms := srv.Chat.Rooms(uuid.Nil); len(rooms) != 2 {
+		t.Fatalf("all rooms: got %d, want 2", len(rooms))
+	}
+
+	// 一个成员离线后房间还在
+	bob.Close()
+	srv.AssertOffline(t, bob.ID)
+
+	rooms = srv.Chat.Rooms(bob.ID)
+	if len(rooms) != 1 {
+		t.Fatalf("bob's rooms after bob left: got %d, want 1", len(rooms))
+	}
+	for _, m := range rooms[0].Members {
+		if want := m.ID == alice.ID; m.Online != want {
+			t.Errorf("member %s online: got %v, want %v", m.Name, m.Online, want)
+		}
+	}
+
+	// 两个成员都离线后房间被删除
+	alice.Close()
+	srv.AssertOffline(t, alice.ID)
+
+	if rooms := srv.Chat.Rooms(uuid.Nil); len(rooms) != 1 || rooms[0].ID != chat.RoomID(alice.ID, carol.ID) {
+		t.Fatalf("rooms after alice left: got %v, want only alice and carol", rooms)
+	}
+
+	carol.Close()
+	srv.AssertOffline(t, carol.ID)
+
+	if rooms := srv.Chat.Rooms(uuid.Nil); len(rooms) != 0 {
+		t.Errorf("rooms after everyone left: got %v", rooms)
+	}
+}
+
+func TestSnapshotRooms(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	carol := srv.Connect(t, "carol")
+	srv.AssertOnline(t, alice.ID, bob.ID, carol.ID)
+
+	if s := srv.Chat.Snapshot(); s.Users != 3 || s.Rooms != 0 || len(s.RoomsOnline) != 0 {
+		t.Fatalf("snapshot before any message: %+v", s)
+	}
+
+	alice.Send(bob.ID, "hi")
+	bob.ExpectMessage(alice.ID, "hi")
+	carol.Send(alice.ID, "hey")
+	alice.ExpectMessage(carol.ID, "hey")
+
+	ab := chat.RoomID(alice.ID, bob.ID).String()
+	ac := chat.RoomID(alice.ID, carol.ID).String()
+
+	s := srv.Chat.Snapshot()
+	if s.Rooms != 2 || s.RoomsOnline[ab] != 2 || s.RoomsOnline[ac] != 2 {
+		t.Fatalf("snapshot: got rooms %d %v, want both rooms with two members online", s.Rooms, s.RoomsOnline)
+	}
+
+	bob.Close()
+	srv.AssertOffline(t, bob.ID)
+
+	s = srv.Chat.Snapshot()
+	if s.Users != 2 || s.Rooms != 2 || s.RoomsOnline[ab] != 1 || s.RoomsOnline[ac] != 2 {
+		t.Fatalf("snapshot after bob left: got users %d rooms %d %v", s.Users, s.Rooms, s.RoomsOnline)
+	}
+
+	// expvar 输出 JSON
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if m["rooms"] != float64(2) {
+		t.Errorf("json rooms: got %v, want 2", m["rooms"])
+	}
+	if online, ok := m["roomsOnline"].(map[string]any); !ok || online[ab] != float64(1) {
+		t.Errorf("json roomsOnline: got %v", m["roomsOnline"])
+	}
+}
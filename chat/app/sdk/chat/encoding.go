@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/foundation/wire"
+)
+
+// 客户端通过 Sec-WebSocket-Protocol 选择的编码，没有选择时使用 JSON 文本帧
+// HELLO、WELCOME 和 Already connected 在所有编码下都是文本帧
+const (
+	SubprotocolJSON    = "chat.json"
+	SubprotocolMsgpack = "chat.msgpack"
+	SubprotocolCBOR    = "chat.cbor"
+)
+
+// subprotocols 服务端支持的子协议，客户端同时提供多个时按这个顺序选择
+var subprotocols = []string{SubprotocolMsgpack, SubprotocolCBOR, SubprotocolJSON}
+
+// encoding 会话中 json 帧使用的编码
+type encoding struct {
+	name        string
+	messageType int
+	marshal     func(v any) ([]byte, error)
+	unmarshal   func(data []byte, v any) error
+}
+
+var (
+	jsonEncoding    = newEncoding(wire.JSON)
+	msgpackEncoding = newEncoding(wire.Msgpack)
+	cborEncoding    = newEncoding(wire.CBOR)
+)
+
+// encodingFor 返回握手时协商的子协议对应的编码
+func encodingFor(subprotocol string) *encoding {
+	switch subprotocol {
+	case SubprotocolMsgpack:
+		return &msgpackEncoding
+	case SubprotocolCBOR:
+		return &cborEncoding
+	default:
+		return &jsonEncoding
+	}
+}
+
+func newEncoding(c wire.Codec) encoding {
+	messageType := websocket.TextMessage
+	if c.Binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	return encoding{
+		name:        c.Name,
+		messageType: messageType,
+		marshal:     c.Marshal,
+		unmarshal:   c.Unmarshal,
+	}
+}
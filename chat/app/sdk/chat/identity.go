@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"strings"
+)
+
+// Identity 由客户端证书确定的用户身份
+type Identity struct {
+	ID   uuid.UUID
+	Name string
+	// Subject 证书的 subject，用于日志和管理接口
+	Subject string
+}
+
+// IdentityFromCert 把客户端证书映射为用户身份
+// ID 优先使用 urn:uuid:<id> 格式的 URI SAN，没有时由 subject 生成固定的 UUID (SHA-1, NameSpaceX500)
+// Name 使用 subject 的 CommonName
+func IdentityFromCert(cert *x509.Certificate) (Identity, error) {
+	subject := cert.Subject.String()
+
+	if cert.Subject.CommonName == "" {
+		return Identity{}, errs.Newf(errs.PermissionDenied, "client certificate %q has no common name", subject)
+	}
+
+	id := uuid.NewSHA1(uuid.NameSpaceX500, []byte(subject))
+	for _, u := range cert.URIs {
+		if u.Scheme != "urn" || !strings.HasPrefix(u.Opaque, "uuid:") {
+			continue
+		}
+		v, err := uuid.Parse(strings.TrimPrefix(u.Opaque, "uuid:"))
+		if err != nil {
+			return Identity{}, errs.Newf(errs.PermissionDenied, "client certificate %q: invalid uuid uri %q", subject, u)
+		}
+		id = v
+		break
+	}
+
+	return Identity{
+		ID:      id,
+		Name:    cert.Subject.CommonName,
+		Subject: subject,
+	}, nil
+}
+
+// peerIdentity 返回校验通过的客户端证书对应的身份，没有客户端证书时返回 false
+func peerIdentity(state *tls.ConnectionState) (Identity, bool, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return Identity{}, false, nil
+	}
+
+	ident, err := IdentityFromCert(state.VerifiedChains[0][0])
+	if err != nil {
+		return Identity{}, false, err
+	}
+
+	return ident, true, nil
+}
+
+// authenticate 使用客户端证书或者 token 的身份替换握手时客户端发送的身份，证书优先
+// token 的身份由 mid.Authenticate 放入 ctx，两者都没有时使用客户端发送的身份
+// 客户端发送的 ID 与证书或者 token 不一致时拒绝连接，没有发送 ID 时使用证书或者 token 的 ID
+func authenticate(ctx context.Context, usr *User, state *tls.ConnectionState) error {
+	ident, ok, err := peerIdentity(state)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return authenticateToken(ctx, usr)
+	}
+
+	if usr.ID != uuid.Nil && usr.ID != ident.ID {
+		return errs.Newf(errs.PermissionDenied, "id does not match the client certificate")
+	}
+
+	usr.ID = ident.ID
+	usr.Name = ident.Name
+	usr.CertSubject = ident.Subject
+
+	return nil
+}
+
+// authenticateToken 使用 token 的用户 ID，用户名仍然由客户端决定
+func authenticateToken(ctx context.Context, usr *User) error {
+	userID, ok := tokenIdentity(ctx)
+	if !ok {
+		return nil
+	}
+
+	if usr.ID != uuid.Nil && usr.ID != userID {
+		return errs.Newf(errs.PermissionDenied, "id does not match the token")
+	}
+
+	usr.ID = userID
+
+	return nil
+}
+
+// tokenIdentity 返回 ctx 中 token 的用户 ID
+func tokenIdentity(ctx context.Context) (uuid.UUID, bool) {
+	ident, ok := auth.FromContext(ctx)
+	if !ok || ident.Method != auth.MethodToken {
+		return uuid.Nil, false
+	}
+
+	return ident.UserID, true
+}
+
+// checkCertless 校验没有客户端证书的连接声明的 ID，只在 Config.ClientCerts 为 true 时检查
+// 由证书 subject 生成的 ID (UUID 版本 5) 和曾经通过证书连接过的 ID 只能通过证书使用
+func (c *Chat) checkCertless(usr User) error {
+	if !c.cfg.ClientCerts || usr.CertSubject != "" {
+		return nil
+	}
+
+	if usr.ID.Version() == 5 {
+		return errs.Newf(errs.PermissionDenied, "id is reserved for client certificates").WithField("id", "is reserved for client certificates")
+	}
+
+	c.mu.RLock()
+	_, bound := c.certIDs[usr.ID]
+	c.mu.RUnlock()
+
+	if bound {
+		return errs.Newf(errs.PermissionDenied, "id is bound to a client certificate").WithField("id", "is bound to a client certificate")
+	}
+
+	return nil
+}
+
+// evictCertless 断开没有客户端证书却使用了 usr 的 ID 的会话
+// 证书中 URI SAN 的 ID 在第一次通过证书连接之前不会被 checkCertless 拒绝
+func (c *Chat) evictCertless(ctx context.Context, usr User) {
+	if usr.CertSubject == "" {
+		return
+	}
+
+	c.mu.RLock()
+	cur, exists := c.users[usr.ID]
+	c.mu.RUnlock()
+
+	if !exists || cur.CertSubject != "" {
+		return
+	}
+
+	logger.ForComponent(ctx, logComponent).Infow("evict certless session", "user", cur.ID, "session", cur.SessionID)
+
+	c.disconnect(ctx, cur, websocket.ClosePolicyViolation, "id is bound to a client certificate")
+}
@@ -0,0 +1,112 @@
+package chat_test
+
+import (
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCertlessClaims(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{ClientCerts: true})
+
+	// 由 subject 生成 ID 的证书，还没有通过证书连接过
+	aliceCert := srv.ClientCert(t, "alice", uuid.Nil)
+	alice, err := chat.IdentityFromCert(aliceCert.Leaf)
+	if err != nil {
+		t.Fatalf("identity from cert: %v", err)
+	}
+
+	c := srv.Dial(t, nil)
+	c.ExpectText("HELLO")
+	c.SendJSON(map[string]any{"id": alice.ID, "name": "alice"})
+	c.ExpectError("permission_denied")
+
+	// URI SAN 中的 ID 通过证书连接过之后，没有证书的连接不能再使用
+	bobID := uuid.New()
+	bob := srv.DialCert(t, srv.ClientCert(t, "bob", bobID))
+	bob.Handshake(uuid.Nil, "bob")
+	srv.AssertOnline(t, bobID)
+	bob.Close()
+	srv.AssertOffline(t, bobID)
+
+	c = srv.Dial(t, nil)
+	c.ExpectText("HELLO")
+	c.SendJSON(map[string]any{"id": bobID, "name": "bob"})
+	c.ExpectError("permission_denied")
+	srv.AssertOffline(t, bobID)
+
+	// 证书的持有者可以正常连接
+	a := srv.DialCert(t, aliceCert)
+	a.Handshake(alice.ID, "alice")
+	srv.AssertOnline(t, alice.ID)
+
+	// 没有证书的连接使用其他 ID 不受影响
+	carol := srv.Connect(t, "carol")
+	srv.AssertOnline(t, carol.ID)
+}
+
+func TestCertEvictsCertless(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{ClientCerts: true})
+
+	// 证书中的 ID 第一次通过证书连接之前被没有证书的连接占用了
+	id := uuid.New()
+	squatter := srv.Dial(t, nil)
+	squatter.Handshake(id, "mallory")
+	srv.AssertOnline(t, id)
+
+	owner := srv.DialCert(t, srv.ClientCert(t, "dave", id))
+	owner.Handshake(id, "dave")
+
+	if reason := squatter.ExpectClose(websocket.ClosePolicyViolation); reason != "id is bound to a client certificate" {
+		t.Errorf("close reason: got %q", reason)
+	}
+
+	sessions := srv.Chat.Sessions()
+	if len(sessions) != 1 || sessions[0].UserID != id || sessions[0].CertSubject == "" {
+		t.Fatalf("sessions: got %+v, want only the certificate session", sessions)
+	}
+}
+
+func TestTokenHandshake(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	aliceID := uuid.New()
+	header := http.Header{"Authorization": {"Bearer " + srv.Token(t, aliceID)}}
+
+	// 握手的 ID 必须与 token 的用户一致
+	c := srv.Dial(t, header)
+	c.ExpectText("HELLO")
+	c.SendJSON(map[string]any{"id": uuid.New(), "name": "mallory"})
+	c.ExpectError("permission_denied")
+	srv.AssertCount(t, 0)
+
+	// 没有发送 ID 时使用 token 的 ID
+	c = srv.Dial(t, header)
+	c.Handshake(uuid.Nil, "alice")
+	srv.AssertOnline(t, aliceID)
+	c.Close()
+	srv.AssertOffline(t, aliceID)
+
+	c = srv.Dial(t, header)
+	c.Handshake(aliceID, "alice")
+	srv.AssertOnline(t, aliceID)
+
+	// token 不合法时在升级之前拒绝
+	for _, token := range []string{"garbage", srv.Token(t, aliceID) + "x"} {
+		_, resp, err := websocket.DefaultDialer.Dial(srv.URL, http.Header{"Authorization": {"Bearer " + token}})
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: got %v, want 401", token, err)
+		}
+	}
+
+	// 过期的 token 也被拒绝
+	expired := http.Header{"Authorization": {"Bearer " + srv.Token(t, uuid.New())}}
+	srv.Advance(t, 2*time.Hour)
+	if _, resp, err := websocket.DefaultDialer.Dial(srv.URL, expired); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expired token: got %v, want 401", err)
+	}
+}
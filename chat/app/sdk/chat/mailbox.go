@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// mailbox 开启断线续传的用户最近收到的消息
+// 会话意外断开后保留 ResumeWindow，这段时间内发给用户的消息放入缓冲区
+// 用户带着续传 token 和最后收到的序号重新连接时补发，被踢下线、服务端断开和客户端正常关闭时删除
+type mailbox struct {
+	token uuid.UUID
+
+	mu sync.Mutex
+	// name 用户离线时构建消息使用的用户名
+	name string
+	// seq 最后一条消息的序号
+	seq uint64
+	// buf 最近的 ResumeBuffer 条消息，按序号递增
+	buf []outMessage
+	// expiresAt 用户离线后保留到这个时间，在线时为零值
+	expiresAt time.Time
+}
+
+// resumed 握手时恢复或者创建的续传会话
+type resumed struct {
+	info   resumeInfo
+	replay []outMessage
+}
+
+// add 给消息分配序号并放入缓冲区，超过 size 时丢弃最旧的，调用方需要持有 mb.mu
+func (mb *mailbox) add(m outMessage, size int) outMessage {
+	mb.seq++
+	m.Seq = mb.seq
+
+	mb.buf = append(mb.buf, m)
+	if over := len(mb.buf) - size; over > 0 {
+		mb.buf = append([]outMessage(nil), mb.buf[over:]...)
+	}
+
+	return m
+}
+
+// undo 删除最后放入的消息，用于放入待发送队列失败时，调用方需要持有 mb.mu
+func (mb *mailbox) undo(seq uint64) {
+	if n := len(mb.buf); n > 0 && mb.buf[n-1].Seq == seq {
+		mb.buf = mb.buf[:n-1]
+	}
+}
+
+// since 返回序号大于 lastSeq 的消息，gap 为 true 时缓冲区已经丢弃了其中一部分，调用方需要持有 mb.mu
+func (mb *mailbox) since(lastSeq uint64) (replay []outMessage, gap bool) {
+	if lastSeq >= mb.seq {
+		return nil, false
+	}
+
+	for i, m := range mb.buf {
+		if m.Seq > lastSeq {
+			return append([]outMessage(nil), mb.buf[i:]...), m.Seq > lastSeq+1
+		}
+	}
+
+	return nil, true
+}
+
+// expired 用户离线超过了 ResumeWindow，调用方需要持有 mb.mu
+func (mb *mailbox) expired(now time.Time) bool {
+	return !mb.expiresAt.IsZero() && !now.Before(mb.expiresAt)
+}
+
+// =============================================================================
+
+// attachMailbox 握手时恢复或者创建用户的续传会话，调用方需要持有 c.mu 的写锁
+// 没有请求续传时删除之前的续传会话，返回 nil
+// 不支持续传时返回空的 token，客户端不需要等待 WELCOME 之后的帧
+// token 不匹配或者已经过期时创建新的续传会话，之前缓冲的消息不会补发
+func (c *Chat) attachMailbox(usr User, req *resumeRequest) *resumed {
+	window := c.settings().ResumeWindow
+	if req == nil || window <= 0 {
+		delete(c.mailboxes, usr.ID)
+		if req == nil {
+			return nil
+		}
+		return &resumed{}
+	}
+
+	info := resumeInfo{Window: int(window / time.Second)}
+
+	mb, exists := c.mailboxes[usr.ID]
+	if exists {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+
+		if mb.token == req.Token && !mb.expired(c.cfg.Clock.Now()) {
+			mb.name = usr.Name
+			mb.expiresAt = time.Time{}
+
+			replay, gap := mb.since(req.LastSeq)
+
+			info.Token = mb.token
+			info.Resumed = true
+			info.Gap = gap
+			return &resumed{info: info, replay: replay}
+		}
+	}
+
+	mb = &mailbox{token: uuid.New(), name: usr.Name}
+	c.mailboxes[usr.ID] = mb
+
+	info.Token = mb.token
+	return &resumed{info: info}
+}
+
+// detachMailbox 会话意外断开后保留用户的续传会话 ResumeWindow，调用方需要持有 c.mu 的写锁
+func (c *Chat) detachMailbox(userID uuid.UUID) {
+	mb, exists := c.mailboxes[userID]
+	if !exists {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.expiresAt = c.cfg.Clock.Now().Add(c.settings().ResumeWindow)
+}
+
+// dropMailbox 删除用户的续传会话，用户已经重新连接时不删除
+func (c *Chat) dropMailbox(userID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, online := c.users[userID]; online {
+		return
+	}
+	delete(c.mailboxes, userID)
+}
+
+// mailboxFor 返回可以接收消息的续传会话，调用方需要持有 c.mu 的读锁或者写锁
+func (c *Chat) mailboxFor(userID uuid.UUID, now time.Time) *mailbox {
+	mb, exists := c.mailboxes[userID]
+	if !exists {
+		return nil
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.expired(now) {
+		return nil
+	}
+	return mb
+}
+
+// sweepMailboxes 删除过期的续传会话，每次 ping 时调用
+func (c *Chat) sweepMailboxes() {
+	now := c.cfg.Clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, mb := range c.mailboxes {
+		mb.mu.Lock()
+		expired := mb.expired(now)
+		mb.mu.Unlock()
+
+		if expired {
+			delete(c.mailboxes, id)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package chat_test
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"testing"
+	"time"
+)
+
+// resumeFrame 请求断线续传时服务端紧跟在 WELCOME 之后发送的帧
+type resumeFrame struct {
+	Resume struct {
+		Token   uuid.UUID `json:"token"`
+		Resumed bool      `json:"resumed"`
+		Gap     bool      `json:"gap"`
+		Window  int       `json:"window"`
+	} `json:"resume"`
+}
+
+// handshakeResume 请求断线续传的握手，返回服务端的续传结果
+func handshakeResume(t *testing.T, srv *chattest.Server, id uuid.UUID, token uuid.UUID, lastSeq uint64) (*chattest.Conn, resumeFrame) {
+	t.Helper()
+
+	c := srv.Dial(t, nil)
+	c.ID = id
+	c.Name = "bob"
+
+	c.ExpectText("HELLO")
+	c.SendJSON(map[string]any{
+		"id":     id,
+		"name":   "bob",
+		"resume": map[string]any{"token": token, "lastSeq": lastSeq},
+	})
+	c.ExpectText("WELCOME bob")
+
+	var f resumeFrame
+	if err := json.Unmarshal(c.Expect().Data, &f); err != nil {
+		t.Fatalf("resume frame: %v", err)
+	}
+
+	return c, f
+}
+
+func TestResumeWindow(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{
+		Chat: func(cfg *chat.Config) {
+			cfg.ResumeWindow = 30 * time.Second
+			cfg.ResumeBuffer = 2
+		},
+	})
+
+	alice := srv.Connect(t, "alice")
+	bobID := uuid.New()
+
+	bob, f := handshakeResume(t, srv, bobID, uuid.Nil, 0)
+	if f.Resume.Token == uuid.Nil || f.Resume.Resumed || f.Resume.Window != 30 {
+		t.Fatalf("first connect: got %+v", f.Resume)
+	}
+	token := f.Resume.Token
+
+	alice.Send(bobID, "one")
+	if got := bob.ExpectMessage(alice.ID, "one"); got.Seq != 1 {
+		t.Errorf("seq: got %d, want 1", got.Seq)
+	}
+
+	// 断开期间的消息在重新连接时补发
+	bob.Drop()
+	srv.AssertOffline(t, bobID)
+	alice.Send(bobID, "two")
+	alice.ExpectNothing(50 * time.Millisecond)
+
+	bob, f = handshakeResume(t, srv, bobID, token, 1)
+	if f.Resume.Token != token || !f.Resume.Resumed || f.Resume.Gap {
+		t.Fatalf("resume: got %+v", f.Resume)
+	}
+	if got := bob.ExpectMessage(alice.ID, "two"); got.Seq != 2 {
+		t.Errorf("seq: got %d, want 2", got.Seq)
+	}
+
+	// 缓冲区只保留最近的 2 条消息
+	bob.Drop()
+	srv.AssertOffline(t, bobID)
+	for _, msg := range []string{"three", "four", "five"} {
+		alice.Send(bobID, msg)
+	}
+	alice.ExpectNothing(50 * time.Millisecond)
+
+	bob, f = handshakeResume(t, srv, bobID, token, 2)
+	if !f.Resume.Resumed || !f.Resume.Gap {
+		t.Fatalf("resume with a gap: got %+v", f.Resume)
+	}
+	bob.ExpectMessage(alice.ID, "four")
+	bob.ExpectMessage(alice.ID, "five")
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	// 超过 ResumeWindow 后不再接收消息，重新连接是新的会话
+	bob.Drop()
+	srv.AssertOffline(t, bobID)
+	srv.Advance(t, 31*time.Second)
+	alice.Send(bobID, "six")
+	alice.ExpectError("failed_precondition")
+
+	bob, f = handshakeResume(t, srv, bobID, token, 5)
+	if f.Resume.Resumed || f.Resume.Token == token {
+		t.Fatalf("resume after the window: got %+v", f.Resume)
+	}
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	// 正常关闭后不保留会话
+	bob.Close()
+	srv.AssertOffline(t, bobID)
+	alice.Send(bobID, "seven")
+	alice.ExpectError("failed_precondition")
+}
+
+func TestResumeDisabled(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{
+		Chat: func(cfg *chat.Config) {
+			cfg.ResumeWindow = 0
+		},
+	})
+
+	alice := srv.Connect(t, "alice")
+	bobID := uuid.New()
+
+	// 不支持断线续传时返回空的 token
+	bob, f := handshakeResume(t, srv, bobID, uuid.Nil, 0)
+	if f.Resume.Token != uuid.Nil || f.Resume.Resumed {
+		t.Fatalf("resume: got %+v", f.Resume)
+	}
+
+	alice.Send(bobID, "one")
+	if got := bob.ExpectMessage(alice.ID, "one"); got.Seq != 0 {
+		t.Errorf("seq: got %d, want 0", got.Seq)
+	}
+
+	bob.Drop()
+	srv.AssertOffline(t, bobID)
+	alice.Send(bobID, "two")
+	alice.ExpectError("failed_precondition")
+}
@@ -3,22 +3,221 @@ package chat
 import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/clock"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
 )
 
+// Config 聊天服务的配置，Settings 中的配置可以在运行时通过 Reconfigure 修改
+type Config struct {
+	Settings
+
+	// MaxFrameSize 客户端单个帧的最大字节数
+	MaxFrameSize int64
+	// SendQueueSize 每个连接待发送队列的长度，队列满时丢弃消息
+	SendQueueSize int
+	// ResumeBuffer 断线续传时每个用户保留的最近的消息数
+	ResumeBuffer int
+	// Compression 客户端支持时使用 permessage-deflate 压缩
+	Compression bool
+	// CompressionLevel flate 的压缩级别，-2 到 9，为 0 时使用 1 (flate.BestSpeed)
+	CompressionLevel int
+	// CompressionThreshold 小于这个字节数的帧不压缩，压缩小帧的开销大于节省的流量
+	CompressionThreshold int
+	// Tracer 为握手、消息路由和投递创建 span，可以为 nil
+	Tracer *tracer.Tracer
+	// Origins 浏览器发起 websocket 握手时允许的来源，与 CORS 使用同一个列表
+	// 为 nil 时只允许同源，没有 Origin 请求头的非浏览器客户端始终允许
+	Origins *origin.Policy
+	// ClientCerts API 校验客户端证书时为 true，没有证书的连接不能使用证书对应的 ID
+	ClientCerts bool
+	// Quarantine 保存被隔离的消息，为 nil 时在内存中保存最近的 DefaultQuarantineSize 条
+	Quarantine QuarantineSink
+	// Clock 用于 ping、握手超时、空闲检测、消息时间和过期时间，为 nil 时使用系统时间
+	Clock clock.Clock
+}
+
+// DefaultConfig 返回默认的配置，cap 的配置项和 chattest 都以它为默认值
+// Tracer、Origins 和 Clock 为 nil，没有审核插件
+func DefaultConfig() Config {
+	return Config{
+		Settings: Settings{
+			MessageRate:      5,
+			MessageBurst:     10,
+			MaxViolations:    10,
+			ViolationWindow:  time.Minute,
+			MaxMessageLength: 2000,
+			MaxNameLength:    64,
+			HandshakeTimeout: 100 * time.Millisecond,
+			PingInterval:     10 * time.Second,
+			WriteWait:        time.Second,
+			ResumeWindow:     30 * time.Second,
+		},
+		MaxFrameSize:         8192,
+		SendQueueSize:        64,
+		ResumeBuffer:         100,
+		Compression:          true,
+		CompressionLevel:     1,
+		CompressionThreshold: 512,
+	}
+}
+
+// Settings 可以在运行时修改的配置，修改后对已有的连接立即生效
+type Settings struct {
+	// MessageRate 每个用户每秒允许发送的消息数
+	MessageRate float64
+	// MessageBurst 每个用户允许的突发消息数
+	MessageBurst int
+	// MaxViolations ViolationWindow 内超过限流的次数达到该值后断开连接，为 0 时不断开
+	MaxViolations int
+	// ViolationWindow 统计超过限流次数的时间窗口
+	ViolationWindow time.Duration
+	// MaxMessageLength 消息文本的最大字符数
+	MaxMessageLength int
+	// MaxNameLength 用户名的最大字符数
+	MaxNameLength int
+	// MaxConnections 最大的在线连接数，达到后拒绝新的握手，为 0 时不限制
+	MaxConnections int
+	// Filters 消息投递前按顺序执行的审核插件
+	Filters []MessageFilter
+	// HandshakeTimeout 等待客户端发送身份的时间
+	HandshakeTimeout time.Duration
+	// PingInterval 发送 ping 和检查空闲连接的间隔
+	PingInterval time.Duration
+	// WriteWait 写入 ping 和关闭帧等控制帧的超时时间，这是网络超时，始终使用系统时间
+	WriteWait time.Duration
+	// IdleTimeout 超过这段时间没有发送消息的连接会被断开，为 0 时不检查
+	// 每次 ping 时检查，实际断开的时间最多晚 PingInterval
+	IdleTimeout time.Duration
+	// MessageTTL 消息在待发送队列中超过这段时间后丢弃，为 0 时不过期
+	MessageTTL time.Duration
+	// ResumeWindow 开启断线续传的会话意外断开后保留的时间，这段时间内发给用户的消息会在重新连接时补发
+	// 为 0 时不支持断线续传
+	ResumeWindow time.Duration
+}
+
 type User struct {
-	ID   uuid.UUID       `json:"id"`
-	Name string          `json:"name"`
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	// Conn websocket 会话的连接，Stream 会话为 nil
 	Conn *websocket.Conn `json:"-"`
+
+	// SessionID 每个连接唯一的会话 ID
+	SessionID   uuid.UUID `json:"-"`
+	ConnectedAt time.Time `json:"-"`
+	RemoteAddr  string    `json:"-"`
+	// CertSubject 使用 mTLS 时客户端证书的 subject，客户端不能在握手时设置
+	CertSubject string `json:"-"`
+
+	// enc 握手时协商的编码
+	enc *encoding
+	// conn 写入帧的连接，websocket 连接或者 Stream
+	conn transport
+
+	// lastActive 最后一次收到消息的时间，单位是纳秒，用于空闲检测
+	lastActive *atomic.Int64
+	// violations 超过限流的次数
+	violations *violations
+
+	// queue 待发送的帧，会话结束时关闭
+	queue *queue
+	// log 带有用户 ID 和会话 ID 的 logger
+	log *zap.SugaredLogger
+}
+
+// violations 会话在 ViolationWindow 内超过限流的次数，只在读取消息的 goroutine 中使用
+type violations struct {
+	count  int
+	window time.Time
+}
+
+// frame 待发送的 websocket 帧
+type frame struct {
+	messageType int
+	data        []byte
+	// sc 发送者路由消息时的追踪上下文，投递的 span 是它的子 span
+	sc tracer.SpanContext
+	// queuedAt 放入队列的时间，设置了 MessageTTL 时用于丢弃过期的消息
+	queuedAt time.Time
+}
+
+// Session 连接的信息，用于管理接口
+type Session struct {
+	SessionID     uuid.UUID `json:"sessionID"`
+	UserID        uuid.UUID `json:"userID"`
+	Name          string    `json:"name"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	LastActiveAt  time.Time `json:"lastActiveAt"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	CertSubject   string    `json:"certSubject,omitempty"`
+	Encoding      string    `json:"encoding"`
+	QueueDepth    int       `json:"queueDepth"`
+	QueueCapacity int       `json:"queueCapacity"`
 }
 
 type inMessage struct {
 	FromID uuid.UUID `json:"fromID"`
 	ToID   uuid.UUID `json:"toID"`
 	Msg    string    `json:"msg"`
+	// Traceparent 客户端可以携带 W3C Trace Context，路由消息的 span 会成为它的子 span
+	Traceparent string `json:"traceparent,omitempty"`
 }
 
 type outMessage struct {
 	From User   `json:"from"`
 	To   User   `json:"to"`
 	Msg  string `json:"msg"`
+	// At 服务端路由消息的时间
+	At time.Time `json:"at"`
+	// Muted 接收者对该会话开启了免打扰，客户端不需要提醒
+	Muted bool `json:"muted,omitempty"`
+	// Traceparent 路由消息的 span，接收者可以把自己的处理关联到发送者的 trace
+	Traceparent string `json:"traceparent,omitempty"`
+	// Seq 接收者开启断线续传时消息的序号，同一个续传 token 下递增
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// handshake 客户端握手时发送的身份，Resume 不为 nil 时请求断线续传
+type handshake struct {
+	ID     uuid.UUID      `json:"id"`
+	Name   string         `json:"name"`
+	Resume *resumeRequest `json:"resume,omitempty"`
+}
+
+// resumeRequest 客户端请求断线续传，第一次连接时 Token 为空
+type resumeRequest struct {
+	Token uuid.UUID `json:"token"`
+	// LastSeq 客户端最后收到的消息序号
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// resumeMessage 开启断线续传时紧跟在 WELCOME 之后发送，之后补发断开期间的消息
+type resumeMessage struct {
+	Resume resumeInfo `json:"resume"`
+}
+
+type resumeInfo struct {
+	// Token 重新连接时使用的续传 token
+	Token uuid.UUID `json:"token"`
+	// Resumed 恢复了之前的会话，为 false 时是新的会话，之前的消息不会补发
+	Resumed bool `json:"resumed"`
+	// Gap 缓冲区已经丢弃了一部分断开期间的消息
+	Gap bool `json:"gap,omitempty"`
+	// Window 断开后保留会话的秒数
+	Window int `json:"window"`
+}
+
+// errorMessage 发送给客户端的错误帧
+type errorMessage struct {
+	Error *errs.Error `json:"error"`
+}
+
+// systemMessage 发送给客户端的系统公告
+type systemMessage struct {
+	System string    `json:"system"`
+	At     time.Time `json:"at"`
 }
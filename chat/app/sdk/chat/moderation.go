@@ -0,0 +1,311 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Action 审核的处理结果
+type Action int
+
+const (
+	// Allow 放行消息
+	Allow Action = iota
+	// Modify 修改消息后放行，比如屏蔽敏感词
+	Modify
+	// Quarantine 隔离消息，不投递给接收者，等待人工审核
+	Quarantine
+	// Reject 拒绝消息，并告知发送者原因
+	Reject
+)
+
+// String 返回处理结果的名称，用于日志
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Modify:
+		return "modify"
+	case Quarantine:
+		return "quarantine"
+	case Reject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// ParseAction 把配置中的名称转换为 Action
+func ParseAction(name string) (Action, error) {
+	for _, a := range []Action{Allow, Modify, Quarantine, Reject} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return Allow, fmt.Errorf("unknown moderation action %q", name)
+}
+
+// Decision 单个过滤器的审核结果
+type Decision struct {
+	Action Action
+	// Msg 修改后的消息，只在 Modify 时使用
+	Msg string
+	// Reason 审核原因，会记录到日志中
+	Reason string
+}
+
+// FilterMessage 交给过滤器审核的消息
+type FilterMessage struct {
+	FromID uuid.UUID
+	ToID   uuid.UUID
+	Msg    string
+}
+
+// MessageFilter 消息审核插件，在消息投递前按顺序调用
+type MessageFilter interface {
+	Name() string
+	Filter(ctx context.Context, msg FilterMessage) Decision
+}
+
+// ModerationConfig 内置过滤器的配置
+type ModerationConfig struct {
+	// Words 需要屏蔽的词
+	Words []string
+	// RejectWords 为 true 时拒绝包含屏蔽词的消息，否则用 * 屏蔽
+	RejectWords bool
+	// Patterns 需要处理的正则表达式
+	Patterns []string
+	// PatternAction 匹配正则表达式时的处理结果：modify、quarantine 或者 reject
+	PatternAction string
+	// BlockLinks 为 true 时拒绝包含链接的消息
+	BlockLinks bool
+	// AllowedDomains 不会被拦截的链接域名
+	AllowedDomains []string
+}
+
+// NewFilters 根据配置按照 词表、正则、链接 的顺序创建内置过滤器
+func NewFilters(cfg ModerationConfig) ([]MessageFilter, error) {
+	var filters []MessageFilter
+
+	if len(cfg.Words) > 0 {
+		filters = append(filters, NewWordListFilter(cfg.Words, cfg.RejectWords))
+	}
+
+	if len(cfg.Patterns) > 0 {
+		action, err := ParseAction(cfg.PatternAction)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := NewRegexFilter(cfg.Patterns, action)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if cfg.BlockLinks {
+		filters = append(filters, NewLinkFilter(cfg.AllowedDomains))
+	}
+
+	return filters, nil
+}
+
+// =============================================================================
+
+// moderate 按顺序执行 filters
+// Modify 的结果会传递给下一个过滤器，Quarantine 和 Reject 会立即结束审核
+func (c *Chat) moderate(ctx context.Context, filters []MessageFilter, msg FilterMessage) (FilterMessage, Decision, string) {
+	final := Decision{Action: Allow}
+	var by string
+
+	for _, f := range filters {
+		d := f.Filter(ctx, msg)
+
+		switch d.Action {
+		case Allow:
+			continue
+
+		case Modify:
+			msg.Msg = d.Msg
+			final = d
+			by = f.Name()
+
+		case Quarantine, Reject:
+			return msg, d, f.Name()
+		}
+	}
+
+	return msg, final, by
+}
+
+// =============================================================================
+
+// WordListFilter 屏蔽词表中的词，匹配时不区分大小写
+type WordListFilter struct {
+	re     *regexp.Regexp
+	reject bool
+}
+
+// NewWordListFilter 创建词表过滤器，reject 为 true 时直接拒绝，否则用 * 屏蔽
+func NewWordListFilter(words []string, reject bool) *WordListFilter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+
+	f := WordListFilter{
+		reject: reject,
+	}
+	if len(quoted) > 0 {
+		f.re = regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+	}
+
+	return &f
+}
+
+// Name 实现 MessageFilter 接口
+func (f *WordListFilter) Name() string {
+	return "wordlist"
+}
+
+// Filter 实现 MessageFilter 接口
+func (f *WordListFilter) Filter(ctx context.Context, msg FilterMessage) Decision {
+	if f.re == nil {
+		return Decision{Action: Allow}
+	}
+
+	matched := f.re.FindAllString(msg.Msg, -1)
+	if len(matched) == 0 {
+		return Decision{Action: Allow}
+	}
+
+	reason := fmt.Sprintf("blocked words %q", matched)
+	if f.reject {
+		return Decision{Action: Reject, Reason: reason}
+	}
+
+	return Decision{Action: Modify, Msg: mask(f.re, msg.Msg), Reason: reason}
+}
+
+// mask 把 text 中所有匹配的部分替换为等长的 *
+func mask(re *regexp.Regexp, text string) string {
+	return re.ReplaceAllStringFunc(text, func(s string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(s))
+	})
+}
+
+// =============================================================================
+
+// RegexFilter 匹配正则表达式的消息会被隔离或者拒绝
+type RegexFilter struct {
+	patterns []*regexp.Regexp
+	action   Action
+}
+
+// NewRegexFilter 编译所有的正则表达式，action 为匹配时的处理结果
+func NewRegexFilter(patterns []string, action Action) (*RegexFilter, error) {
+	f := RegexFilter{
+		action: action,
+	}
+
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("compile pattern %q: %w", p, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	return &f, nil
+}
+
+// Name 实现 MessageFilter 接口
+func (f *RegexFilter) Name() string {
+	return "regex"
+}
+
+// Filter 实现 MessageFilter 接口
+func (f *RegexFilter) Filter(ctx context.Context, msg FilterMessage) Decision {
+	for _, re := range f.patterns {
+		if !re.MatchString(msg.Msg) {
+			continue
+		}
+
+		d := Decision{
+			Action: f.action,
+			Reason: fmt.Sprintf("matched pattern %q", re.String()),
+		}
+		if f.action == Modify {
+			d.Msg = mask(re, msg.Msg)
+		}
+
+		return d
+	}
+
+	return Decision{Action: Allow}
+}
+
+// =============================================================================
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|cn|co|me|info|xyz|app|dev)\b\S*`)
+
+// LinkFilter 拒绝包含链接的消息，allowed 中的域名可以放行
+type LinkFilter struct {
+	allowed []string
+}
+
+// NewLinkFilter 创建链接过滤器
+func NewLinkFilter(allowed []string) *LinkFilter {
+	lower := make([]string, 0, len(allowed))
+	for _, d := range allowed {
+		lower = append(lower, strings.ToLower(d))
+	}
+
+	return &LinkFilter{
+		allowed: lower,
+	}
+}
+
+// Name 实现 MessageFilter 接口
+func (f *LinkFilter) Name() string {
+	return "link"
+}
+
+// Filter 实现 MessageFilter 接口
+func (f *LinkFilter) Filter(ctx context.Context, msg FilterMessage) Decision {
+	for _, link := range linkPattern.FindAllString(msg.Msg, -1) {
+		if f.isAllowed(link) {
+			continue
+		}
+
+		return Decision{
+			Action: Reject,
+			Reason: fmt.Sprintf("link %q is not allowed", link),
+		}
+	}
+
+	return Decision{Action: Allow}
+}
+
+func (f *LinkFilter) isAllowed(link string) bool {
+	host := strings.ToLower(link)
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+		host = host[:i]
+	}
+
+	for _, d := range f.allowed {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
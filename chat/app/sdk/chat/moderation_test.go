@@ -0,0 +1,163 @@
+package chat_test
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"strings"
+	"testing"
+	"time"
+)
+
+// moderated 启动使用 mc 审核消息的测试服务
+func moderated(t *testing.T, mc chat.ModerationConfig) *chattest.Server {
+	t.Helper()
+
+	filters, err := chat.NewFilters(mc)
+	if err != nil {
+		t.Fatalf("NewFilters: %v", err)
+	}
+
+	return chattest.New(t, chattest.Config{
+		Chat: func(cfg *chat.Config) {
+			cfg.Filters = filters
+		},
+	})
+}
+
+func TestModerationReject(t *testing.T) {
+	srv := moderated(t, chat.ModerationConfig{
+		Words:       []string{"secretword"},
+		RejectWords: true,
+	})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	alice.Send(bob.ID, "say SecretWord")
+	e := alice.ExpectError("invalid_argument")
+	if e.Reason != "moderation_rejected" {
+		t.Errorf("reason: got %q, want %q", e.Reason, "moderation_rejected")
+	}
+
+	// 错误中不能包含命中的词
+	if strings.Contains(strings.ToLower(e.Message), "secretword") {
+		t.Errorf("rejection leaks the matched word: %q", e.Message)
+	}
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	alice.Send(bob.ID, "hello")
+	bob.ExpectMessage(alice.ID, "hello")
+}
+
+func TestModerationQuarantine(t *testing.T) {
+	srv := moderated(t, chat.ModerationConfig{
+		Patterns:      []string{`\d{4}-\d{4}`},
+		PatternAction: "quarantine",
+	})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	// 发送者不会知道消息被隔离
+	alice.Send(bob.ID, "call 1234-5678")
+	alice.Send(bob.ID, "card 8765-4321")
+	alice.ExpectNothing(50 * time.Millisecond)
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	ctx := context.Background()
+	items, err := srv.Chat.Quarantined(ctx)
+	if err != nil {
+		t.Fatalf("Quarantined: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("quarantined messages: got %d, want 2", len(items))
+	}
+
+	m := items[0]
+	if m.FromID != alice.ID || m.FromName != "alice" || m.ToID != bob.ID || m.Msg != "call 1234-5678" || m.Filter != "regex" {
+		t.Errorf("got quarantined message %+v", m)
+	}
+
+	// 放行的消息不再经过审核
+	if err := srv.Chat.ReleaseQuarantined(ctx, m.ID); err != nil {
+		t.Fatalf("ReleaseQuarantined: %v", err)
+	}
+	bob.ExpectMessage(alice.ID, "call 1234-5678")
+
+	if err := srv.Chat.DiscardQuarantined(ctx, items[1].ID); err != nil {
+		t.Fatalf("DiscardQuarantined: %v", err)
+	}
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	if items, _ := srv.Chat.Quarantined(ctx); len(items) != 0 {
+		t.Errorf("quarantined messages after review: got %d, want 0", len(items))
+	}
+
+	var appErr *errs.Error
+	if err := srv.Chat.DiscardQuarantined(ctx, m.ID); !errors.As(err, &appErr) || appErr.Code != errs.NotFound {
+		t.Errorf("discard a reviewed message: got %v, want not_found", err)
+	}
+}
+
+func TestModerationReleaseOffline(t *testing.T) {
+	srv := moderated(t, chat.ModerationConfig{
+		Patterns:      []string{`forbidden`},
+		PatternAction: "quarantine",
+	})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	alice.Send(bob.ID, "forbidden")
+	bob.Close()
+	srv.AssertOffline(t, bob.ID)
+
+	ctx := context.Background()
+	srv.Eventually(t, func() bool {
+		items, _ := srv.Chat.Quarantined(ctx)
+		return len(items) == 1
+	}, "message was not quarantined")
+
+	// 接收者不在线时消息继续保留
+	items, _ := srv.Chat.Quarantined(ctx)
+	if err := srv.Chat.ReleaseQuarantined(ctx, items[0].ID); err == nil {
+		t.Fatalf("release to an offline user: got nil error")
+	}
+	if items, _ := srv.Chat.Quarantined(ctx); len(items) != 1 {
+		t.Fatalf("quarantined messages after a failed release: got %d, want 1", len(items))
+	}
+
+	bob = srv.Dial(t, nil)
+	bob.Handshake(items[0].ToID, "bob")
+	if err := srv.Chat.ReleaseQuarantined(ctx, items[0].ID); err != nil {
+		t.Fatalf("ReleaseQuarantined: %v", err)
+	}
+	bob.ExpectMessage(alice.ID, "forbidden")
+}
+
+func TestMemoryQuarantineSize(t *testing.T) {
+	ctx := context.Background()
+	q := chat.NewMemoryQuarantine(2)
+
+	var ids []uuid.UUID
+	for i := range 3 {
+		id := uuid.New()
+		ids = append(ids, id)
+		q.Put(ctx, chat.QuarantinedMessage{ID: id, At: time.Unix(int64(i), 0)})
+	}
+
+	items, err := q.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(items) != 2 || items[0].ID != ids[1] || items[1].ID != ids[2] {
+		t.Errorf("got %v, want the 2 newest messages", items)
+	}
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultQuarantineSize Config.Quarantine 为 nil 时内存中保存的隔离消息数
+const DefaultQuarantineSize = 1000
+
+// QuarantinedMessage 被隔离等待人工审核的消息
+type QuarantinedMessage struct {
+	ID       uuid.UUID `json:"id"`
+	FromID   uuid.UUID `json:"fromID"`
+	FromName string    `json:"fromName"`
+	ToID     uuid.UUID `json:"toID"`
+	Msg      string    `json:"msg"`
+	// Filter 和 Reason 隔离消息的过滤器和原因
+	Filter string    `json:"filter"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// QuarantineSink 保存被隔离的消息，管理员审核后放行或者丢弃
+type QuarantineSink interface {
+	Put(ctx context.Context, m QuarantinedMessage) error
+	// List 按隔离的时间返回所有的消息
+	List(ctx context.Context) ([]QuarantinedMessage, error)
+	// Take 取出并删除消息，不存在时返回 errs.NotFound
+	Take(ctx context.Context, id uuid.UUID) (QuarantinedMessage, error)
+}
+
+// MemoryQuarantine 在内存中保存最近的隔离消息，超过容量时丢弃最旧的，重启后丢失
+type MemoryQuarantine struct {
+	mu    sync.Mutex
+	size  int
+	items []QuarantinedMessage
+}
+
+// NewMemoryQuarantine 创建最多保存 size 条消息的 MemoryQuarantine
+func NewMemoryQuarantine(size int) *MemoryQuarantine {
+	return &MemoryQuarantine{
+		size: size,
+	}
+}
+
+// Put 实现 QuarantineSink 接口
+func (q *MemoryQuarantine) Put(ctx context.Context, m QuarantinedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, m)
+	if over := len(q.items) - q.size; over > 0 {
+		q.items = append([]QuarantinedMessage(nil), q.items[over:]...)
+	}
+
+	return nil
+}
+
+// List 实现 QuarantineSink 接口
+func (q *MemoryQuarantine) List(ctx context.Context) ([]QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// 放行失败的消息会重新放回队尾
+	items := append([]QuarantinedMessage(nil), q.items...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].At.Before(items[j].At)
+	})
+
+	return items, nil
+}
+
+// Take 实现 QuarantineSink 接口
+func (q *MemoryQuarantine) Take(ctx context.Context, id uuid.UUID) (QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, m := range q.items {
+		if m.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return m, nil
+		}
+	}
+
+	return QuarantinedMessage{}, errs.Newf(errs.NotFound, "quarantined message %s not found", id)
+}
@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"sync"
+)
+
+// queue 会话的待发送队列，由 writeLoop 写入连接，gorilla/websocket 同一时间只允许一个写入者
+// 放入队列和关闭队列持有同一个锁，队列深度的指标在锁内修改，关闭后不会再有帧放入，指标不会漂移
+type queue struct {
+	mu     sync.Mutex
+	closed bool
+	ch     chan frame
+	// done 会话结束时关闭
+	done chan struct{}
+}
+
+func newQueue(size int) *queue {
+	return &queue{
+		ch:   make(chan frame, size),
+		done: make(chan struct{}),
+	}
+}
+
+// push 把帧放入队列，队列满时直接返回错误，避免慢速客户端阻塞发送者
+func (q *queue) push(f frame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errSessionClosed
+	}
+
+	// 先增加指标再放入队列，writeLoop 取出后减少指标时不会出现负数
+	metrics.AddQueueDepth(1)
+	select {
+	case q.ch <- f:
+		return nil
+	default:
+		metrics.AddQueueDepth(-1)
+		return errQueueFull
+	}
+}
+
+// popped writeLoop 从 ch 取出一个帧之后调用
+func (q *queue) popped() {
+	metrics.AddQueueDepth(-1)
+}
+
+// close 关闭队列并丢弃剩余的帧，重复调用没有影响
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.done)
+
+	// writeLoop 可能同时取出帧，每个帧只会被取出一次
+	for {
+		select {
+		case <-q.ch:
+			metrics.AddQueueDepth(-1)
+		default:
+			return
+		}
+	}
+}
+
+// len 返回队列中的帧数
+func (q *queue) len() int {
+	return len(q.ch)
+}
+
+// cap 返回队列的容量
+func (q *queue) cap() int {
+	return cap(q.ch)
+}
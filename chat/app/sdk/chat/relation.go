@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"sort"
+)
+
+// relations 保存用户的屏蔽列表和免打扰列表
+type relations map[uuid.UUID]map[uuid.UUID]struct{}
+
+func (r relations) add(userID uuid.UUID, targetID uuid.UUID) {
+	m, exists := r[userID]
+	if !exists {
+		m = make(map[uuid.UUID]struct{})
+		r[userID] = m
+	}
+	m[targetID] = struct{}{}
+}
+
+func (r relations) remove(userID uuid.UUID, targetID uuid.UUID) {
+	m, exists := r[userID]
+	if !exists {
+		return
+	}
+	delete(m, targetID)
+	if len(m) == 0 {
+		delete(r, userID)
+	}
+}
+
+func (r relations) has(userID uuid.UUID, targetID uuid.UUID) bool {
+	_, exists := r[userID][targetID]
+	return exists
+}
+
+func (r relations) list(userID uuid.UUID) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(r[userID]))
+	for id := range r[userID] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids
+}
+
+// =============================================================================
+
+// Block 屏蔽用户，被屏蔽的用户发送的消息不会投递给 userID
+func (c *Chat) Block(ctx context.Context, userID uuid.UUID, targetID uuid.UUID) {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+
+	c.blocks.add(userID, targetID)
+	logger.ForComponent(ctx, logComponent).Infow("block user", "user", userID, "target", targetID)
+}
+
+// Unblock 取消屏蔽用户
+func (c *Chat) Unblock(ctx context.Context, userID uuid.UUID, targetID uuid.UUID) {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+
+	c.blocks.remove(userID, targetID)
+	logger.ForComponent(ctx, logComponent).Infow("unblock user", "user", userID, "target", targetID)
+}
+
+// Blocked 返回 userID 屏蔽的所有用户
+func (c *Chat) Blocked(userID uuid.UUID) []uuid.UUID {
+	c.relMu.RLock()
+	defer c.relMu.RUnlock()
+
+	return c.blocks.list(userID)
+}
+
+// Mute 对和 targetID 的会话开启免打扰，消息仍然会投递，只是客户端不再提醒
+func (c *Chat) Mute(ctx context.Context, userID uuid.UUID, targetID uuid.UUID) {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+
+	c.mutes.add(userID, targetID)
+	logger.ForComponent(ctx, logComponent).Infow("mute conversation", "user", userID, "target", targetID)
+}
+
+// Unmute 关闭和 targetID 的会话的免打扰
+func (c *Chat) Unmute(ctx context.Context, userID uuid.UUID, targetID uuid.UUID) {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+
+	c.mutes.remove(userID, targetID)
+	logger.ForComponent(ctx, logComponent).Infow("unmute conversation", "user", userID, "target", targetID)
+}
+
+// Muted 返回 userID 开启免打扰的所有会话
+func (c *Chat) Muted(userID uuid.UUID) []uuid.UUID {
+	c.relMu.RLock()
+	defer c.relMu.RUnlock()
+
+	return c.mutes.list(userID)
+}
+
+// isBlocked 判断 userID 是否屏蔽了 targetID
+func (c *Chat) isBlocked(userID uuid.UUID, targetID uuid.UUID) bool {
+	c.relMu.RLock()
+	defer c.relMu.RUnlock()
+
+	return c.blocks.has(userID, targetID)
+}
+
+// isMuted 判断 userID 是否对和 targetID 的会话开启了免打扰
+func (c *Chat) isMuted(userID uuid.UUID, targetID uuid.UUID) bool {
+	c.relMu.RLock()
+	defer c.relMu.RUnlock()
+
+	return c.mutes.has(userID, targetID)
+}
@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"github.com/google/uuid"
+	"sort"
+	"time"
+)
+
+// roomNamespace 由两个成员的 ID 生成房间 ID 的命名空间
+var roomNamespace = uuid.MustParse("6f1c1b52-4a8e-4f43-9d36-2a7c5f0e8b11")
+
+// Room 两个用户之间的会话，第一次投递消息时创建，两个成员都离线后删除
+type Room struct {
+	// ID 由两个成员的 ID 生成，同样的两个用户总是同一个 ID
+	ID            uuid.UUID    `json:"id"`
+	Members       []RoomMember `json:"members"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	LastMessageAt time.Time    `json:"lastMessageAt"`
+}
+
+// RoomMember 房间的成员
+type RoomMember struct {
+	ID     uuid.UUID `json:"id"`
+	Name   string    `json:"name"`
+	Online bool      `json:"online"`
+}
+
+// room 注册表中的房间，成员按 ID 排序
+type room struct {
+	id            uuid.UUID
+	members       [2]User
+	createdAt     time.Time
+	lastMessageAt time.Time
+}
+
+// RoomID 返回两个用户之间的房间 ID
+func RoomID(a uuid.UUID, b uuid.UUID) uuid.UUID {
+	if b.String() < a.String() {
+		a, b = b, a
+	}
+	return uuid.NewSHA1(roomNamespace, append(a[:], b[:]...))
+}
+
+// touchRoom 记录一条从 from 投递到 to 的消息，房间不存在时创建
+// 调用方需要持有 c.mu 的读锁或者写锁
+func (c *Chat) touchRoom(from User, to User, at time.Time) {
+	id := RoomID(from.ID, to.ID)
+
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	r, exists := c.rooms[id]
+	if !exists {
+		r = &room{
+			id:        id,
+			members:   [2]User{{ID: from.ID, Name: from.Name}, {ID: to.ID, Name: to.Name}},
+			createdAt: at,
+		}
+		if r.members[1].ID.String() < r.members[0].ID.String() {
+			r.members[0], r.members[1] = r.members[1], r.members[0]
+		}
+		c.rooms[id] = r
+	}
+
+	// 用户名可能在重新连接后改变
+	for i, m := range r.members {
+		switch m.ID {
+		case from.ID:
+			r.members[i].Name = from.Name
+		case to.ID:
+			r.members[i].Name = to.Name
+		}
+	}
+	r.lastMessageAt = at
+}
+
+// pruneRooms 删除 userID 所在的、两个成员都已经离线的房间，调用方需要持有 c.mu 的写锁
+func (c *Chat) pruneRooms(userID uuid.UUID) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	for id, r := range c.rooms {
+		if r.members[0].ID != userID && r.members[1].ID != userID {
+			continue
+		}
+
+		_, online0 := c.users[r.members[0].ID]
+		_, online1 := c.users[r.members[1].ID]
+		if !online0 && !online1 {
+			delete(c.rooms, id)
+		}
+	}
+}
+
+// Rooms 返回 userID 所在的房间，userID 为 uuid.Nil 时返回所有的房间，按最后一条消息的时间倒序
+func (c *Chat) Rooms(userID uuid.UUID) []Room {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	rooms := make([]Room, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		if userID != uuid.Nil && r.members[0].ID != userID && r.members[1].ID != userID {
+			continue
+		}
+
+		room := Room{
+			ID:            r.id,
+			Members:       make([]RoomMember, 0, len(r.members)),
+			CreatedAt:     r.createdAt,
+			LastMessageAt: r.lastMessageAt,
+		}
+		for _, m := range r.members {
+			_, online := c.users[m.ID]
+			room.Members = append(room.Members, RoomMember{ID: m.ID, Name: m.Name, Online: online})
+		}
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		if !rooms[i].LastMessageAt.Equal(rooms[j].LastMessageAt) {
+			return rooms[i].LastMessageAt.After(rooms[j].LastMessageAt)
+		}
+		return rooms[i].ID.String() < rooms[j].ID.String()
+	})
+
+	return rooms
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"sync/atomic"
+	"time"
+)
+
+// Stream 由其他协议实现的会话连接，比如 gRPC 的双向流
+// Chat 像管理 websocket 连接一样管理它：同一个注册表、限流、审核、踢下线和空闲检测
+// 发给会话的帧使用与 websocket 相同的 JSON 编码，比如 {"from","to","msg","at"} 和 {"error":{...}}
+type Stream interface {
+	// Welcome 会话加入注册表后、发送任何帧之前调用一次，对应 websocket 的 WELCOME
+	Welcome(s Session) error
+	// Send 发送一个 JSON 帧，只在会话的写 goroutine 中调用
+	Send(data []byte) error
+	// Close 结束会话，服务端断开时 reason 是断开的原因，比如被踢下线，其他情况为空
+	// 可能被调用多次，可能与 Send 并发调用
+	Close(reason string)
+}
+
+// transport 会话的连接，websocket 连接或者 Stream
+type transport interface {
+	// write 写入一个帧，只在 writeLoop 中调用
+	write(f frame) error
+	// ping 发送心跳
+	ping(deadline time.Time) error
+	// closeWith 告诉客户端断开的原因，之后由 close 关闭连接
+	closeWith(code int, reason string, deadline time.Time) error
+	// close 关闭连接
+	close() error
+}
+
+// wsTransport websocket 连接
+type wsTransport struct {
+	conn *websocket.Conn
+	// compression 大于等于 threshold 字节的帧压缩，没有开启压缩时为 false
+	compression bool
+	threshold   int
+}
+
+func (t wsTransport) write(f frame) error {
+	// 没有协商压缩时 gorilla/websocket 会忽略这个设置
+	if t.compression {
+		t.conn.EnableWriteCompression(len(f.data) >= t.threshold)
+	}
+
+	return t.conn.WriteMessage(f.messageType, f.data)
+}
+
+func (t wsTransport) ping(deadline time.Time) error {
+	return t.conn.WriteControl(websocket.PingMessage, []byte("ping"), deadline)
+}
+
+func (t wsTransport) closeWith(code int, reason string, deadline time.Time) error {
+	return t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
+
+func (t wsTransport) close() error {
+	return t.conn.Close()
+}
+
+// streamTransport Stream 会话，心跳由 Stream 的协议自己处理
+type streamTransport struct {
+	s Stream
+}
+
+func (t streamTransport) write(f frame) error {
+	return t.s.Send(f.data)
+}
+
+func (t streamTransport) ping(deadline time.Time) error {
+	return nil
+}
+
+func (t streamTransport) closeWith(code int, reason string, deadline time.Time) error {
+	t.s.Close(reason)
+	return nil
+}
+
+func (t streamTransport) close() error {
+	t.s.Close("")
+	return nil
+}
+
+// =============================================================================
+
+// Join 把 s 作为用户 id 的会话加入注册表，与 websocket 握手一样校验用户，返回的 User 用于 Receive 和 Leave
+// 身份与握手相同：state 中校验通过的客户端证书优先，其次是 ctx 中的 token，id 为 uuid.Nil 时使用它们的 ID
+// 用户已经在线时返回 errs.AlreadyExists，连接数达到上限时返回 errs.ResourceExhausted，Stream 会话不支持断线续传
+func (c *Chat) Join(ctx context.Context, state *tls.ConnectionState, id uuid.UUID, name string, remoteAddr string, s Stream) (usr User, err error) {
+	ctx, span := c.cfg.Tracer.Start(ctx, "chat.join")
+	defer func() {
+		span.SetAttributes("chat.user", usr.ID.String(), "chat.session", usr.SessionID.String())
+		span.SetError(err)
+		span.End()
+	}()
+
+	now := c.cfg.Clock.Now()
+	usr = User{
+		ID:          id,
+		Name:        name,
+		SessionID:   uuid.New(),
+		ConnectedAt: now,
+		RemoteAddr:  remoteAddr,
+		enc:         &jsonEncoding,
+		conn:        streamTransport{s: s},
+		lastActive:  new(atomic.Int64),
+		violations:  new(violations),
+		queue:       newQueue(c.cfg.SendQueueSize),
+	}
+	usr.lastActive.Store(now.UnixNano())
+
+	if err := authenticate(ctx, &usr, state); err != nil {
+		return User{}, err
+	}
+
+	usr.log = logger.ForComponent(ctx, logComponent).With("user", usr.ID, "session", usr.SessionID)
+	ctx = logger.NewContext(ctx, usr.log)
+
+	if err := c.validateUser(usr); err != nil {
+		return User{}, err
+	}
+	if err := c.checkCertless(usr); err != nil {
+		return User{}, err
+	}
+
+	c.evictCertless(ctx, usr)
+	if _, err := c.addUser(ctx, usr, nil); err != nil {
+		if errors.Is(err, ErrTooManyConnections) {
+			return User{}, errs.Newf(errs.ResourceExhausted, "too many connections")
+		}
+		return User{}, errs.Newf(errs.AlreadyExists, "already connected")
+	}
+
+	// 与 WELCOME 一样，Welcome 之前 writeLoop 还没有启动，保证它是第一帧
+	if err := s.Welcome(usr.session()); err != nil {
+		c.removeUser(ctx, usr)
+		return User{}, fmt.Errorf("welcome: %w", err)
+	}
+
+	go c.writeLoop(ctx, usr)
+
+	usr.log.Infow("join completed", "User", usr)
+
+	return usr, nil
+}
+
+// Receive 处理 Stream 会话中用户发送的一条消息，与 websocket 的消息一样限流、校验和审核，错误作为错误帧发送给会话
+// 返回 false 时会话已经因为多次超过限流被断开
+func (c *Chat) Receive(ctx context.Context, usr User, toID uuid.UUID, msg string, traceparent string) bool {
+	ctx = logger.NewContext(ctx, usr.log)
+
+	ok, admitted := c.admit(ctx, usr)
+	if !admitted {
+		return ok
+	}
+
+	c.routeMessage(ctx, usr, inMessage{FromID: usr.ID, ToID: toID, Msg: msg, Traceparent: traceparent})
+	return true
+}
+
+// Leave 结束 Stream 会话，比如客户端关闭了流，之后发给用户的消息返回 errs.FailedPrecondition
+func (c *Chat) Leave(ctx context.Context, usr User) {
+	c.removeUser(ctx, usr)
+	c.dropMailbox(usr.ID)
+}
+
+// Send 以在线用户 fromID 的身份发送一条消息，不需要属于某个会话，比如内部服务的一元调用
+// 调用方必须有 state 中校验通过的客户端证书或者 ctx 中的 token，fromID 为 uuid.Nil 时使用它们的 ID
+// 没有身份时返回 errs.Unauthenticated，fromID 与身份不一致时返回 errs.PermissionDenied
+// 与会话中发送的消息一样限流、校验和审核，返回路由消息的时间，校验和投递失败时返回 *errs.Error
+// 超过限流时返回 errs.TooManyRequests，不会断开发送者的会话
+func (c *Chat) Send(ctx context.Context, state *tls.ConnectionState, fromID uuid.UUID, toID uuid.UUID, msg string, traceparent string) (time.Time, error) {
+	sender := User{ID: fromID}
+	if err := authenticate(ctx, &sender, state); err != nil {
+		return time.Time{}, err
+	}
+	if _, ok := tokenIdentity(ctx); !ok && sender.CertSubject == "" {
+		return time.Time{}, errs.Newf(errs.Unauthenticated, "client certificate or token required")
+	}
+	if err := c.checkCertless(sender); err != nil {
+		return time.Time{}, err
+	}
+	fromID = sender.ID
+
+	usr, exists := c.lookup(fromID)
+	if !exists {
+		return time.Time{}, errs.Newf(errs.FailedPrecondition, "sender is not connected")
+	}
+
+	now := c.cfg.Clock.Now()
+	if !c.limiter.AllowAt(usr.ID.String(), now) {
+		metrics.AddMessageDropped(metrics.DropRateLimited)
+		return time.Time{}, errs.Newf(errs.TooManyRequests, "rate limit exceeded, message dropped").
+			WithReason("rate_limited").
+			WithRetryAfter(c.limiter.RetryAfterAt(usr.ID.String(), now))
+	}
+
+	if err := c.route(ctx, usr, inMessage{FromID: fromID, ToID: toID, Msg: msg, Traceparent: traceparent}); err != nil {
+		return time.Time{}, err
+	}
+
+	return now.UTC(), nil
+}
@@ -0,0 +1,99 @@
+package chat_test
+
+import (
+	"context"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"github.com/zhangpetergo/chat/chat/client"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"sync"
+	"testing"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []tracer.SpanData
+}
+
+func (e *memoryExporter) Export(service string, spans []tracer.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// find 返回名字为 name 的 span
+func (e *memoryExporter) find(t *testing.T, tr *tracer.Tracer, name string) []tracer.SpanData {
+	t.Helper()
+
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var spans []tracer.SpanData
+	for _, s := range e.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTraceDeliverIsChildOfRoute(t *testing.T) {
+	var exp memoryExporter
+	tr := tracer.New(tracer.Config{Probability: 1, Exporter: &exp})
+	t.Cleanup(func() {
+		tr.Shutdown(context.Background())
+	})
+
+	srv := chattest.New(t, chattest.Config{
+		Chat: func(cfg *chat.Config) {
+			cfg.Tracer = tr
+		},
+	})
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertOnline(t, alice.ID, bob.ID)
+
+	// 客户端携带 traceparent 时路由的 span 是它的子 span
+	parent, err := tracer.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	alice.SendJSON(client.InMessage{FromID: alice.ID, ToID: bob.ID, Msg: "hi", Traceparent: parent.Traceparent()})
+	m := bob.ExpectMessage(alice.ID, "hi")
+
+	var deliver []tracer.SpanData
+	srv.Eventually(t, func() bool {
+		deliver = exp.find(t, tr, "chat.deliver")
+		return len(deliver) == 1
+	}, "deliver span exported")
+
+	routes := exp.find(t, tr, "chat.route")
+	if len(routes) != 1 {
+		t.Fatalf("got %d route spans, want 1", len(routes))
+	}
+	route, d := routes[0], deliver[0]
+
+	if route.Context.TraceID != parent.TraceID || route.Parent != parent.SpanID || route.Kind != tracer.KindProducer {
+		t.Errorf("route: got trace %s parent %s kind %d, want the client's span as parent", route.Context.TraceID, route.Parent, route.Kind)
+	}
+	if d.Context.TraceID != route.Context.TraceID || d.Parent != route.Context.SpanID || d.Kind != tracer.KindConsumer {
+		t.Errorf("deliver: got trace %s parent %s kind %d, want a child of route %s", d.Context.TraceID, d.Parent, d.Kind, route.Context.SpanID)
+	}
+
+	// 接收者收到的 traceparent 是路由的 span
+	if m.Traceparent != route.Context.Traceparent() {
+		t.Errorf("message traceparent: got %q, want %q", m.Traceparent, route.Context.Traceparent())
+	}
+
+	// 投递关联接收者连接的 span，它在另一个 trace 中
+	if len(d.Links) != 1 || d.Links[0].TraceID == route.Context.TraceID {
+		t.Errorf("deliver links: got %v, want bob's connection span", d.Links)
+	}
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"unicode/utf8"
+)
+
+// validateUser 校验握手时客户端发送的用户信息
+func (c *Chat) validateUser(usr User) error {
+	if usr.ID == uuid.Nil {
+		return errs.Newf(errs.InvalidArgument, "id is required").WithField("id", "is required")
+	}
+
+	if !utf8.ValidString(usr.Name) {
+		return errs.Newf(errs.InvalidArgument, "name is not valid utf-8").WithField("name", "is not valid utf-8")
+	}
+
+	if max := c.settings().MaxNameLength; usr.Name == "" || utf8.RuneCountInString(usr.Name) > max {
+		return errs.Newf(errs.InvalidArgument, "name must be between 1 and %d characters", max).
+			WithField("name", "must be between 1 and %d characters", max)
+	}
+
+	return nil
+}
+
+// validateMessage 校验客户端发送的消息，发送者必须是当前连接的用户
+func (c *Chat) validateMessage(usr User, msg inMessage) error {
+	if msg.FromID != usr.ID {
+		return errs.Newf(errs.PermissionDenied, "fromID does not match the connected user").WithField("fromID", "does not match the connected user")
+	}
+
+	if msg.ToID == uuid.Nil {
+		return errs.Newf(errs.InvalidArgument, "toID is required").WithField("toID", "is required")
+	}
+
+	if !utf8.ValidString(msg.Msg) {
+		return errs.Newf(errs.InvalidArgument, "msg is not valid utf-8").WithField("msg", "is not valid utf-8")
+	}
+
+	if max := c.settings().MaxMessageLength; msg.Msg == "" || utf8.RuneCountInString(msg.Msg) > max {
+		return errs.Newf(errs.InvalidArgument, "msg must be between 1 and %d characters", max).
+			WithField("msg", "must be between 1 and %d characters", max)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package chattest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/google/uuid"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// certAuthority 签发客户端证书的测试 CA
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newCertAuthority() (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chattest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &certAuthority{cert: cert, key: key, pool: pool}, nil
+}
+
+// ClientCert 签发 CommonName 为 name 的客户端证书，id 不为 uuid.Nil 时写入 urn:uuid:<id> 格式的 URI SAN
+// 服务没有设置 Config.ClientCerts 时测试失败
+func (s *Server) ClientCert(t testing.TB, name string, id uuid.UUID) tls.Certificate {
+	t.Helper()
+
+	if s.ca == nil {
+		t.Fatal("chattest: client certificates require Config.ClientCerts")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("chattest: generate key: %v", err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if id != uuid.Nil {
+		tmpl.URIs = []*url.URL{{Scheme: "urn", Opaque: "uuid:" + id.String()}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, s.ca.cert, &key.PublicKey, s.ca.key)
+	if err != nil {
+		t.Fatalf("chattest: create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("chattest: parse certificate: %v", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
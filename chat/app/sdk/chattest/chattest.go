@@ -0,0 +1,286 @@
+// Package chattest 在进程内启动完整的 WebAPI，用于测试聊天协议
+//
+// 使用方式：
+//
+//	func TestSend(t *testing.T) {
+//		srv := chattest.New(t, chattest.Config{})
+//
+//		alice := srv.Connect(t, "alice")
+//		bob := srv.Connect(t, "bob")
+//		srv.AssertOnline(t, alice.ID, bob.ID)
+//
+//		alice.Send(bob.ID, "hi")
+//		bob.ExpectMessage(alice.ID, "hi")
+//
+//		alice.Send(uuid.New(), "hi")
+//		alice.ExpectError("failed_precondition")
+//	}
+//
+// 默认使用 clock.Fake，ping、握手超时、空闲检测和消息过期只有在调用 Advance 时才会发生
+package chattest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mux"
+	"github.com/zhangpetergo/chat/chat/foundation/clock"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Config 测试服务的配置，零值字段使用默认值
+type Config struct {
+	// Log 为 nil 时不输出日志，可以传入 zaptest.NewLogger(t).Sugar() 把日志输出到测试中
+	Log *zap.SugaredLogger
+	// Clock 为 nil 时使用从当前时间开始的 clock.Fake
+	Clock clock.Clock
+	// Chat 不为 nil 时用来修改聊天服务的配置，修改之前是 chat.DefaultConfig
+	// 消息限流默认放宽到每秒 1000 条，握手超时默认放宽到 1s，避免测试机器较慢时握手失败
+	// Clock 字段在修改之后会被覆盖
+	Chat func(cfg *chat.Config)
+	// ClientCerts 为 true 时使用 HTTPS，由测试 CA 签发的客户端证书是可选的 (tls.VerifyClientCertIfGiven)
+	// chat.Config.ClientCerts 也会被设置为 true，使用 Server.ClientCert 签发证书，Server.DialCert 使用证书连接
+	ClientCerts bool
+	// HTTPRate 和 HTTPBurst 为 0 时不会触发 HTTP 限流
+	HTTPRate  float64
+	HTTPBurst int
+	// Timeout Expect 系列方法和注册表断言的等待时间，默认 2s
+	Timeout time.Duration
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Log == nil {
+		cfg.Log = zap.NewNop().Sugar()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewFake(time.Now())
+	}
+	if cfg.HTTPRate == 0 {
+		cfg.HTTPRate = 1e6
+	}
+	if cfg.HTTPBurst == 0 {
+		cfg.HTTPBurst = 1e6
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	return cfg
+}
+
+// chatConfig 返回聊天服务的配置
+func (cfg Config) chatConfig() chat.Config {
+	c := chat.DefaultConfig()
+	c.MessageRate = 1000
+	c.MessageBurst = 1000
+	c.HandshakeTimeout = time.Second
+
+	if cfg.Chat != nil {
+		cfg.Chat(&c)
+	}
+	c.Clock = cfg.Clock
+	c.ClientCerts = cfg.ClientCerts
+
+	return c
+}
+
+// Server 运行在 httptest.Server 上的聊天服务，测试结束时自动关闭
+type Server struct {
+	// URL websocket 连接地址，比如 ws://127.0.0.1:12345/connect
+	URL   string
+	HTTP  *httptest.Server
+	Chat  *chat.Chat
+	Clock clock.Clock
+	// Auth 使用 Clock 的时间签发和校验 token，token 的有效期是 1h
+	Auth *auth.Authenticator
+
+	// ShuttingDown 设置为 true 后就绪检查失败，新的 websocket 连接被拒绝
+	ShuttingDown *atomic.Bool
+
+	timeout time.Duration
+	// ca 和 dialer 在 Config.ClientCerts 为 true 时用于签发客户端证书和信任服务端的证书
+	ca     *certAuthority
+	dialer websocket.Dialer
+}
+
+// New 启动测试服务，测试结束时关闭服务并停止 ping
+func New(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	cfg = cfg.withDefaults()
+
+	cht := chat.NewChat(cfg.Log, cfg.chatConfig())
+
+	authenticator := auth.New(auth.Config{
+		Secret: "chattest",
+		TTL:    time.Hour,
+		Clock:  cfg.Clock,
+	})
+
+	var shuttingDown atomic.Bool
+
+	srv := httptest.NewUnstartedServer(mux.WebAPI(mux.Config{
+		Log:          cfg.Log,
+		HTTPLimiter:  rate.NewKeyed(cfg.HTTPRate, cfg.HTTPBurst),
+		Build:        "test",
+		Chat:         cht,
+		ShuttingDown: &shuttingDown,
+		Auth:         authenticator,
+	}))
+
+	t.Cleanup(func() {
+		srv.Close()
+		cht.Stop()
+	})
+
+	s := Server{
+		HTTP:         srv,
+		Chat:         cht,
+		Clock:        cfg.Clock,
+		Auth:         authenticator,
+		ShuttingDown: &shuttingDown,
+		timeout:      cfg.Timeout,
+		dialer:       *websocket.DefaultDialer,
+	}
+
+	if !cfg.ClientCerts {
+		srv.Start()
+		s.URL = "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect"
+		return &s
+	}
+
+	ca, err := newCertAuthority()
+	if err != nil {
+		t.Fatalf("chattest: create certificate authority: %v", err)
+	}
+	s.ca = ca
+
+	srv.TLS = &tls.Config{
+		ClientCAs:  ca.pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+
+	s.URL = "wss" + strings.TrimPrefix(srv.URL, "https") + "/connect"
+	s.dialer.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	return &s
+}
+
+// Token 为用户签发 token
+func (s *Server) Token(t testing.TB, userID uuid.UUID) string {
+	t.Helper()
+
+	token, _, err := s.Auth.Issue(userID)
+	if err != nil {
+		t.Fatalf("chattest: issue token: %v", err)
+	}
+
+	return token
+}
+
+// Advance 让 clock.Fake 前进 d，服务使用的不是 clock.Fake 时测试失败
+func (s *Server) Advance(t testing.TB, d time.Duration) {
+	t.Helper()
+
+	fake, ok := s.Clock.(*clock.Fake)
+	if !ok {
+		t.Fatalf("chattest: clock %T is not a *clock.Fake", s.Clock)
+	}
+
+	fake.Advance(d)
+}
+
+// =============================================================================
+// 注册表断言
+// 连接断开后用户是异步移除的，断言会在超时时间内重试
+
+// AssertOnline 断言这些用户都在线
+func (s *Server) AssertOnline(t testing.TB, ids ...uuid.UUID) {
+	t.Helper()
+
+	s.eventually(t, func() (bool, string) {
+		online := s.online()
+		for _, id := range ids {
+			if !slices.Contains(online, id.String()) {
+				return false, "user " + id.String() + " is not online, online: " + strings.Join(online, ", ")
+			}
+		}
+		return true, ""
+	})
+}
+
+// AssertOffline 断言这些用户都不在线
+func (s *Server) AssertOffline(t testing.TB, ids ...uuid.UUID) {
+	t.Helper()
+
+	s.eventually(t, func() (bool, string) {
+		online := s.online()
+		for _, id := range ids {
+			if slices.Contains(online, id.String()) {
+				return false, "user " + id.String() + " is still online"
+			}
+		}
+		return true, ""
+	})
+}
+
+// AssertCount 断言在线用户的数量
+func (s *Server) AssertCount(t testing.TB, want int) {
+	t.Helper()
+
+	s.eventually(t, func() (bool, string) {
+		if got := s.Chat.Count(); got != want {
+			return false, fmt.Sprintf("online users: got %d, want %d", got, want)
+		}
+		return true, ""
+	})
+}
+
+// Eventually 在超时时间内重试 cond，直到返回 true
+func (s *Server) Eventually(t testing.TB, cond func() bool, msg string) {
+	t.Helper()
+
+	s.eventually(t, func() (bool, string) {
+		return cond(), msg
+	})
+}
+
+func (s *Server) eventually(t testing.TB, cond func() (bool, string)) {
+	t.Helper()
+
+	deadline := time.Now().Add(s.timeout)
+	for {
+		ok, msg := cond()
+		if ok {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("chattest: %s (after %s)", msg, s.timeout)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) online() []string {
+	sessions := s.Chat.Sessions()
+
+	ids := make([]string, len(sessions))
+	for i, ss := range sessions {
+		ids[i] = ss.UserID.String()
+	}
+
+	return ids
+}
@@ -0,0 +1,291 @@
+package chattest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/client"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Frame 从服务端收到的一个 websocket 帧，json 帧使用 client.Decode 解析到对应的类型
+// HELLO 和 WELCOME 等文本帧只有 Data
+type Frame struct {
+	Data    []byte
+	Message *client.Message
+	Error   *client.Error
+	System  *client.System
+}
+
+func parseFrame(data []byte) Frame {
+	f := Frame{Data: data}
+
+	e, err := client.Decode(data)
+	if err != nil {
+		return f
+	}
+
+	f.Message = e.Message
+	f.Error = e.Error
+	f.System = e.System
+
+	return f
+}
+
+// Conn 脚本化的客户端，直接读写 websocket 帧，可以发送任意内容测试协议的边界情况
+// 方法失败时调用 t.Fatalf，只能在测试的 goroutine 中调用
+type Conn struct {
+	// ID 和 Name 握手时使用的身份
+	ID   uuid.UUID
+	Name string
+	WS   *websocket.Conn
+
+	t       testing.TB
+	timeout time.Duration
+	frames  chan Frame
+	// closed 读取出错后关闭，closeErr 是读取的错误
+	closed   chan struct{}
+	closeErr error
+}
+
+// Dial 建立 websocket 连接但是不握手，header 可以为 nil
+func (s *Server) Dial(t testing.TB, header http.Header) *Conn {
+	t.Helper()
+
+	return s.dial(t, s.dialer, header)
+}
+
+// DialCert 使用客户端证书建立 websocket 连接但是不握手，证书由 ClientCert 签发
+func (s *Server) DialCert(t testing.TB, cert tls.Certificate) *Conn {
+	t.Helper()
+
+	if s.ca == nil {
+		t.Fatal("chattest: client certificates require Config.ClientCerts")
+	}
+
+	d := s.dialer
+	d.TLSClientConfig = d.TLSClientConfig.Clone()
+	d.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	return s.dial(t, d, nil)
+}
+
+func (s *Server) dial(t testing.TB, d websocket.Dialer, header http.Header) *Conn {
+	t.Helper()
+
+	ws, _, err := d.Dial(s.URL, header)
+	if err != nil {
+		t.Fatalf("chattest: dial: %v", err)
+	}
+
+	c := Conn{
+		WS:      ws,
+		t:       t,
+		timeout: s.timeout,
+		frames:  make(chan Frame, 256),
+		closed:  make(chan struct{}),
+	}
+
+	go c.read()
+
+	t.Cleanup(func() {
+		ws.Close()
+	})
+
+	return &c
+}
+
+// Connect 建立连接并以新的用户 ID 完成握手
+func (s *Server) Connect(t testing.TB, name string) *Conn {
+	t.Helper()
+
+	c := s.Dial(t, nil)
+	c.Handshake(uuid.New(), name)
+
+	return c
+}
+
+// read 在后台读取帧，这样 Expect 的超时不会影响连接
+// gorilla/websocket 的读取超时之后连接就不能再使用了
+func (c *Conn) read() {
+	defer close(c.closed)
+
+	for {
+		_, data, err := c.WS.ReadMessage()
+		if err != nil {
+			c.closeErr = err
+			return
+		}
+		c.frames <- parseFrame(data)
+	}
+}
+
+// Handshake 完成握手：HELLO -> {"id","name"} -> WELCOME name
+func (c *Conn) Handshake(id uuid.UUID, name string) {
+	c.t.Helper()
+
+	c.ID = id
+	c.Name = name
+
+	c.ExpectText("HELLO")
+	c.SendJSON(client.User{ID: id, Name: name})
+	c.ExpectText("WELCOME " + name)
+}
+
+// =============================================================================
+
+// SendRaw 发送一个文本帧
+func (c *Conn) SendRaw(data []byte) {
+	c.t.Helper()
+
+	c.WS.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.WS.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("chattest: %s: write: %v", c.Name, err)
+	}
+}
+
+// SendJSON 把 v 编码为 json 后发送
+func (c *Conn) SendJSON(v any) {
+	c.t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatalf("chattest: %s: marshal: %v", c.Name, err)
+	}
+
+	c.SendRaw(data)
+}
+
+// Send 以自己的身份向用户 to 发送消息
+func (c *Conn) Send(to uuid.UUID, msg string) {
+	c.t.Helper()
+
+	c.SendJSON(client.InMessage{FromID: c.ID, ToID: to, Msg: msg})
+}
+
+// Close 发送正常的关闭帧后关闭连接
+func (c *Conn) Close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.WS.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.WS.Close()
+}
+
+// Drop 不发送关闭帧直接断开 TCP 连接，模拟网络故障
+func (c *Conn) Drop() {
+	c.WS.NetConn().Close()
+}
+
+// =============================================================================
+
+// Expect 在超时时间内等待下一个帧
+func (c *Conn) Expect() Frame {
+	c.t.Helper()
+
+	select {
+	case f := <-c.frames:
+		return f
+	case <-c.closed:
+		// 连接关闭之前收到的帧仍然可以读取
+		select {
+		case f := <-c.frames:
+			return f
+		default:
+		}
+		c.t.Fatalf("chattest: %s: connection closed while waiting for a frame: %v", c.Name, c.closeErr)
+	case <-time.After(c.timeout):
+		c.t.Fatalf("chattest: %s: no frame after %s", c.Name, c.timeout)
+	}
+
+	return Frame{}
+}
+
+// ExpectText 等待内容为 want 的文本帧
+func (c *Conn) ExpectText(want string) {
+	c.t.Helper()
+
+	if f := c.Expect(); string(f.Data) != want {
+		c.t.Fatalf("chattest: %s: got frame %q, want %q", c.Name, f.Data, want)
+	}
+}
+
+// ExpectMessage 等待来自 from 内容为 msg 的消息
+func (c *Conn) ExpectMessage(from uuid.UUID, msg string) client.Message {
+	c.t.Helper()
+
+	f := c.Expect()
+	if f.Message == nil {
+		c.t.Fatalf("chattest: %s: got frame %s, want a message", c.Name, f.Data)
+	}
+	if f.Message.From.ID != from || f.Message.Msg != msg {
+		c.t.Fatalf("chattest: %s: got message %q from %s, want %q from %s", c.Name, f.Message.Msg, f.Message.From.ID, msg, from)
+	}
+
+	return *f.Message
+}
+
+// ExpectError 等待错误码为 code 的错误帧，比如 invalid_argument
+func (c *Conn) ExpectError(code string) client.Error {
+	c.t.Helper()
+
+	f := c.Expect()
+	if f.Error == nil {
+		c.t.Fatalf("chattest: %s: got frame %s, want error %s", c.Name, f.Data, code)
+	}
+	if f.Error.Code != code {
+		c.t.Fatalf("chattest: %s: got error %s, want %s", c.Name, f.Error, code)
+	}
+
+	return *f.Error
+}
+
+// ExpectSystem 等待内容为 msg 的系统公告
+func (c *Conn) ExpectSystem(msg string) client.System {
+	c.t.Helper()
+
+	f := c.Expect()
+	if f.System == nil || f.System.System != msg {
+		c.t.Fatalf("chattest: %s: got frame %s, want system %q", c.Name, f.Data, msg)
+	}
+
+	return *f.System
+}
+
+// ExpectClose 等待服务端关闭连接并返回关闭帧的原因，code 为 0 时不检查关闭码
+// 关闭之前收到的帧会被丢弃
+func (c *Conn) ExpectClose(code int) string {
+	c.t.Helper()
+
+	select {
+	case <-c.closed:
+	case <-time.After(c.timeout):
+		c.t.Fatalf("chattest: %s: connection still open after %s", c.Name, c.timeout)
+	}
+
+	var closeErr *websocket.CloseError
+	if !errors.As(c.closeErr, &closeErr) {
+		if code != 0 {
+			c.t.Fatalf("chattest: %s: got %v, want close code %d", c.Name, c.closeErr, code)
+		}
+		return ""
+	}
+	if code != 0 && closeErr.Code != code {
+		c.t.Fatalf("chattest: %s: got close code %d (%s), want %d", c.Name, closeErr.Code, closeErr.Text, code)
+	}
+
+	return closeErr.Text
+}
+
+// ExpectNothing 在 d 时间内没有收到任何帧
+func (c *Conn) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+
+	select {
+	case f := <-c.frames:
+		c.t.Fatalf("chattest: %s: got unexpected frame %s", c.Name, f.Data)
+	case <-time.After(d):
+	}
+}
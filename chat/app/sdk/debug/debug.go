@@ -0,0 +1,66 @@
+// Package debug 在调试端口上提供 pprof 和 expvar
+package debug
+
+import (
+	"expvar"
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+)
+
+var once sync.Once
+
+// Routes 注册 pprof 和 expvar 的路由，并发布运行时和聊天服务的 expvar
+func Routes(app *gin.Engine, cht *chat.Chat) {
+	once.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+
+		expvar.Publish("runtime", expvar.Func(runtimeStats))
+
+		expvar.Publish("chat", expvar.Func(func() any {
+			return cht.Snapshot()
+		}))
+	})
+
+	debug := app.Group("/debug")
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+
+	debug.GET("/pprof/", gin.WrapF(pprof.Index))
+	debug.GET("/pprof/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/pprof/profile", gin.WrapF(pprof.Profile))
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/pprof/trace", gin.WrapF(pprof.Trace))
+
+	// allocs、block、goroutine、heap、mutex、threadcreate 等 profile
+	debug.GET("/pprof/:name", func(c *gin.Context) {
+		pprof.Handler(c.Param("name")).ServeHTTP(c.Writer, c.Request)
+	})
+}
+
+// runtimeStats 返回堆内存和 GC 的统计信息
+func runtimeStats() any {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return map[string]any{
+		"goroutines":    runtime.NumGoroutine(),
+		"heapAlloc":     m.HeapAlloc,
+		"heapInuse":     m.HeapInuse,
+		"heapObjects":   m.HeapObjects,
+		"heapSys":       m.HeapSys,
+		"numGC":         m.NumGC,
+		"lastGC":        m.LastGC,
+		"pauseTotalNs":  m.PauseTotalNs,
+		"lastPauseNs":   m.PauseNs[(m.NumGC+255)%256],
+		"gcCPUFraction": m.GCCPUFraction,
+		"nextGC":        m.NextGC,
+		"totalAlloc":    m.TotalAlloc,
+		"mallocs":       m.Mallocs,
+		"frees":         m.Frees,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"time"
 )
 
 // ErrCode represents an error code in the system.
@@ -51,36 +52,88 @@ func (ec ErrCode) Equal(ec2 ErrCode) bool {
 
 // Error represents an error in the system.
 type Error struct {
-	Code     ErrCode `json:"code"`
-	Message  string  `json:"message"`
-	FuncName string  `json:"-"`
-	FileName string  `json:"-"`
+	Code    ErrCode `json:"code"`
+	Message string  `json:"message"`
+
+	// Reason is a machine-readable identifier that is more specific than
+	// Code, such as rate_limited. Clients can switch on it without parsing
+	// Message.
+	Reason string `json:"reason,omitempty"`
+
+	// Fields describes which input fields failed validation.
+	Fields []FieldError `json:"fields,omitempty"`
+
+	// RetryAfter tells the client how long to wait before retrying. It is
+	// sent as the Retry-After header and as retryAfter in seconds.
+	RetryAfter time.Duration `json:"-"`
+
+	// Err is the wrapped cause. It is only logged, never sent to the client.
+	Err error `json:"-"`
+
+	FuncName string `json:"-"`
+	FileName string `json:"-"`
+}
+
+// FieldError describes a validation failure of a single input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
-// New constructs an error based on an app error.
+// New constructs an error based on an app error. The error is kept as the
+// cause.
 func New(code ErrCode, err error) *Error {
 	pc, filename, line, _ := runtime.Caller(1)
 
 	return &Error{
 		Code:     code,
 		Message:  err.Error(),
+		Err:      err,
 		FuncName: runtime.FuncForPC(pc).Name(),
 		FileName: fmt.Sprintf("%s:%d", filename, line),
 	}
 }
 
-// Newf constructs an error based on a error message.
+// Newf constructs an error based on a error message. Errors formatted with
+// %w are kept as the cause.
 func Newf(code ErrCode, format string, v ...any) *Error {
 	pc, filename, line, _ := runtime.Caller(1)
 
+	wrapped := fmt.Errorf(format, v...)
+
+	var cause error
+	switch wrapped.(type) {
+	case interface{ Unwrap() error }, interface{ Unwrap() []error }:
+		cause = wrapped
+	}
+
 	return &Error{
 		Code:     code,
-		Message:  fmt.Sprintf(format, v...),
+		Message:  wrapped.Error(),
+		Err:      cause,
 		FuncName: runtime.FuncForPC(pc).Name(),
 		FileName: fmt.Sprintf("%s:%d", filename, line),
 	}
 }
 
+// WithReason sets the machine-readable reason and returns the error.
+func (e *Error) WithReason(reason string) *Error {
+	e.Reason = reason
+	return e
+}
+
+// WithField adds a field validation failure and returns the error.
+func (e *Error) WithField(field string, format string, v ...any) *Error {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, v...)})
+	return e
+}
+
+// WithRetryAfter sets the retry hint and returns the error.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	e.RetryAfter = d
+	return e
+}
+
 // NewError checks for an Error in the error interface value. If it doesn't
 // exist, will create one from the error.
 func NewError(err error) *Error {
@@ -97,6 +150,34 @@ func (e *Error) Error() string {
 	return e.Message
 }
 
+// Unwrap returns the wrapped cause so errors.Is and errors.As can see it.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to whole seconds, the
+// unit of the Retry-After header. It is 0 when there is no hint.
+func (e *Error) RetryAfterSeconds() int {
+	if e.RetryAfter <= 0 {
+		return 0
+	}
+
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// MarshalJSON adds retryAfter in seconds. Without the optional fields the
+// shape is the original {"code","message"}.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	type alias Error
+	return json.Marshal(struct {
+		*alias
+		RetryAfter int `json:"retryAfter,omitempty"`
+	}{
+		alias:      (*alias)(e),
+		RetryAfter: e.RetryAfterSeconds(),
+	})
+}
+
 // Encode implements the encoder interface.
 func (e *Error) Encode() ([]byte, string, error) {
 	data, err := json.Marshal(e)
@@ -0,0 +1,101 @@
+package errs
+
+// gRPC status codes, with the same values as google.golang.org/grpc/codes.
+// They are declared here so the mapping does not pull the grpc module into
+// packages that only need the numbers. Convert with codes.Code(ec.GRPCCode()).
+const (
+	grpcOK                 uint32 = 0
+	grpcCanceled           uint32 = 1
+	grpcUnknown            uint32 = 2
+	grpcInvalidArgument    uint32 = 3
+	grpcDeadlineExceeded   uint32 = 4
+	grpcNotFound           uint32 = 5
+	grpcAlreadyExists      uint32 = 6
+	grpcPermissionDenied   uint32 = 7
+	grpcResourceExhausted  uint32 = 8
+	grpcFailedPrecondition uint32 = 9
+	grpcAborted            uint32 = 10
+	grpcOutOfRange         uint32 = 11
+	grpcUnimplemented      uint32 = 12
+	grpcInternal           uint32 = 13
+	grpcUnavailable        uint32 = 14
+	grpcDataLoss           uint32 = 15
+	grpcUnauthenticated    uint32 = 16
+)
+
+// grpcCodes maps by name, not by value: NoContent shifts every ErrCode
+// after OK up by one, and TooManyRequests and InternalOnlyLog have no
+// gRPC counterpart.
+var grpcCodes = map[ErrCode]uint32{
+	OK:                 grpcOK,
+	NoContent:          grpcOK,
+	Canceled:           grpcCanceled,
+	Unknown:            grpcUnknown,
+	InvalidArgument:    grpcInvalidArgument,
+	DeadlineExceeded:   grpcDeadlineExceeded,
+	NotFound:           grpcNotFound,
+	AlreadyExists:      grpcAlreadyExists,
+	PermissionDenied:   grpcPermissionDenied,
+	ResourceExhausted:  grpcResourceExhausted,
+	FailedPrecondition: grpcFailedPrecondition,
+	Aborted:            grpcAborted,
+	OutOfRange:         grpcOutOfRange,
+	Unimplemented:      grpcUnimplemented,
+	Internal:           grpcInternal,
+	Unavailable:        grpcUnavailable,
+	DataLoss:           grpcDataLoss,
+	Unauthenticated:    grpcUnauthenticated,
+	TooManyRequests:    grpcResourceExhausted,
+	InternalOnlyLog:    grpcInternal,
+}
+
+// fromGRPC is the reverse of grpcCodes for codes received from other
+// services.
+var fromGRPC = map[uint32]ErrCode{
+	grpcOK:                 OK,
+	grpcCanceled:           Canceled,
+	grpcUnknown:            Unknown,
+	grpcInvalidArgument:    InvalidArgument,
+	grpcDeadlineExceeded:   DeadlineExceeded,
+	grpcNotFound:           NotFound,
+	grpcAlreadyExists:      AlreadyExists,
+	grpcPermissionDenied:   PermissionDenied,
+	grpcResourceExhausted:  ResourceExhausted,
+	grpcFailedPrecondition: FailedPrecondition,
+	grpcAborted:            Aborted,
+	grpcOutOfRange:         OutOfRange,
+	grpcUnimplemented:      Unimplemented,
+	grpcInternal:           Internal,
+	grpcUnavailable:        Unavailable,
+	grpcDataLoss:           DataLoss,
+	grpcUnauthenticated:    Unauthenticated,
+}
+
+// GRPCCode returns the gRPC status code for the error code. Codes without
+// a gRPC counterpart map to the closest one; unknown codes map to Unknown.
+func (ec ErrCode) GRPCCode() uint32 {
+	c, exists := grpcCodes[ec]
+	if !exists {
+		return grpcUnknown
+	}
+
+	return c
+}
+
+// FromGRPCCode returns the error code for a gRPC status code received from
+// another service. Unknown codes map to Unknown.
+func FromGRPCCode(code uint32) ErrCode {
+	ec, exists := fromGRPC[code]
+	if !exists {
+		return Unknown
+	}
+
+	return ec
+}
+
+// GRPCCode returns the gRPC status code for the error, the gRPC
+// counterpart of HTTPStatus. InternalOnlyLog errors should be replaced
+// before they are sent, as Errors does for HTTP.
+func (e *Error) GRPCCode() uint32 {
+	return e.Code.GRPCCode()
+}
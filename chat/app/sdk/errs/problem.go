@@ -0,0 +1,48 @@
+package errs
+
+import (
+	"net/http"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// problemTypePrefix builds the problem type URI from the error code, so
+// clients can switch on type the same way they switch on code.
+const problemTypePrefix = "urn:chat:error:"
+
+// Problem is an RFC 7807 problem details document. Code, Reason, Fields,
+// RetryAfter and Errors are extension members carrying the same
+// information as the default JSON shape.
+type Problem struct {
+	Type       string       `json:"type"`
+	Title      string       `json:"title"`
+	Status     int          `json:"status"`
+	Detail     string       `json:"detail,omitempty"`
+	Instance   string       `json:"instance,omitempty"`
+	Code       ErrCode      `json:"code"`
+	Reason     string       `json:"reason,omitempty"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	RetryAfter int          `json:"retryAfter,omitempty"`
+
+	// Errors lists further errors raised by the same request.
+	Errors []*Error `json:"errors,omitempty"`
+}
+
+// Problem converts the error to problem details. instance identifies the
+// occurrence, usually the request path.
+func (e *Error) Problem(instance string) Problem {
+	status := e.HTTPStatus()
+
+	return Problem{
+		Type:       problemTypePrefix + e.Code.String(),
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     e.Message,
+		Instance:   instance,
+		Code:       e.Code,
+		Reason:     e.Reason,
+		Fields:     e.Fields,
+		RetryAfter: e.RetryAfterSeconds(),
+	}
+}
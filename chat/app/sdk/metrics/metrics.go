@@ -0,0 +1,112 @@
+// Package metrics 定义服务和聊天内部的指标，在调试端口以 Prometheus 文本格式输出
+package metrics
+
+import (
+	"github.com/zhangpetergo/chat/chat/foundation/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	httpRequests = registry.NewCounter("chat_http_requests_total",
+		"Number of HTTP requests handled.", "method", "route", "status")
+
+	// 升级为 websocket 的请求持续整个会话，不记录耗时
+	httpDuration = registry.NewHistogram("chat_http_request_duration_seconds",
+		"HTTP request latency in seconds, excluding websocket upgrades.", nil, "method", "route")
+
+	panics = registry.NewCounter("chat_panics_total",
+		"Number of panics recovered by the panics middleware.")
+
+	connections = registry.NewGauge("chat_connections",
+		"Number of connected websocket users.")
+
+	handshakes = registry.NewCounter("chat_handshakes_total",
+		"Number of websocket handshakes by result.", "result")
+
+	messagesRouted = registry.NewCounter("chat_messages_routed_total",
+		"Number of messages delivered to a recipient's send queue.")
+
+	messagesDropped = registry.NewCounter("chat_messages_dropped_total",
+		"Number of messages that were not delivered, by reason.", "reason")
+
+	queueDepth = registry.NewGauge("chat_outbound_queue_depth",
+		"Number of frames waiting in all outbound send queues.")
+
+	pingFailures = registry.NewCounter("chat_ping_failures_total",
+		"Number of failed websocket pings.")
+)
+
+// 消息被丢弃的原因
+const (
+	DropRateLimited   = "rate_limited"
+	DropInvalid       = "invalid"
+	DropUndeliverable = "undeliverable"
+	DropRejected      = "rejected"
+	DropQuarantined   = "quarantined"
+	DropQueueFull     = "queue_full"
+	DropExpired       = "expired"
+)
+
+// Handler 返回输出所有指标的 http.Handler
+func Handler() http.Handler {
+	return registry.Handler()
+}
+
+// AddRequest 记录一个 HTTP 请求
+func AddRequest(method string, route string, status int, since time.Duration) {
+	httpRequests.Inc(method, route, strconv.Itoa(status))
+	httpDuration.Observe(since.Seconds(), method, route)
+}
+
+// AddUpgrade 记录一个升级为 websocket 的 HTTP 请求，状态码记为 101，不记录耗时
+func AddUpgrade(method string, route string) {
+	httpRequests.Inc(method, route, strconv.Itoa(http.StatusSwitchingProtocols))
+}
+
+// AddPanic 记录一次 panic
+func AddPanic() {
+	panics.Inc()
+}
+
+// AddConnection 记录一个新的连接
+func AddConnection() {
+	connections.Inc()
+}
+
+// RemoveConnection 记录一个断开的连接
+func RemoveConnection() {
+	connections.Dec()
+}
+
+// AddHandshake 记录一次握手的结果
+func AddHandshake(succeeded bool) {
+	if succeeded {
+		handshakes.Inc("succeeded")
+		return
+	}
+	handshakes.Inc("failed")
+}
+
+// AddMessageRouted 记录一条投递成功的消息
+func AddMessageRouted() {
+	messagesRouted.Inc()
+}
+
+// AddMessageDropped 记录一条被丢弃的消息
+func AddMessageDropped(reason string) {
+	messagesDropped.Inc(reason)
+}
+
+// AddQueueDepth 修改待发送队列的长度，d 可以是负数
+func AddQueueDepth(d int) {
+	queueDepth.Add(float64(d))
+}
+
+// AddPingFailure 记录一次 ping 失败
+func AddPingFailure() {
+	pingFailures.Inc()
+}
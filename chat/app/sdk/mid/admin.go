@@ -0,0 +1,23 @@
+package mid
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"strings"
+)
+
+// AdminToken 校验请求头 Authorization: Bearer <token>，token 为空时拒绝所有请求
+func AdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		bearer, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.Error(errs.Newf(errs.Unauthenticated, "invalid admin token"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
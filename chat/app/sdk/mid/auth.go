@@ -0,0 +1,80 @@
+package mid
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"strings"
+)
+
+// Authenticate 确定请求的身份并放入 context，校验通过的客户端证书优先，其次是 Authorization: Bearer <token>
+// a 为 nil 时不接受 token
+// 没有身份的请求继续处理，由 RequireUser 决定是否拒绝，token 不合法时返回 errs.Unauthenticated
+func Authenticate(a *auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		if tls := c.Request.TLS; tls != nil && len(tls.VerifiedChains) > 0 {
+			ident, err := chat.IdentityFromCert(tls.VerifiedChains[0][0])
+			if err != nil {
+				c.Error(err)
+				c.Abort()
+				return
+			}
+
+			setIdentity(c, auth.Identity{UserID: ident.ID, Method: auth.MethodCert})
+			c.Next()
+			return
+		}
+
+		bearer, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found {
+			c.Next()
+			return
+		}
+
+		userID, err := a.Verify(bearer)
+		if err != nil {
+			c.Error(errs.Newf(errs.Unauthenticated, "%v", err))
+			c.Abort()
+			return
+		}
+
+		setIdentity(c, auth.Identity{UserID: userID, Method: auth.MethodToken})
+		c.Next()
+	}
+}
+
+func setIdentity(c *gin.Context, ident auth.Identity) {
+	c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), ident))
+}
+
+// RequireUser 要求请求的身份与路径参数 param 中的用户 ID 一致
+// 没有身份时返回 errs.Unauthenticated，不一致时返回 errs.PermissionDenied
+func RequireUser(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		ident, ok := auth.FromContext(c.Request.Context())
+		if !ok {
+			c.Error(errs.Newf(errs.Unauthenticated, "authentication required"))
+			c.Abort()
+			return
+		}
+
+		userID, err := uuid.Parse(c.Param(param))
+		if err != nil {
+			c.Error(errs.Newf(errs.InvalidArgument, "invalid %s: %v", param, err))
+			c.Abort()
+			return
+		}
+
+		if userID != ident.UserID {
+			c.Error(errs.Newf(errs.PermissionDenied, "cannot access another user's resources"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
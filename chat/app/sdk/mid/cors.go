@@ -0,0 +1,83 @@
+package mid
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig 跨域请求的配置
+type CORSConfig struct {
+	// Origins 允许的来源，与 websocket 握手使用同一个列表
+	Origins *origin.Policy
+	// AllowCredentials 允许浏览器携带 cookie 和 Authorization 等凭证
+	AllowCredentials bool
+	// AllowedMethods 和 AllowedHeaders 预检请求允许的方法和请求头
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders 浏览器中的脚本可以读取的响应头
+	ExposedHeaders []string
+	// MaxAge 浏览器缓存预检结果的时间，为 0 时不设置
+	MaxAge time.Duration
+}
+
+// CORS 处理跨域请求，来源不在允许的列表中时不设置 CORS 响应头，由浏览器拒绝
+// 预检请求在这里直接返回，不会经过限流和路由
+func CORS(cfg CORSConfig) gin.HandlerFunc {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		o := c.GetHeader("Origin")
+		if o == "" {
+			c.Next()
+			return
+		}
+
+		// 响应与 Origin 有关，缓存需要区分
+		c.Writer.Header().Add("Vary", "Origin")
+
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if !cfg.Origins.Allowed(o) {
+			if preflight {
+				c.Error(errs.Newf(errs.PermissionDenied, "origin %s is not allowed", o))
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// 允许凭证时不能使用 *，始终返回请求的 Origin
+		h := c.Writer.Header()
+		h.Set("Access-Control-Allow-Origin", o)
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+			c.Next()
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", headers)
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", maxAge)
+		}
+
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,132 @@
+package mid_test
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func corsHandler(t *testing.T, patterns ...string) http.Handler {
+	t.Helper()
+
+	origins, err := origin.New(patterns)
+	if err != nil {
+		t.Fatalf("origins: %v", err)
+	}
+
+	app := gin.New()
+	app.Use(mid.Errors(), mid.CORS(mid.CORSConfig{
+		Origins:          origins,
+		AllowCredentials: true,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPut},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		MaxAge:           10 * time.Minute,
+	}))
+	app.GET("/v1/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return app
+}
+
+func serve(h http.Handler, method string, origin string, preflight bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/v1/test", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if preflight {
+		r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		r.Header.Set("Access-Control-Request-Headers", "Authorization")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	h := corsHandler(t, "https://*.example.com", "http://localhost:3000")
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		preflight bool
+		status    int
+		allowed   bool
+	}{
+		{"no origin", http.MethodGet, "", false, http.StatusOK, false},
+		{"allowed", http.MethodGet, "https://chat.example.com", false, http.StatusOK, true},
+		{"allowed nested subdomain", http.MethodGet, "https://a.b.example.com", false, http.StatusOK, true},
+		{"allowed explicit port", http.MethodGet, "http://localhost:3000", false, http.StatusOK, true},
+		// 不允许的来源仍然处理请求，没有 CORS 响应头，由浏览器拒绝
+		{"denied apex", http.MethodGet, "https://example.com", false, http.StatusOK, false},
+		{"denied scheme", http.MethodGet, "http://chat.example.com", false, http.StatusOK, false},
+		{"denied null", http.MethodGet, "null", false, http.StatusOK, false},
+
+		{"preflight allowed", http.MethodOptions, "https://chat.example.com", true, http.StatusNoContent, true},
+		{"preflight denied", http.MethodOptions, "https://evil.test", true, http.StatusForbidden, false},
+		{"preflight denied port", http.MethodOptions, "http://localhost:3001", true, http.StatusForbidden, false},
+		{"preflight denied null", http.MethodOptions, "null", true, http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, tt.method, tt.origin, tt.preflight)
+			if w.Code != tt.status {
+				t.Fatalf("status: got %d, want %d", w.Code, tt.status)
+			}
+
+			got := w.Header().Get("Access-Control-Allow-Origin")
+			switch {
+			case tt.allowed && got != tt.origin:
+				t.Errorf("Access-Control-Allow-Origin: got %q, want %q", got, tt.origin)
+			case !tt.allowed && got != "":
+				t.Errorf("Access-Control-Allow-Origin: got %q, want none", got)
+			}
+
+			if tt.origin != "" && !slices.Contains(w.Header().Values("Vary"), "Origin") {
+				t.Errorf("Vary: got %q, want Origin", w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	h := corsHandler(t, "https://*.example.com")
+
+	w := serve(h, http.MethodGet, "https://chat.example.com", false)
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials: got %q, want true", got)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-ID" {
+		t.Errorf("Access-Control-Expose-Headers: got %q, want X-Request-ID", got)
+	}
+
+	w = serve(h, http.MethodOptions, "https://chat.example.com", true)
+	want := map[string]string{
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+		"Access-Control-Max-Age":           "600",
+		"Access-Control-Allow-Credentials": "true",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s: got %q, want %q", k, got, v)
+		}
+	}
+
+	// 拒绝的预检请求也不能带有其他 CORS 响应头
+	w = serve(h, http.MethodOptions, "https://evil.test", true)
+	for k := range want {
+		if got := w.Header().Get(k); got != "" {
+			t.Errorf("denied preflight %s: got %q, want none", k, got)
+		}
+	}
+}
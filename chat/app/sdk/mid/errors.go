@@ -5,12 +5,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
 	"github.com/zhangpetergo/chat/chat/foundation/logger"
-	"github.com/zhangpetergo/chat/chat/foundation/web"
-	"go.uber.org/zap"
+	"mime"
 	"path"
+	"strconv"
+	"strings"
 )
 
 // Errors 处理请求中的错误
+// 默认返回 {"code","message"}，Accept 中包含 application/problem+json 时返回 RFC 7807 格式
 func Errors() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
@@ -20,11 +22,16 @@ func Errors() gin.HandlerFunc {
 
 		// 程序处理完毕
 		// 判断是否存在错误
-		if len(c.Errors) > 0 {
-			// 处理第一个错误
-			// 在 gin 中，错误是一个数组，这里只处理第一个错误，一般来说我们在程序中遇到错误时，只会返回一个错误
-			// 如果出现了例外情况，那么我们需要修改这里的代码
-			err := c.Errors[0].Err
+		if len(c.Errors) == 0 {
+			return
+		}
+
+		log := logger.ForComponent(ctx, "mid")
+
+		// 记录所有的错误，响应使用第一个错误，其余的错误只在 problem+json 的 errors 中返回
+		appErrs := make([]*errs.Error, len(c.Errors))
+		for i, ginErr := range c.Errors {
+			err := ginErr.Err
 
 			var appErr *errs.Error
 			// 如果不是我们自定义错误，代表服务器发生了一些我们不知道的错误，所以这里返回 500
@@ -32,24 +39,70 @@ func Errors() gin.HandlerFunc {
 				appErr = errs.Newf(errs.Internal, "Internal Server Error")
 			}
 
-			traceID := web.GetTraceID(ctx).String()
-
-			log := logger.Log.With(zap.String("uuid", traceID))
-
-			log.Errorw("handled error during request",
+			args := []any{
 				"err", err,
 				"source_err_file", path.Base(appErr.FileName),
-				"source_err_func", path.Base(appErr.FuncName))
+				"source_err_func", path.Base(appErr.FuncName),
+			}
+			if appErr.Err != nil {
+				args = append(args, "cause", appErr.Err)
+			}
+			if len(c.Errors) > 1 {
+				args = append(args, "error_index", i, "error_count", len(c.Errors))
+			}
+			log.Errorw("handled error during request", args...)
 
 			if appErr.Code == errs.InternalOnlyLog {
 				appErr = errs.Newf(errs.Internal, "Internal Server Error")
 			}
 
-			c.JSON(appErr.HTTPStatus(), appErr)
+			appErrs[i] = appErr
+		}
+
+		c.Abort()
 
-			c.Abort()
+		// 响应已经写出时不能再写入，比如 websocket 升级之后握手失败
+		if c.Writer.Written() {
 			return
 		}
 
+		appErr := appErrs[0]
+
+		if secs := appErr.RetryAfterSeconds(); secs > 0 {
+			c.Header("Retry-After", strconv.Itoa(secs))
+		}
+
+		if !acceptsProblem(c.GetHeader("Accept")) {
+			c.JSON(appErr.HTTPStatus(), appErr)
+			return
+		}
+
+		p := appErr.Problem(c.Request.URL.Path)
+		if len(appErrs) > 1 {
+			p.Errors = appErrs[1:]
+		}
+
+		// gin 不会覆盖已经设置的 Content-Type
+		c.Header("Content-Type", errs.ProblemContentType)
+		c.JSON(p.Status, p)
+	}
+}
+
+// acceptsProblem 判断 Accept 请求头中是否明确接受 application/problem+json
+// */* 和 application/json 不算，这样没有要求的客户端仍然得到原来的格式
+func acceptsProblem(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != errs.ProblemContentType {
+			continue
+		}
+
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+
+		return true
 	}
+
+	return false
 }
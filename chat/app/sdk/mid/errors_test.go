@@ -0,0 +1,209 @@
+package mid_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// errorsHandler 返回处理函数产生 errors 的 handler
+func errorsHandler(errors ...error) http.Handler {
+	app := gin.New()
+	app.Use(mid.Errors())
+	app.GET("/v1/test", func(c *gin.Context) {
+		for _, err := range errors {
+			c.Error(err)
+		}
+	})
+
+	return app
+}
+
+func get(h http.Handler, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/v1/test", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// body 把响应解析为 map，用于检查没有多余的字段
+func body(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+
+	var m map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("decode %s: %v", w.Body.Bytes(), err)
+	}
+	return m
+}
+
+func TestErrorsDefaultShape(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   string
+	}{
+		{
+			name:   "code and message only",
+			err:    errs.Newf(errs.NotFound, "session not found"),
+			status: http.StatusNotFound,
+			want:   `{"code":"not_found","message":"session not found"}`,
+		},
+		{
+			name:   "optional fields",
+			err:    errs.Newf(errs.InvalidArgument, "bad").WithReason("too_long").WithField("msg", "too long"),
+			status: http.StatusBadRequest,
+			want:   `{"code":"invalid_argument","message":"bad","reason":"too_long","fields":[{"field":"msg","message":"too long"}]}`,
+		},
+		{
+			name:   "not an app error",
+			err:    errors.New("database password is hunter2"),
+			status: http.StatusInternalServerError,
+			want:   `{"code":"internal","message":"Internal Server Error"}`,
+		},
+		{
+			name:   "internal only log",
+			err:    errs.Newf(errs.InternalOnlyLog, "PANIC [boom]"),
+			status: http.StatusInternalServerError,
+			want:   `{"code":"internal","message":"Internal Server Error"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(errorsHandler(tt.err), "")
+
+			if w.Code != tt.status {
+				t.Errorf("status: got %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type: got %q, want application/json", got)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body:\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorsRetryAfter(t *testing.T) {
+	h := errorsHandler(errs.Newf(errs.TooManyRequests, "slow down").WithRetryAfter(1500 * time.Millisecond))
+
+	w := get(h, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status: got %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After: got %q, want 2", got)
+	}
+	if got := body(t, w)["retryAfter"]; got != float64(2) {
+		t.Errorf("retryAfter: got %v, want 2", got)
+	}
+
+	w = get(h, errs.ProblemContentType)
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("problem Retry-After: got %q, want 2", got)
+	}
+	if got := body(t, w)["retryAfter"]; got != float64(2) {
+		t.Errorf("problem retryAfter: got %v, want 2", got)
+	}
+}
+
+func TestErrorsAcceptNegotiation(t *testing.T) {
+	h := errorsHandler(errs.Newf(errs.InvalidArgument, "bad"))
+
+	tests := []struct {
+		accept  string
+		problem bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/*", false},
+		{"application/json", false},
+		{"text/html, */*;q=0.8", false},
+		{"application/problem+json;q=0", false},
+		{"application/problem+json; q=0.0, application/json", false},
+		{"application/problem+json", true},
+		{"Application/Problem+JSON", true},
+		{"application/problem+json;q=0.5", true},
+		{"application/json, application/problem+json", true},
+		{"text/html, application/problem+json;charset=utf-8", true},
+	}
+
+	for _, tt := range tests {
+		w := get(h, tt.accept)
+		m := body(t, w)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Accept %q: status got %d, want 400", tt.accept, w.Code)
+		}
+
+		ct := w.Header().Get("Content-Type")
+		_, isProblem := m["type"]
+
+		switch {
+		case tt.problem && (ct != errs.ProblemContentType || !isProblem):
+			t.Errorf("Accept %q: got Content-Type %q body %s, want problem details", tt.accept, ct, w.Body.Bytes())
+		case !tt.problem && (ct != "application/json; charset=utf-8" || isProblem):
+			t.Errorf("Accept %q: got Content-Type %q body %s, want the default shape", tt.accept, ct, w.Body.Bytes())
+		}
+	}
+}
+
+func TestErrorsProblemShape(t *testing.T) {
+	h := errorsHandler(
+		errs.Newf(errs.InvalidArgument, "bad").WithReason("too_long").WithField("msg", "too long"),
+		errs.Newf(errs.NotFound, "second"),
+	)
+
+	w := get(h, errs.ProblemContentType)
+
+	var p struct {
+		Type     string `json:"type"`
+		Title    string `json:"title"`
+		Status   int    `json:"status"`
+		Detail   string `json:"detail"`
+		Instance string `json:"instance"`
+		Code     string `json:"code"`
+		Reason   string `json:"reason"`
+		Fields   []struct {
+			Field string `json:"field"`
+		} `json:"fields"`
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if p.Type != "urn:chat:error:invalid_argument" || p.Title != "Bad Request" || p.Status != http.StatusBadRequest ||
+		p.Detail != "bad" || p.Instance != "/v1/test" || p.Code != "invalid_argument" || p.Reason != "too_long" {
+		t.Errorf("got problem %s", w.Body.Bytes())
+	}
+	if len(p.Fields) != 1 || p.Fields[0].Field != "msg" {
+		t.Errorf("fields: got %+v", p.Fields)
+	}
+
+	// 第一个错误决定响应，其余的错误在 errors 中
+	if len(p.Errors) != 1 || p.Errors[0].Code != "not_found" || p.Errors[0].Message != "second" {
+		t.Errorf("errors: got %+v", p.Errors)
+	}
+
+	// 默认格式只包含第一个错误
+	if _, exists := body(t, get(h, ""))["errors"]; exists {
+		t.Error("default shape: got errors, want only the first error")
+	}
+}
@@ -3,8 +3,6 @@ package mid
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/zhangpetergo/chat/chat/foundation/logger"
-	"github.com/zhangpetergo/chat/chat/foundation/web"
-	"go.uber.org/zap"
 	"time"
 )
 
@@ -12,16 +10,14 @@ import (
 func Logger() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		// 打印时需要带着uuid
+		// mid.TraceID 已经把带有 uuid 的 logger 放入了 context
 
 		now := time.Now()
 
 		r := c.Request
 		ctx := c.Request.Context()
 
-		traceID := web.GetTraceID(ctx).String()
-
-		log := logger.Log.With(zap.String("uuid", traceID))
+		log := logger.ForComponent(ctx, "http")
 
 		// 程序运行之前打印
 		log.Infow("request started", "method", r.Method, "path", r.URL.Path, "remoteaddr", r.RemoteAddr)
@@ -0,0 +1,50 @@
+package mid
+
+import (
+	"bufio"
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
+	"net"
+	"time"
+)
+
+// Metrics 记录每个请求的数量和耗时
+// 升级为 websocket 的请求在整个会话结束后才返回，只记录数量，不记录耗时
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		now := time.Now()
+
+		w := hijackWriter{ResponseWriter: c.Writer}
+		c.Writer = &w
+
+		c.Next()
+
+		// 使用路由模板而不是实际路径，避免标签的数量无限增长
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		if w.hijacked {
+			metrics.AddUpgrade(c.Request.Method, route)
+			return
+		}
+
+		metrics.AddRequest(c.Request.Method, route, c.Writer.Status(), time.Since(now))
+	}
+}
+
+// hijackWriter 记录连接是否被接管，websocket 升级时会接管连接
+type hijackWriter struct {
+	gin.ResponseWriter
+	hijacked bool
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
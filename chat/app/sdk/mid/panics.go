@@ -3,6 +3,7 @@ package mid
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
 	"runtime/debug"
 )
 
@@ -15,6 +16,8 @@ func Panics() gin.HandlerFunc {
 
 				err := errs.Newf(errs.InternalOnlyLog, "PANIC [%v] TRACE[%s]", rec, string(trace))
 
+				metrics.AddPanic()
+
 				c.Error(err)
 				c.Abort()
 
@@ -0,0 +1,25 @@
+package mid
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/sdk/errs"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+)
+
+// RateLimit 按照客户端 IP 限流，超过限制时返回 errs.TooManyRequests
+func RateLimit(limiter *rate.Keyed) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		ip := c.ClientIP()
+		if !limiter.Allow(ip) {
+			err := errs.Newf(errs.TooManyRequests, "rate limit exceeded, try again later").
+				WithReason("rate_limited").
+				WithRetryAfter(limiter.RetryAfter(ip))
+			c.Error(err)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,25 +1,64 @@
 package mid
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
 	"github.com/zhangpetergo/chat/chat/foundation/web"
+	"go.uber.org/zap"
+	"net/http"
 )
 
-// TraceID 每个请求都会生成一个唯一的 traceID
-func TraceID() gin.HandlerFunc {
+// TraceID 从 traceparent 或者 X-Request-ID 请求头中提取 traceID，都不存在时生成一个新的
+// 同时为每个请求创建一个 span，traceID 和 span 的 trace-id 相同
+// 基于 log 创建带有 traceID 的子 logger 放入 context，后续通过 logger.FromContext 获取
+func TraceID(log *zap.SugaredLogger, t *tracer.Tracer) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 生成 uuid 进行日志打印跟踪
 
 		ctx := c.Request.Context()
+		r := c.Request
 
-		traceID := uuid.New()
+		opts := []tracer.Option{
+			tracer.WithKind(tracer.KindServer),
+			tracer.WithAttributes("http.method", r.Method, "http.target", r.URL.Path, "http.route", c.FullPath()),
+		}
+
+		// 优先使用 W3C Trace Context，其次使用 UUID 格式的 X-Request-ID
+		if sc, err := tracer.ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+			opts = append(opts, tracer.WithParent(sc))
+		} else if requestID := r.Header.Get("X-Request-ID"); requestID != "" {
+			if id, err := uuid.Parse(requestID); err == nil {
+				opts = append(opts, tracer.WithTraceID(tracer.TraceID(id)))
+			} else {
+				opts = append(opts, tracer.WithAttributes("http.request_id", requestID))
+			}
+		}
+
+		ctx, span := t.Start(ctx, fmt.Sprintf("%s %s", r.Method, c.FullPath()), opts...)
+		defer span.End()
+
+		traceID := uuid.UUID(span.Context().TraceID)
 
 		ctx = web.SetTraceID(ctx, traceID)
 
+		// 子 logger 自动带上 traceID、路由以及路径中的用户 ID
+		reqLog := log.With("uuid", traceID.String(), "route", c.FullPath())
+		if userID := c.Param("userID"); userID != "" {
+			reqLog = reqLog.With("user", userID)
+		}
+		ctx = logger.NewContext(ctx, reqLog)
+
 		c.Request = c.Request.WithContext(ctx)
+		c.Header("X-Request-ID", traceID.String())
 
 		c.Next()
 
+		status := c.Writer.Status()
+		span.SetAttributes("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%s", http.StatusText(status)))
+		}
 	}
 }
@@ -2,21 +2,142 @@ package mux
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/zhangpetergo/chat/chat/app/domain/adminapp"
 	"github.com/zhangpetergo/chat/chat/app/domain/chatapp"
+	"github.com/zhangpetergo/chat/chat/app/domain/checkapp"
+	"github.com/zhangpetergo/chat/chat/app/sdk/auth"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/debug"
+	"github.com/zhangpetergo/chat/chat/app/sdk/metrics"
 	"github.com/zhangpetergo/chat/chat/app/sdk/mid"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"go.uber.org/zap"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
+// Config 包含 WebAPI 需要的配置
+type Config struct {
+	Log *zap.SugaredLogger
+	// HTTPLimiter 按 IP 限流，可以在运行时通过 SetLimit 修改限制
+	HTTPLimiter *rate.Keyed
+	// TrustedProxies 信任的反向代理的 IP 或者 CIDR，只有来自这些地址的请求才使用 X-Forwarded-For 作为客户端 IP
+	// 为空时始终使用连接的地址
+	TrustedProxies []string
+	Build          string
+	Chat           *chat.Chat
+	// ShuttingDown 服务开始关闭时设置为 true，就绪检查失败并且拒绝新的 websocket 连接
+	ShuttingDown *atomic.Bool
+	// Tracer 为每个请求创建 span，可以为 nil
+	Tracer *tracer.Tracer
+	// CORS 跨域请求的配置，Origins 为 nil 时不处理跨域请求
+	CORS mid.CORSConfig
+	// Auth 校验用户的 token，为 nil 时只能使用客户端证书
+	Auth *auth.Authenticator
+}
+
 // WebAPI 返回一个 http.Handler，用于设置带有中间件和路由的 Gin 引擎。
-func WebAPI() http.Handler {
-	
+func WebAPI(cfg Config) http.Handler {
+
+	app := gin.New()
+
+	// gin 默认信任所有代理，客户端可以伪造 X-Forwarded-For 绕过按 IP 的限流
+	if err := app.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		cfg.Log.Errorw("startup", "status", "invalid trusted proxies, trusting none", "trustedProxies", cfg.TrustedProxies, "err", err)
+		app.SetTrustedProxies(nil)
+	}
+
+	// 健康检查不经过中间件，避免被限流以及产生大量日志
+	checkapp.Routes(app, checkapp.Config{
+		Log:          cfg.Log,
+		Build:        cfg.Build,
+		Chat:         cfg.Chat,
+		ShuttingDown: cfg.ShuttingDown,
+	})
+
+	// add mid
+	// CORS 在限流之前，被限流的响应也带有 CORS 响应头，浏览器中的脚本可以读取错误
+	app.Use(mid.TraceID(cfg.Log, cfg.Tracer), mid.Logger(), mid.Metrics(), mid.Errors(), mid.Panics())
+	if cfg.CORS.Origins != nil {
+		app.Use(mid.CORS(cfg.CORS))
+	}
+	app.Use(mid.RateLimit(cfg.HTTPLimiter))
+
+	// add route
+	chatapp.Routes(app, chatapp.Config{
+		Chat:         cfg.Chat,
+		Auth:         cfg.Auth,
+		ShuttingDown: cfg.ShuttingDown,
+	})
+
+	return app
+}
+
+// DebugConfig 包含 DebugAPI 需要的配置
+type DebugConfig struct {
+	Log *zap.SugaredLogger
+	// AdminToken 访问管理接口需要的 token
+	AdminToken string
+	Chat       *chat.Chat
+	// Levels 管理接口通过它在运行时修改日志级别
+	Levels *logger.Levels
+	// Auth 管理接口通过它为用户签发 token
+	Auth *auth.Authenticator
+}
+
+// DebugAPI 返回调试和管理监听端口使用的 http.Handler，不应该暴露到公网
+func DebugAPI(cfg DebugConfig) http.Handler {
+
 	app := gin.New()
 
+	// 日志中的客户端 IP 始终使用连接的地址
+	app.SetTrustedProxies(nil)
+
 	// add mid
-	app.Use(mid.TraceID(), mid.Logger(), mid.Errors(), mid.Panics())
+	// 调试端口的请求不导出 span
+	app.Use(mid.TraceID(cfg.Log, nil), mid.Logger(), mid.Errors(), mid.Panics())
+
+	// Prometheus 指标
+	app.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// pprof 和 expvar
+	debug.Routes(app, cfg.Chat)
 
 	// add route
-	chatapp.Routes(app)
+	adminapp.Routes(app, adminapp.Config{
+		Chat:   cfg.Chat,
+		Levels: cfg.Levels,
+		Auth:   cfg.Auth,
+		Token:  cfg.AdminToken,
+	})
 
 	return app
 }
+
+// Redirect 返回 HTTP 重定向端口使用的 http.Handler，把所有请求重定向到 HTTPS
+// httpsPort 是 API 监听的端口，为 443 时重定向的地址不带端口
+func Redirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+
+		// 308 保留请求的方法和 body
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,178 @@
+package mux_test
+
+import (
+	"bufio"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chat"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"github.com/zhangpetergo/chat/chat/app/sdk/mux"
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// scrape 读取调试端口的 /metrics，返回每个样本的值，键是指标名和标签，比如 chat_connections
+// 或者 chat_http_requests_total{method="GET",route="/connect",status="101"}
+func scrape(t *testing.T, debug http.Handler) map[string]float64 {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	debug.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", w.Code)
+	}
+
+	samples := make(map[string]float64)
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed sample %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("malformed sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+
+	return samples
+}
+
+func TestDebugMetrics(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	debug := mux.DebugAPI(mux.DebugConfig{
+		Log:  zap.NewNop().Sugar(),
+		Chat: srv.Chat,
+	})
+
+	// 指标是全局的，计数器只比较测试前后的差值
+	const (
+		upgrades  = `chat_http_requests_total{method="GET",route="/connect",status="101"}`
+		notFound  = `chat_http_requests_total{method="GET",route="unmatched",status="404"}`
+		duration  = `chat_http_request_duration_seconds_count{method="GET",route="/connect"}`
+		routed    = `chat_messages_routed_total`
+		handshake = `chat_handshakes_total{result="succeeded"}`
+	)
+	before := scrape(t, debug)
+
+	for _, name := range []string{
+		"chat_connections",
+		"chat_outbound_queue_depth",
+		"chat_panics_total",
+		"chat_ping_failures_total",
+		routed,
+	} {
+		if _, exists := before[name]; !exists {
+			t.Errorf("series %s is missing", name)
+		}
+	}
+
+	alice := srv.Connect(t, "alice")
+	bob := srv.Connect(t, "bob")
+	srv.AssertCount(t, 2)
+
+	alice.Send(bob.ID, "hi")
+	bob.ExpectMessage(alice.ID, "hi")
+
+	resp, err := http.Get(srv.HTTP.URL + "/nope")
+	if err != nil {
+		t.Fatalf("GET /nope: %v", err)
+	}
+	resp.Body.Close()
+
+	during := scrape(t, debug)
+	if got := during["chat_connections"]; got != 2 {
+		t.Errorf("chat_connections: got %v, want 2", got)
+	}
+	if got := during["chat_outbound_queue_depth"]; got != 0 {
+		t.Errorf("chat_outbound_queue_depth: got %v, want 0", got)
+	}
+	if got := during[routed] - before[routed]; got != 1 {
+		t.Errorf("%s: got +%v, want +1", routed, got)
+	}
+	if got := during[handshake] - before[handshake]; got != 2 {
+		t.Errorf("%s: got +%v, want +2", handshake, got)
+	}
+	if got := during[notFound] - before[notFound]; got != 1 {
+		t.Errorf("%s: got +%v, want +1", notFound, got)
+	}
+
+	alice.Close()
+	bob.Close()
+	srv.AssertCount(t, 0)
+
+	// 连接的请求在会话结束后才返回
+	var after map[string]float64
+	srv.Eventually(t, func() bool {
+		after = scrape(t, debug)
+		return after[upgrades]-before[upgrades] == 2
+	}, "upgraded requests were not counted")
+
+	if got := after["chat_connections"]; got != 0 {
+		t.Errorf("chat_connections: got %v, want 0", got)
+	}
+	if got := after["chat_outbound_queue_depth"]; got != 0 {
+		t.Errorf("chat_outbound_queue_depth: got %v, want 0", got)
+	}
+
+	// 整个 websocket 会话的时间不应该计入请求的耗时
+	if got := after[duration] - before[duration]; got != 0 {
+		t.Errorf("%s: got +%v, want +0", duration, got)
+	}
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		// want 第二个请求的状态码
+		want int
+	}{
+		{name: "untrusted", trustedProxies: nil, want: http.StatusTooManyRequests},
+		{name: "trusted", trustedProxies: []string{"192.0.2.0/24"}, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cht := chat.NewChat(zap.NewNop().Sugar(), chat.DefaultConfig())
+			t.Cleanup(cht.Stop)
+
+			api := mux.WebAPI(mux.Config{
+				Log:            zap.NewNop().Sugar(),
+				HTTPLimiter:    rate.NewKeyed(0.001, 1),
+				TrustedProxies: tt.trustedProxies,
+				Chat:           cht,
+				ShuttingDown:   new(atomic.Bool),
+			})
+
+			// 两个请求来自同一个连接地址，伪造了不同的 X-Forwarded-For
+			var codes []int
+			for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+				r := httptest.NewRequest(http.MethodGet, "/test", nil)
+				r.RemoteAddr = "192.0.2.1:1234"
+				r.Header.Set("X-Forwarded-For", ip)
+
+				w := httptest.NewRecorder()
+				api.ServeHTTP(w, r)
+				codes = append(codes, w.Code)
+			}
+
+			if codes[0] != http.StatusOK {
+				t.Fatalf("first request: got status %d, want %d", codes[0], http.StatusOK)
+			}
+			if codes[1] != tt.want {
+				t.Errorf("second request: got status %d, want %d", codes[1], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,561 @@
+// Package client 是 chat 服务的 Go 客户端
+//
+// 使用方式：
+//
+//	c, err := client.Dial(ctx, "ws://localhost:9000/connect", client.Options{
+//		User:      client.User{ID: id, Name: "Alice"},
+//		Reconnect: true,
+//		Resume:    true,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	for e := range c.Events() {
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/foundation/wire"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotConnected 连接断开后正在重连时发送消息
+	ErrNotConnected = errors.New("not connected")
+	// ErrClosed 客户端已经关闭
+	ErrClosed = errors.New("client closed")
+	// ErrDisconnectedByServer 服务端主动断开连接，比如被管理员踢下线或者超过限流，不会自动重连
+	ErrDisconnectedByServer = errors.New("disconnected by server")
+	// ErrAlreadyConnected 该用户已经有一个连接
+	ErrAlreadyConnected = errors.New("already connected")
+)
+
+// Options 客户端的配置，零值字段使用默认值
+type Options struct {
+	// User 握手时使用的身份，ID 不能为空
+	User User
+	// Header 握手时附带的请求头
+	Header http.Header
+	// Token 不为空时设置 Authorization: Bearer，服务端要求 User.ID 与 token 的用户一致
+	Token string
+	// Dialer 为 nil 时使用 websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// Compression 请求 permessage-deflate 压缩，服务端同意时生效
+	Compression bool
+	// Encoding 消息使用的编码：json、msgpack 或者 cbor，默认 json
+	// 通过 Sec-WebSocket-Protocol 协商，服务端不支持时使用 json
+	Encoding string
+
+	// HandshakeTimeout 等待 HELLO 和 WELCOME 的时间，默认 5s
+	HandshakeTimeout time.Duration
+	// WriteTimeout 发送消息的超时时间，默认 10s
+	WriteTimeout time.Duration
+	// ReadTimeout 在这段时间内没有收到消息或者服务端的 ping 时认为连接已经断开，默认 30s
+	// 服务端默认每 10s 发送一次 ping
+	ReadTimeout time.Duration
+
+	// Reconnect 连接断开后按指数退避自动重连并重新握手
+	// 没有开启 Resume 时重连后是一个新的会话，断开期间的消息会丢失
+	Reconnect  bool
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Resume 请求服务端在连接意外断开后保留会话，重连时补发断开期间的消息，重复的消息按序号丢弃
+	// 服务端保留会话的时间由服务端配置，超过之后重连是一个新的会话，EventConnected 的 Resumed 为 false
+	Resume bool
+
+	// OnEvent 不为 nil 时在读取消息的 goroutine 中调用，Events 返回 nil
+	// 为 nil 时事件发送到 Events 返回的 channel，调用方需要一直读取
+	OnEvent     func(Event)
+	EventBuffer int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Dialer == nil {
+		o.Dialer = websocket.DefaultDialer
+	}
+	if o.Encoding == "" {
+		o.Encoding = wire.JSON.Name
+	}
+
+	// 不修改调用方的 Dialer
+	d := *o.Dialer
+	d.Subprotocols = []string{subprotocolPrefix + o.Encoding}
+	if o.Compression {
+		d.EnableCompression = true
+	}
+	o.Dialer = &d
+	if o.HandshakeTimeout == 0 {
+		o.HandshakeTimeout = 5 * time.Second
+	}
+	if o.WriteTimeout == 0 {
+		o.WriteTimeout = 10 * time.Second
+	}
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = 30 * time.Second
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 500 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.EventBuffer == 0 {
+		o.EventBuffer = 64
+	}
+	return o
+}
+
+// subprotocolPrefix 编码对应的子协议是 chat.<编码>
+const subprotocolPrefix = "chat."
+
+// Client 到 chat 服务的一个连接，方法可以并发调用
+type Client struct {
+	url    string
+	opts   Options
+	events chan Event
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	sess *session
+	// token 和 lastSeq 断线续传的 token 和最后收到的消息序号
+	token   uuid.UUID
+	lastSeq uint64
+}
+
+// session 一次握手成功的连接
+type session struct {
+	ws    *websocket.Conn
+	codec wire.Codec
+	// resumed 和 gap 握手时服务端返回的续传结果
+	resumed bool
+	gap     bool
+}
+
+// Dial 连接服务端并完成握手，ctx 只用于这次连接
+// 返回的 Client 在后台读取消息，需要调用 Close 关闭
+func Dial(ctx context.Context, url string, opts Options) (*Client, error) {
+	if opts.User.ID == uuid.Nil {
+		return nil, errors.New("user id is required")
+	}
+	if _, ok := wire.Lookup(opts.Encoding); opts.Encoding != "" && !ok {
+		return nil, fmt.Errorf("unknown encoding %q", opts.Encoding)
+	}
+
+	c := Client{
+		url:  url,
+		opts: opts.withDefaults(),
+		done: make(chan struct{}),
+	}
+
+	if c.opts.OnEvent == nil {
+		c.events = make(chan Event, c.opts.EventBuffer)
+	}
+
+	sess, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.setSession(sess)
+	c.emit(Event{Kind: EventConnected, Resumed: sess.resumed, Gap: sess.gap})
+
+	go c.run(sess)
+
+	return &c, nil
+}
+
+// Events 返回接收事件的 channel，客户端关闭后 channel 会被关闭
+// 设置了 Options.OnEvent 时返回 nil
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// User 返回握手时使用的身份
+func (c *Client) User() User {
+	return c.opts.User
+}
+
+// Connected 返回当前是否已经连接
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sess != nil
+}
+
+// Encoding 返回当前连接协商的编码，没有连接时返回空字符串
+func (c *Client) Encoding() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sess == nil {
+		return ""
+	}
+	return c.sess.codec.Name
+}
+
+// Send 向用户 to 发送消息
+func (c *Client) Send(ctx context.Context, to uuid.UUID, msg string) error {
+	return c.SendMessage(ctx, InMessage{
+		FromID: c.opts.User.ID,
+		ToID:   to,
+		Msg:    msg,
+	})
+}
+
+// SendMessage 发送消息，FromID 为空时使用自己的 ID
+func (c *Client) SendMessage(ctx context.Context, msg InMessage) error {
+	if msg.FromID == uuid.Nil {
+		msg.FromID = c.opts.User.ID
+	}
+
+	return c.write(ctx, msg)
+}
+
+// Close 正常关闭连接并停止重连，等待后台的 goroutine 退出
+func (c *Client) Close() error {
+	c.cancel()
+
+	// 正常关闭后服务端不再保留断线续传的会话
+	c.mu.Lock()
+	if c.sess != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		c.sess.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.sess.ws.Close()
+	}
+	c.mu.Unlock()
+
+	<-c.done
+
+	return nil
+}
+
+// =============================================================================
+
+// run 读取消息，连接断开后按配置重连，直到客户端关闭
+func (c *Client) run(sess *session) {
+	defer close(c.done)
+	if c.events != nil {
+		defer close(c.events)
+	}
+
+	for {
+		err := c.read(sess)
+		c.setSession(nil)
+		sess.ws.Close()
+
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		reconnect := c.opts.Reconnect && !errors.Is(err, ErrDisconnectedByServer)
+		c.emit(Event{Kind: EventDisconnected, Err: err, Reconnecting: reconnect})
+		if !reconnect {
+			return
+		}
+
+		if sess = c.reconnect(); sess == nil {
+			return
+		}
+
+		c.setSession(sess)
+		c.emit(Event{Kind: EventConnected, Resumed: sess.resumed, Gap: sess.gap})
+	}
+}
+
+// reconnect 按指数退避重连，客户端关闭时返回 nil
+func (c *Client) reconnect() *session {
+	backoff := c.opts.MinBackoff
+	for {
+		// 加上随机抖动，避免服务重启后所有客户端同时重连
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		sess, err := c.dial(c.ctx)
+		if err == nil {
+			return sess
+		}
+
+		if c.ctx.Err() != nil {
+			return nil
+		}
+
+		c.emit(Event{Kind: EventDisconnected, Err: err, Reconnecting: true})
+
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// dial 建立连接并完成握手：HELLO -> {"id","name"} -> WELCOME name
+// 开启 Resume 时握手带上续传 token 和最后收到的序号，WELCOME 之后是服务端的续传结果
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	header := c.opts.Header.Clone()
+	if c.opts.Token != "" {
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	ws, _, err := c.opts.Dialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	sess := session{
+		ws:    ws,
+		codec: codecFor(ws.Subprotocol()),
+	}
+
+	if err := c.handshake(&sess); err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	return &sess, nil
+}
+
+func (c *Client) handshake(sess *session) error {
+	ws := sess.ws
+
+	ws.SetReadDeadline(time.Now().Add(c.opts.HandshakeTimeout))
+	ws.SetWriteDeadline(time.Now().Add(c.opts.HandshakeTimeout))
+	defer ws.SetWriteDeadline(time.Time{})
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read hello: %w", err)
+	}
+	if string(msg) != "HELLO" {
+		return fmt.Errorf("unexpected message: %s", msg)
+	}
+
+	hs := handshake{User: c.opts.User}
+	if c.opts.Resume {
+		c.mu.Lock()
+		hs.Resume = &resumeRequest{Token: c.token, LastSeq: c.lastSeq}
+		c.mu.Unlock()
+	}
+	if err := writeValue(ws, sess.codec, hs); err != nil {
+		return fmt.Errorf("write identity: %w", err)
+	}
+
+	_, msg, err = ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read welcome: %w", err)
+	}
+
+	switch {
+	case strings.HasPrefix(string(msg), "WELCOME"):
+	case string(msg) == "Already connected":
+		return ErrAlreadyConnected
+	default:
+		var f frame
+		if err := sess.codec.Unmarshal(msg, &f); err == nil && f.Error != nil {
+			return fmt.Errorf("handshake: %w", f.Error)
+		}
+		return fmt.Errorf("handshake: unexpected message: %s", msg)
+	}
+
+	if !c.opts.Resume {
+		return nil
+	}
+
+	_, msg, err = ws.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("read resume: %w", err)
+	}
+
+	var f frame
+	if err := sess.codec.Unmarshal(msg, &f); err != nil || f.Resume == nil {
+		return fmt.Errorf("handshake: expected resume, got: %s", msg)
+	}
+
+	// 新的会话的序号从头开始
+	c.mu.Lock()
+	c.token = f.Resume.Token
+	if !f.Resume.Resumed {
+		c.lastSeq = 0
+	}
+	c.mu.Unlock()
+
+	sess.resumed = f.Resume.Resumed
+	sess.gap = f.Resume.Gap
+
+	return nil
+}
+
+// read 读取消息直到连接断开
+// 收到服务端的 ping 时回复 pong 并延长读取的超时时间
+func (c *Client) read(sess *session) error {
+	ws := sess.ws
+	ws.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.ClosePolicyViolation {
+				return fmt.Errorf("%w: %s", ErrDisconnectedByServer, closeErr.Text)
+			}
+			return err
+		}
+
+		ws.SetReadDeadline(time.Now().Add(c.opts.ReadTimeout))
+
+		c.dispatch(sess, data)
+	}
+}
+
+// dispatch 把帧转换为事件，无法解析的帧作为 invalid_frame 错误
+// 带有序号的消息已经收到过时丢弃，重连时服务端可能补发断开前已经收到的消息
+func (c *Client) dispatch(sess *session, data []byte) {
+	e, err := decode(sess.codec, data)
+	if err != nil {
+		c.emit(Event{Kind: EventError, Error: &Error{Code: "invalid_frame", Message: string(data)}})
+		return
+	}
+
+	if e.Kind == EventMessage && e.Message.Seq > 0 {
+		c.mu.Lock()
+		dup := e.Message.Seq <= c.lastSeq
+		if !dup {
+			c.lastSeq = e.Message.Seq
+		}
+		c.mu.Unlock()
+
+		if dup {
+			return
+		}
+	}
+
+	c.emit(e)
+}
+
+// Decode 根据帧的字段把服务端发送的 json 帧转换为 EventMessage、EventError 或者 EventSystem 事件
+// HELLO 和 WELCOME 等握手的文本帧不是 json，返回错误
+func Decode(data []byte) (Event, error) {
+	return decode(wire.JSON, data)
+}
+
+func decode(codec wire.Codec, data []byte) (Event, error) {
+	var f frame
+	if err := codec.Unmarshal(data, &f); err != nil {
+		return Event{}, fmt.Errorf("decode frame: %w", err)
+	}
+
+	switch {
+	case f.Error != nil:
+		return Event{Kind: EventError, Error: f.Error}, nil
+
+	case f.System != "":
+		return Event{Kind: EventSystem, System: &System{System: f.System, At: f.At}}, nil
+
+	case f.From.ID == uuid.Nil:
+		return Event{}, errors.New("decode frame: unknown frame")
+	}
+
+	// frame 的 At 字段覆盖了 Message 中的 At
+	msg := f.Message
+	msg.At = f.At
+	return Event{Kind: EventMessage, Message: &msg}, nil
+}
+
+func (c *Client) emit(e Event) {
+	if c.opts.OnEvent != nil {
+		c.opts.OnEvent(e)
+		return
+	}
+
+	// 客户端关闭后调用方可能已经不再读取
+	select {
+	case c.events <- e:
+	case <-c.ctx.Done():
+	}
+}
+
+// write 按当前连接协商的编码发送 v
+func (c *Client) write(ctx context.Context, v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if c.sess == nil {
+		return ErrNotConnected
+	}
+
+	deadline := time.Now().Add(c.opts.WriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.sess.ws.SetWriteDeadline(deadline)
+
+	if err := writeValue(c.sess.ws, c.sess.codec, v); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) setSession(sess *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sess = sess
+}
+
+// writeValue 按编码写入一个帧，二进制编码使用二进制帧
+func writeValue(ws *websocket.Conn, codec wire.Codec, v any) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	messageType := websocket.TextMessage
+	if codec.Binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	return ws.WriteMessage(messageType, data)
+}
+
+// codecFor 返回服务端选择的子协议对应的编码，服务端没有选择时使用 JSON
+func codecFor(subprotocol string) wire.Codec {
+	if codec, ok := wire.Lookup(strings.TrimPrefix(subprotocol, subprotocolPrefix)); ok && subprotocol != "" {
+		return codec
+	}
+	return wire.JSON
+}
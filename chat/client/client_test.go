@@ -0,0 +1,352 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/zhangpetergo/chat/chat/app/sdk/chattest"
+	"github.com/zhangpetergo/chat/chat/client"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conns 记录客户端建立的 TCP 连接，测试可以直接断开连接模拟网络故障
+type conns struct {
+	mu   sync.Mutex
+	list []net.Conn
+}
+
+func (cs *conns) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.list = append(cs.list, conn)
+
+	return conn, nil
+}
+
+// drop 断开所有的连接，不发送关闭帧
+func (cs *conns) drop() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, conn := range cs.list {
+		conn.Close()
+	}
+	cs.list = nil
+}
+
+func (cs *conns) dialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.NetDialContext = cs.dial
+	return &d
+}
+
+// dial 连接测试服务，测试结束时关闭客户端
+func dial(t *testing.T, srv *chattest.Server, name string, opts client.Options) *client.Client {
+	t.Helper()
+
+	if opts.User.ID == uuid.Nil {
+		opts.User = client.User{ID: uuid.New(), Name: name}
+	}
+
+	c, err := client.Dial(context.Background(), srv.URL, opts)
+	if err != nil {
+		t.Fatalf("dial %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	return c
+}
+
+// next 返回下一个事件，超时或者客户端已经关闭时测试失败
+func next(t *testing.T, c *client.Client, want client.EventKind) client.Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-c.Events():
+		if !ok {
+			t.Fatalf("%s: events closed, want %s", c.User().Name, want)
+		}
+		if e.Kind != want {
+			t.Fatalf("%s: got event %s (err %v), want %s", c.User().Name, e.Kind, e.Err, want)
+		}
+		return e
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s: no event, want %s", c.User().Name, want)
+	}
+
+	return client.Event{}
+}
+
+func sessionOf(t *testing.T, srv *chattest.Server, userID uuid.UUID) uuid.UUID {
+	t.Helper()
+
+	for _, s := range srv.Chat.Sessions() {
+		if s.UserID == userID {
+			return s.SessionID
+		}
+	}
+
+	t.Fatalf("user %s has no session", userID)
+	return uuid.Nil
+}
+
+// =============================================================================
+
+func TestConnectAndSend(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	ctx := context.Background()
+
+	alice := dial(t, srv, "alice", client.Options{})
+	bob := dial(t, srv, "bob", client.Options{})
+	next(t, alice, client.EventConnected)
+	next(t, bob, client.EventConnected)
+	srv.AssertOnline(t, alice.User().ID, bob.User().ID)
+
+	if err := alice.Send(ctx, bob.User().ID, "hi"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg := next(t, bob, client.EventMessage).Message
+	if msg.From.ID != alice.User().ID || msg.To.ID != bob.User().ID || msg.Msg != "hi" {
+		t.Errorf("got message %+v", msg)
+	}
+
+	if err := bob.Send(ctx, alice.User().ID, "hello"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := next(t, alice, client.EventMessage).Message.Msg; got != "hello" {
+		t.Errorf("got message %q, want hello", got)
+	}
+
+	// 接收者不在线
+	if err := alice.Send(ctx, uuid.New(), "hi"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := next(t, alice, client.EventError).Error.Code; got != "failed_precondition" {
+		t.Errorf("got error %q, want failed_precondition", got)
+	}
+
+	// 正常关闭后服务端移除会话，客户端不能再发送
+	bob.Close()
+	srv.AssertOffline(t, bob.User().ID)
+	if err := bob.Send(ctx, alice.User().ID, "hi"); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("send after close: got %v, want %v", err, client.ErrClosed)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	for _, enc := range []string{"json", "msgpack", "cbor"} {
+		t.Run(enc, func(t *testing.T) {
+			srv := chattest.New(t, chattest.Config{})
+			ctx := context.Background()
+
+			alice := srv.Connect(t, "alice")
+			bob := dial(t, srv, "bob", client.Options{Encoding: enc})
+			next(t, bob, client.EventConnected)
+
+			if got := bob.Encoding(); got != enc {
+				t.Errorf("encoding: got %q, want %q", got, enc)
+			}
+
+			// 另一端使用 JSON，服务端按各自协商的编码发送
+			alice.Send(bob.User().ID, "hi")
+			if got := next(t, bob, client.EventMessage).Message; got.Msg != "hi" || got.From.ID != alice.ID {
+				t.Errorf("got message %+v", got)
+			}
+
+			if err := bob.Send(ctx, alice.ID, "héllo"); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			alice.ExpectMessage(bob.User().ID, "héllo")
+
+			if err := bob.Send(ctx, uuid.New(), "hi"); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if got := next(t, bob, client.EventError).Error.Code; got != "failed_precondition" {
+				t.Errorf("got error %q, want failed_precondition", got)
+			}
+		})
+	}
+
+	if _, err := client.Dial(context.Background(), "ws://127.0.0.1:1/connect", client.Options{
+		User:     client.User{ID: uuid.New(), Name: "bob"},
+		Encoding: "xml",
+	}); err == nil {
+		t.Error("dial with an unknown encoding: expected an error")
+	}
+}
+
+func TestAlreadyConnected(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	bob := srv.Connect(t, "bob")
+
+	_, err := client.Dial(context.Background(), srv.URL, client.Options{
+		User: client.User{ID: bob.ID, Name: "bob"},
+	})
+	if !errors.Is(err, client.ErrAlreadyConnected) {
+		t.Fatalf("dial: got %v, want %v", err, client.ErrAlreadyConnected)
+	}
+}
+
+func TestToken(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	aliceID := uuid.New()
+	alice := dial(t, srv, "alice", client.Options{
+		User:  client.User{ID: aliceID, Name: "alice"},
+		Token: srv.Token(t, aliceID),
+	})
+	next(t, alice, client.EventConnected)
+	srv.AssertOnline(t, aliceID)
+
+	// 服务端校验 token，ID 与 token 的用户不一致时握手失败
+	_, err := client.Dial(context.Background(), srv.URL, client.Options{
+		User:  client.User{ID: uuid.New(), Name: "mallory"},
+		Token: srv.Token(t, aliceID),
+	})
+	if err == nil {
+		t.Fatal("dial with another user's token: expected an error")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+	ctx := context.Background()
+
+	var cs conns
+	alice := srv.Connect(t, "alice")
+	bob := dial(t, srv, "bob", client.Options{
+		Dialer:     cs.dialer(),
+		Reconnect:  true,
+		MinBackoff: 200 * time.Millisecond,
+	})
+	next(t, bob, client.EventConnected)
+
+	cs.drop()
+	if e := next(t, bob, client.EventDisconnected); !e.Reconnecting {
+		t.Errorf("disconnected: got reconnecting false, want true (err %v)", e.Err)
+	}
+	srv.AssertOffline(t, bob.User().ID)
+	if err := bob.Send(ctx, alice.ID, "hi"); !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("send while reconnecting: got %v, want %v", err, client.ErrNotConnected)
+	}
+
+	// 没有开启断线续传，断开期间的消息不会投递
+	alice.Send(bob.User().ID, "lost")
+	alice.ExpectError("failed_precondition")
+
+	if e := next(t, bob, client.EventConnected); e.Resumed {
+		t.Error("connected: got resumed true, want false")
+	}
+	srv.AssertOnline(t, bob.User().ID)
+
+	alice.Send(bob.User().ID, "again")
+	if got := next(t, bob, client.EventMessage).Message.Msg; got != "again" {
+		t.Errorf("got message %q, want again", got)
+	}
+
+	if err := bob.Send(ctx, alice.ID, "back"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	alice.ExpectMessage(bob.User().ID, "back")
+}
+
+func TestResume(t *testing.T) {
+	for _, enc := range []string{"json", "msgpack"} {
+		t.Run(enc, func(t *testing.T) {
+			srv := chattest.New(t, chattest.Config{})
+
+			var cs conns
+			alice := srv.Connect(t, "alice")
+			bob := dial(t, srv, "bob", client.Options{
+				Dialer:     cs.dialer(),
+				Encoding:   enc,
+				Reconnect:  true,
+				Resume:     true,
+				MinBackoff: 200 * time.Millisecond,
+			})
+			if e := next(t, bob, client.EventConnected); e.Resumed {
+				t.Error("first connect: got resumed true, want false")
+			}
+
+			alice.Send(bob.User().ID, "one")
+			if got := next(t, bob, client.EventMessage).Message; got.Msg != "one" || got.Seq != 1 {
+				t.Errorf("got message %q seq %d, want one seq 1", got.Msg, got.Seq)
+			}
+
+			cs.drop()
+			next(t, bob, client.EventDisconnected)
+			srv.AssertOffline(t, bob.User().ID)
+
+			// 断开期间的消息放入缓冲区，发送者不会收到错误
+			alice.Send(bob.User().ID, "two")
+			alice.Send(bob.User().ID, "three")
+			alice.ExpectNothing(50 * time.Millisecond)
+
+			if e := next(t, bob, client.EventConnected); !e.Resumed || e.Gap {
+				t.Errorf("reconnect: got resumed %v gap %v, want resumed without a gap", e.Resumed, e.Gap)
+			}
+
+			for i, want := range []string{"two", "three"} {
+				got := next(t, bob, client.EventMessage).Message
+				if got.Msg != want || got.Seq != uint64(i+2) {
+					t.Errorf("replayed message %d: got %q seq %d, want %q seq %d", i, got.Msg, got.Seq, want, i+2)
+				}
+			}
+
+			// 补发之后的消息继续使用同一个序列
+			alice.Send(bob.User().ID, "four")
+			if got := next(t, bob, client.EventMessage).Message; got.Msg != "four" || got.Seq != 4 {
+				t.Errorf("got message %q seq %d, want four seq 4", got.Msg, got.Seq)
+			}
+		})
+	}
+}
+
+func TestKick(t *testing.T) {
+	srv := chattest.New(t, chattest.Config{})
+
+	alice := srv.Connect(t, "alice")
+	bob := dial(t, srv, "bob", client.Options{
+		Reconnect: true,
+		Resume:    true,
+	})
+	next(t, bob, client.EventConnected)
+
+	if err := srv.Chat.Kick(context.Background(), sessionOf(t, srv, bob.User().ID), "spam"); err != nil {
+		t.Fatalf("kick: %v", err)
+	}
+
+	// 被踢下线不会重连
+	e := next(t, bob, client.EventDisconnected)
+	if !errors.Is(e.Err, client.ErrDisconnectedByServer) || e.Reconnecting {
+		t.Errorf("disconnected: got err %v reconnecting %v, want %v without reconnecting", e.Err, e.Reconnecting, client.ErrDisconnectedByServer)
+	}
+
+	select {
+	case e, ok := <-bob.Events():
+		if ok {
+			t.Errorf("got event %s after kick, want events closed", e.Kind)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("events were not closed after kick")
+	}
+
+	// 被踢下线后不保留断线续传的会话
+	srv.AssertOffline(t, bob.User().ID)
+	alice.Send(bob.User().ID, "hi")
+	alice.ExpectError("failed_precondition")
+}
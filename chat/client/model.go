@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// User 用户的身份，握手时发送给服务端
+type User struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+// InMessage 客户端发送给服务端的消息
+type InMessage struct {
+	FromID uuid.UUID `json:"fromID"`
+	ToID   uuid.UUID `json:"toID"`
+	Msg    string    `json:"msg"`
+	// Traceparent 可选的 W3C Trace Context，服务端路由消息的 span 会成为它的子 span
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// Message 服务端转发给客户端的消息
+type Message struct {
+	From User   `json:"from"`
+	To   User   `json:"to"`
+	Msg  string `json:"msg"`
+	// At 服务端路由消息的时间
+	At time.Time `json:"at"`
+	// Muted 接收者对该会话开启了免打扰
+	Muted bool `json:"muted,omitempty"`
+	// Traceparent 服务端路由消息的 span
+	Traceparent string `json:"traceparent,omitempty"`
+	// Seq 开启断线续传时消息的序号，重连后补发的消息序号连续递增
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// Error 服务端发送的错误帧，比如消息格式不正确或者接收者不在线
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Reason 比 Code 更具体的原因，比如 rate_limited
+	Reason string `json:"reason,omitempty"`
+	// Fields 校验失败的字段
+	Fields []FieldError `json:"fields,omitempty"`
+	// RetryAfter 建议等待多少秒之后重试
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// FieldError 单个字段的校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// System 服务端发送的系统公告
+type System struct {
+	System string    `json:"system"`
+	At     time.Time `json:"at"`
+}
+
+// frame 服务端发送的 json 帧，根据字段区分类型
+type frame struct {
+	Message
+	Error  *Error    `json:"error"`
+	System string    `json:"system"`
+	At     time.Time `json:"at"`
+	Resume *resume   `json:"resume"`
+}
+
+// handshake 握手时发送的身份，Resume 不为 nil 时请求断线续传
+type handshake struct {
+	User
+	Resume *resumeRequest `json:"resume,omitempty"`
+}
+
+type resumeRequest struct {
+	Token   uuid.UUID `json:"token"`
+	LastSeq uint64    `json:"lastSeq"`
+}
+
+// resume 请求断线续传时服务端紧跟在 WELCOME 之后发送
+type resume struct {
+	Token   uuid.UUID `json:"token"`
+	Resumed bool      `json:"resumed"`
+	Gap     bool      `json:"gap"`
+}
+
+// =============================================================================
+
+// EventKind 事件的类型
+type EventKind int
+
+const (
+	// EventConnected 握手成功，包括重连成功
+	EventConnected EventKind = iota + 1
+	// EventDisconnected 连接断开，Err 为断开的原因
+	EventDisconnected
+	// EventMessage 收到消息
+	EventMessage
+	// EventError 收到错误帧
+	EventError
+	// EventSystem 收到系统公告
+	EventSystem
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventMessage:
+		return "message"
+	case EventError:
+		return "error"
+	case EventSystem:
+		return "system"
+	}
+	return "unknown"
+}
+
+// Event 连接上发生的事件，根据 Kind 只有一个字段有值
+type Event struct {
+	Kind    EventKind
+	Message *Message
+	Error   *Error
+	System  *System
+	// Err 连接断开的原因
+	Err error
+	// Reconnecting 连接断开后是否会自动重连
+	Reconnecting bool
+	// Resumed 重连时恢复了之前的会话，断开期间的消息随后补发，只在开启 Options.Resume 时设置
+	Resumed bool
+	// Gap 服务端的缓冲区已经丢弃了一部分断开期间的消息
+	Gap bool
+}
@@ -0,0 +1,136 @@
+// Package certs 读取 TLS 证书，证书文件更新后可以在不重启服务的情况下重新读取
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Reloader 保存当前使用的服务端证书和用于校验客户端证书的 CA
+// Reload 只影响之后的 TLS 握手，已经建立的连接不受影响
+type Reloader struct {
+	certFile   string
+	keyFile    string
+	clientCA   string
+	clientAuth tls.ClientAuthType
+
+	current atomic.Pointer[state]
+}
+
+type state struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// New 读取证书和私钥，clientCAFile 为空时不校验客户端证书
+func New(certFile, keyFile, clientCAFile string, clientAuth tls.ClientAuthType) (*Reloader, error) {
+	r := Reloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		clientCA:   clientCAFile,
+		clientAuth: clientAuth,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Files 返回需要监听变化的文件
+func (r *Reloader) Files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCA != "" {
+		files = append(files, r.clientCA)
+	}
+	return files
+}
+
+// Reload 重新读取证书、私钥和 CA，读取失败时继续使用原来的证书
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	// 提前解析证书，GetCertificate 和日志中都会用到
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parse certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	s := state{cert: &cert}
+
+	if r.clientCA != "" {
+		pool, err := loadPool(r.clientCA)
+		if err != nil {
+			return err
+		}
+		s.clientCAs = pool
+	}
+
+	r.current.Store(&s)
+
+	return nil
+}
+
+// Leaf 返回当前使用的服务端证书
+func (r *Reloader) Leaf() *x509.Certificate {
+	return r.current.Load().cert.Leaf
+}
+
+// TLSConfig 返回 http.Server 使用的配置，每次握手时使用最新读取的证书和 CA
+// 只使用 HTTP/1.1，websocket 升级需要 Hijack，HTTP/2 的连接不支持
+func (r *Reloader) TLSConfig() *tls.Config {
+	return r.tlsConfig("http/1.1")
+}
+
+// GRPCTLSConfig 返回 gRPC 服务使用的配置，与 TLSConfig 使用同样的证书和 CA，ALPN 协商 h2
+func (r *Reloader) GRPCTLSConfig() *tls.Config {
+	return r.tlsConfig("h2")
+}
+
+func (r *Reloader) tlsConfig(nextProtos ...string) *tls.Config {
+	base := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		s := r.current.Load()
+
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*s.cert}
+		if s.clientCAs != nil {
+			c.ClientCAs = s.clientCAs
+			c.ClientAuth = r.clientAuth
+		}
+
+		return c, nil
+	}
+
+	return cfg
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client ca: no certificates found")
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,268 @@
+// Package clock 抽象当前时间和定时器，测试时可以使用 Fake 控制时间的流逝
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock 提供当前时间和定时器
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc 与 time.AfterFunc 相同，d 之后在新的 goroutine 中调用 f
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker 与 time.Ticker 相同，C 是一个方法以便 Fake 实现
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	// Reset 停止 Ticker 并按新的间隔重新开始计时
+	Reset(d time.Duration)
+}
+
+// Timer AfterFunc 返回的定时器
+type Timer interface {
+	// Stop 取消还没有触发的定时器，已经触发或者已经取消时返回 false
+	Stop() bool
+}
+
+// Since 返回 clk 的当前时间距离 t 的时间
+func Since(clk Clock, t time.Time) time.Duration {
+	return clk.Now().Sub(t)
+}
+
+// WithTimeout 与 context.WithTimeout 相同，但是由 clk 决定什么时候超时
+// 超时后 context.Cause 返回 context.DeadlineExceeded
+func WithTimeout(parent context.Context, clk Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clk.(Real); ok {
+		return context.WithTimeout(parent, d)
+	}
+
+	ctx, cancel := context.WithCancelCause(parent)
+	t := clk.AfterFunc(d, func() {
+		cancel(context.DeadlineExceeded)
+	})
+
+	return ctx, func() {
+		t.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// =============================================================================
+
+// Real 使用系统时间
+type Real struct{}
+
+// Now 返回 time.Now()
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker 返回 time.NewTicker 创建的 Ticker
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{t: time.NewTicker(d)}
+}
+
+// AfterFunc 返回 time.AfterFunc 创建的定时器
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
+
+func (r realTicker) Reset(d time.Duration) {
+	r.t.Reset(d)
+}
+
+// =============================================================================
+
+// Fake 只有调用 Advance 时时间才会前进，可以并发使用
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake 创建一个从 now 开始的 Fake
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now: now,
+	}
+}
+
+// Now 返回 Fake 的当前时间
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// NewTicker 创建一个按 Fake 的时间触发的 Ticker
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	t := f.add(&fakeTimer{
+		c:        make(chan time.Time, 1),
+		interval: d,
+	}, d)
+
+	return fakeTicker{t: t}
+}
+
+// AfterFunc 创建一个按 Fake 的时间触发的定时器，回调在 Advance 中调用
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.add(&fakeTimer{fn: fn}, d)
+}
+
+func (f *Fake) add(t *fakeTimer, d time.Duration) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t.fake = f
+	t.next = f.now.Add(d)
+	f.timers = append(f.timers, t)
+
+	return t
+}
+
+// Advance 让时间前进 d，按时间顺序触发期间到期的 Ticker 和定时器
+// 与 time.Ticker 相同，接收方来不及读取时多余的触发会被丢弃
+// AfterFunc 的回调在 Advance 中按到期顺序依次调用，调用时 Now 返回到期的时间，Advance 返回时回调都已经执行完毕
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	f.mu.Unlock()
+
+	for f.step(end) {
+	}
+}
+
+// step 触发一个在 end 之前到期的 Ticker 或者定时器，没有到期的时把时间设置为 end 并返回 false
+// 调用回调时不持有锁，回调中可以使用 Fake
+func (f *Fake) step(end time.Time) bool {
+	f.mu.Lock()
+
+	t := f.earliest()
+	if t == nil || t.next.After(end) {
+		if end.After(f.now) {
+			f.now = end
+		}
+		f.mu.Unlock()
+		return false
+	}
+
+	f.now = t.next
+
+	if t.fn != nil {
+		f.remove(t)
+		f.mu.Unlock()
+
+		t.fn()
+		return true
+	}
+
+	select {
+	case t.c <- t.next:
+	default:
+	}
+	t.next = t.next.Add(t.interval)
+	f.mu.Unlock()
+
+	return true
+}
+
+// Timers 返回还没有停止的 Ticker 和定时器的数量，测试可以用它等待后台任务启动
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.timers)
+}
+
+// earliest 返回最早到期的定时器，调用方需要持有锁
+func (f *Fake) earliest() *fakeTimer {
+	var first *fakeTimer
+	for _, t := range f.timers {
+		if first == nil || t.next.Before(first.next) {
+			first = t
+		}
+	}
+	return first
+}
+
+// remove 移除定时器，定时器不存在时返回 false，调用方需要持有锁
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, ft := range f.timers {
+		if ft == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer Fake 的 Ticker 和定时器，fn 不为 nil 时是 AfterFunc 创建的一次性定时器
+type fakeTimer struct {
+	fake     *Fake
+	next     time.Time
+	c        chan time.Time
+	interval time.Duration
+	fn       func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+
+	return t.fake.remove(t)
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (ft fakeTicker) C() <-chan time.Time {
+	return ft.t.c
+}
+
+func (ft fakeTicker) Stop() {
+	ft.t.Stop()
+}
+
+func (ft fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("clock: non-positive interval for Ticker.Reset")
+	}
+
+	f := ft.t.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ft.t.interval = d
+	ft.t.next = f.now.Add(d)
+
+	// 与 time.Ticker 相同，已经停止的 Ticker 调用 Reset 后重新开始
+	for _, t := range f.timers {
+		if t == ft.t {
+			return
+		}
+	}
+	f.timers = append(f.timers, ft.t)
+}
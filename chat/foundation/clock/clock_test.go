@@ -0,0 +1,206 @@
+package clock_test
+
+import (
+	"context"
+	"errors"
+	"github.com/zhangpetergo/chat/chat/foundation/clock"
+	"slices"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeAfterFuncOrder(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	var fired []string
+	var at []time.Time
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name)
+			at = append(at, fake.Now())
+		}
+	}
+
+	// 创建的顺序与到期的顺序不同
+	fake.AfterFunc(3*time.Second, record("c"))
+	fake.AfterFunc(time.Second, record("a"))
+	fake.AfterFunc(2*time.Second, record("b"))
+	fake.AfterFunc(10*time.Second, record("late"))
+
+	fake.Advance(5 * time.Second)
+
+	if want := []string{"a", "b", "c"}; !slices.Equal(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+
+	// 回调执行时时间停在到期的时刻
+	for i, d := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if want := start.Add(d); !at[i].Equal(want) {
+			t.Errorf("%s: now %s, want %s", fired[i], at[i], want)
+		}
+	}
+
+	if got, want := fake.Now(), start.Add(5*time.Second); !got.Equal(want) {
+		t.Errorf("now %s, want %s", got, want)
+	}
+	if got := fake.Timers(); got != 1 {
+		t.Errorf("timers %d, want 1", got)
+	}
+}
+
+func TestFakeAfterFuncNested(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	var fired []time.Time
+	fake.AfterFunc(time.Second, func() {
+		fired = append(fired, fake.Now())
+
+		// 回调中创建的定时器在同一次 Advance 中到期时也会触发
+		fake.AfterFunc(time.Second, func() {
+			fired = append(fired, fake.Now())
+		})
+	})
+
+	fake.Advance(3 * time.Second)
+
+	want := []time.Time{start.Add(time.Second), start.Add(2 * time.Second)}
+	if !slices.EqualFunc(fired, want, time.Time.Equal) {
+		t.Fatalf("fired at %v, want %v", fired, want)
+	}
+}
+
+func TestFakeTimerStop(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	var fired int
+	timer := fake.AfterFunc(time.Second, func() { fired++ })
+
+	if !timer.Stop() {
+		t.Fatal("first Stop returned false, want true")
+	}
+	if timer.Stop() {
+		t.Fatal("second Stop returned true, want false")
+	}
+
+	fake.Advance(time.Minute)
+	if fired != 0 {
+		t.Fatalf("stopped timer fired %d times", fired)
+	}
+
+	timer = fake.AfterFunc(time.Second, func() { fired++ })
+	fake.Advance(time.Second)
+	if fired != 1 {
+		t.Fatalf("timer fired %d times, want 1", fired)
+	}
+	if timer.Stop() {
+		t.Fatal("Stop after firing returned true, want false")
+	}
+	if got := fake.Timers(); got != 0 {
+		t.Fatalf("timers %d, want 0", got)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	ticker := fake.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	expectNoTick(t, ticker)
+
+	fake.Advance(10 * time.Second)
+	expectTick(t, ticker, start.Add(10*time.Second))
+	expectNoTick(t, ticker)
+
+	// 跨越多个周期时只保留第一次触发，与 time.Ticker 相同
+	fake.Advance(35 * time.Second)
+	expectTick(t, ticker, start.Add(20*time.Second))
+	expectNoTick(t, ticker)
+
+	// 下一次触发仍然在周期的整数倍上
+	fake.Advance(4 * time.Second)
+	expectNoTick(t, ticker)
+	fake.Advance(time.Second)
+	expectTick(t, ticker, start.Add(50*time.Second))
+}
+
+func TestFakeTickerStopReset(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	ticker := fake.NewTicker(10 * time.Second)
+
+	fake.Advance(5 * time.Second)
+	ticker.Reset(time.Second)
+
+	// Reset 从当前时间重新开始计时
+	fake.Advance(time.Second)
+	expectTick(t, ticker, start.Add(6*time.Second))
+
+	ticker.Stop()
+	fake.Advance(time.Minute)
+	expectNoTick(t, ticker)
+	if got := fake.Timers(); got != 0 {
+		t.Fatalf("timers %d after Stop, want 0", got)
+	}
+
+	// 已经停止的 Ticker 调用 Reset 后重新开始
+	ticker.Reset(2 * time.Second)
+	fake.Advance(2 * time.Second)
+	expectTick(t, ticker, start.Add(68*time.Second))
+	if got := fake.Timers(); got != 1 {
+		t.Fatalf("timers %d after Reset, want 1", got)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	fake := clock.NewFake(start)
+
+	ctx, cancel := clock.WithTimeout(context.Background(), fake, time.Second)
+	defer cancel()
+
+	fake.Advance(999 * time.Millisecond)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("context done before the timeout: %v", err)
+	}
+
+	fake.Advance(time.Millisecond)
+	if err := context.Cause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cause %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = clock.WithTimeout(context.Background(), fake, time.Second)
+	cancel()
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cause %v, want %v", err, context.Canceled)
+	}
+	if got := fake.Timers(); got != 0 {
+		t.Fatalf("timers %d after cancel, want 0", got)
+	}
+}
+
+// =============================================================================
+
+func expectTick(t *testing.T, ticker clock.Ticker, want time.Time) {
+	t.Helper()
+
+	select {
+	case got := <-ticker.C():
+		if !got.Equal(want) {
+			t.Fatalf("tick at %s, want %s", got, want)
+		}
+	default:
+		t.Fatalf("no tick, want %s", want)
+	}
+}
+
+func expectNoTick(t *testing.T, ticker clock.Ticker) {
+	t.Helper()
+
+	select {
+	case got := <-ticker.C():
+		t.Fatalf("unexpected tick at %s", got)
+	default:
+	}
+}
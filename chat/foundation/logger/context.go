@@ -0,0 +1,37 @@
+package logger
+
+import (
+	"context"
+	"go.uber.org/zap"
+)
+
+type ctxKey int
+
+const logKey ctxKey = 1
+
+// NewContext 把 logger 放入 context，后续通过 FromContext 获取
+// 一般存放已经带有 traceID、用户 ID 等字段的子 logger
+func NewContext(ctx context.Context, log *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, logKey, log)
+}
+
+// FromContext 返回 context 中的 logger，不存在时返回不输出任何内容的 logger
+// 所以请求和后台任务的入口都需要通过 NewContext 放入注入的 logger
+func FromContext(ctx context.Context) *zap.SugaredLogger {
+	if log, ok := ctx.Value(logKey).(*zap.SugaredLogger); ok {
+		return log
+	}
+
+	return zap.NewNop().Sugar()
+}
+
+// ForComponent 返回 context 中标记为指定组件的 logger，组件可以通过 Levels 单独设置日志级别
+// 已经是该组件的 logger 不会重复命名
+func ForComponent(ctx context.Context, component string) *zap.SugaredLogger {
+	log := FromContext(ctx)
+	if log.Desugar().Name() == component {
+		return log
+	}
+
+	return log.Named(component)
+}
@@ -1,13 +1,14 @@
 package logger
 
 import (
+	"go.uber.org/zap"
 	"runtime/debug"
 	"strconv"
 	"strings"
 )
 
 // BuildInfo logs information stored inside the Go binary.
-func BuildInfo() {
+func BuildInfo(log *zap.SugaredLogger) {
 	var values []any
 
 	info, _ := debug.ReadBuildInfo()
@@ -29,7 +30,26 @@ func BuildInfo() {
 	values = append(values, "goversion", info.GoVersion)
 	values = append(values, "modversion", info.Main.Version)
 
-	Log.Infow("build info", values...)
+	log.Infow("build info", values...)
+}
+
+// Build returns the information stored inside the Go binary as key/value pairs.
+func Build() map[string]string {
+	m := make(map[string]string)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return m
+	}
+
+	for _, s := range info.Settings {
+		m[s.Key] = s.Value
+	}
+
+	m["goversion"] = info.GoVersion
+	m["modversion"] = info.Main.Version
+
+	return m
 }
 
 // quoteKey reports whether key is required to be quoted.
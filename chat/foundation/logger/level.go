@@ -0,0 +1,216 @@
+package logger
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync"
+)
+
+// Levels 保存全局日志级别以及各个组件的日志级别，可以在运行时修改
+// 组件通过 logger 的名字区分，比如 log.Named("chat")，没有单独设置级别的组件使用全局级别
+type Levels struct {
+	global zap.AtomicLevel
+
+	mu         sync.RWMutex
+	components map[string]zap.AtomicLevel
+}
+
+// NewLevels 创建 Levels，components 的 key 是组件名，value 是日志级别
+func NewLevels(global string, components map[string]string) (*Levels, error) {
+	l := Levels{
+		global:     zap.NewAtomicLevel(),
+		components: make(map[string]zap.AtomicLevel),
+	}
+
+	if err := l.Set(global, components); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+// ValidateLevels 校验全局级别和各个组件的级别，不修改任何 Levels
+func ValidateLevels(global string, components map[string]string) error {
+	_, _, err := parseLevels(global, components)
+	return err
+}
+
+// Set 替换全局级别和所有组件的级别，用于重新加载配置，级别不合法时保持原来的级别
+func (l *Levels) Set(global string, components map[string]string) error {
+	g, m, err := parseLevels(global, components)
+	if err != nil {
+		return err
+	}
+
+	l.global.SetLevel(g)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.components = m
+
+	return nil
+}
+
+// SetLevel 修改单个组件的级别，component 为空时修改全局级别
+// 组件的 level 为空时删除该组件的级别，之后使用全局级别
+func (l *Levels) SetLevel(component string, level string) error {
+	component = strings.ToLower(component)
+
+	if component == "" {
+		lvl, err := parseLevel(level)
+		if err != nil {
+			return err
+		}
+		l.global.SetLevel(lvl)
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level == "" {
+		delete(l.components, component)
+		return nil
+	}
+
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	if al, exists := l.components[component]; exists {
+		al.SetLevel(lvl)
+		return nil
+	}
+
+	l.components[component] = zap.NewAtomicLevelAt(lvl)
+
+	return nil
+}
+
+// Snapshot 返回当前的全局级别和各个组件的级别
+func (l *Levels) Snapshot() (string, map[string]string) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	m := make(map[string]string, len(l.components))
+	for name, al := range l.components {
+		m[name] = al.String()
+	}
+
+	return l.global.String(), m
+}
+
+// Enabled 判断组件是否需要记录该级别的日志
+// name 是 logger 的名字，只使用第一段作为组件名，比如 chat.ping 属于 chat 组件
+func (l *Levels) Enabled(name string, level zapcore.Level) bool {
+	component, _, _ := strings.Cut(name, ".")
+
+	l.mu.RLock()
+	al, exists := l.components[component]
+	l.mu.RUnlock()
+
+	if exists {
+		return al.Enabled(level)
+	}
+
+	return l.global.Enabled(level)
+}
+
+// minEnabled 判断是否有任意一个组件需要记录该级别的日志
+func (l *Levels) minEnabled(level zapcore.Level) bool {
+	if l.global.Enabled(level) {
+		return true
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, al := range l.components {
+		if al.Enabled(level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseLevels(global string, components map[string]string) (zapcore.Level, map[string]zap.AtomicLevel, error) {
+	g, err := parseLevel(global)
+	if err != nil {
+		return g, nil, err
+	}
+
+	m := make(map[string]zap.AtomicLevel, len(components))
+	for name, level := range components {
+		lvl, err := parseLevel(level)
+		if err != nil {
+			return g, nil, fmt.Errorf("component %s: %w", name, err)
+		}
+		m[strings.ToLower(name)] = zap.NewAtomicLevelAt(lvl)
+	}
+
+	return g, m, nil
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("parse level %q: %w", level, err)
+	}
+
+	return lvl, nil
+}
+
+// =============================================================================
+
+// levelCore 根据 logger 的名字使用对应组件的级别过滤日志
+type levelCore struct {
+	zapcore.Core
+	levels *Levels
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.levels.minEnabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{
+		Core:   c.Core.With(fields),
+		levels: c.levels,
+	}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.Enabled(ent.LoggerName, ent.Level) {
+		return ce
+	}
+
+	return c.Core.Check(ent, ce)
+}
+
+// sampledCore 只对指定的日志消息采样，其它日志全部记录
+type sampledCore struct {
+	zapcore.Core
+	sampled  zapcore.Core
+	messages map[string]struct{}
+}
+
+func (c *sampledCore) With(fields []zapcore.Field) zapcore.Core {
+	return &sampledCore{
+		Core:     c.Core.With(fields),
+		sampled:  c.sampled.With(fields),
+		messages: c.messages,
+	}
+}
+
+func (c *sampledCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if _, exists := c.messages[ent.Message]; exists {
+		return c.sampled.Check(ent, ce)
+	}
+
+	return c.Core.Check(ent, ce)
+}
@@ -0,0 +1,200 @@
+package logger_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/zhangpetergo/chat/chat/foundation/logger"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type entry struct {
+	Level  string `json:"level"`
+	Logger string `json:"logger"`
+	Msg    string `json:"msg"`
+}
+
+// newLogger 创建写入 JSON 文件的 logger，返回读取日志的函数
+// error 级别的日志在单独的文件中，读取时排在其他级别之后
+func newLogger(t *testing.T, cfg logger.Config) (*zap.SugaredLogger, func() []entry) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg.Encoding = "json"
+	cfg.InfoFile = filepath.Join(dir, "info.json")
+	cfg.ErrorFile = filepath.Join(dir, "error.json")
+
+	log, err := logger.New(cfg)
+	if err != nil {
+		t.Fatalf("new logger: %v", err)
+	}
+
+	read := func() []entry {
+		t.Helper()
+		log.Sync()
+
+		return append(readFile(t, cfg.InfoFile), readFile(t, cfg.ErrorFile)...)
+	}
+
+	return log, read
+}
+
+func readFile(t *testing.T, file string) []entry {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer f.Close()
+
+	var entries []entry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("decode %q: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// logged 返回 logger 名字为 name 的日志消息
+func logged(entries []entry, name string) []string {
+	var msgs []string
+	for _, e := range entries {
+		if e.Logger == name {
+			msgs = append(msgs, e.Msg)
+		}
+	}
+	return msgs
+}
+
+func levels(t *testing.T, global string, components map[string]string) *logger.Levels {
+	t.Helper()
+
+	l, err := logger.NewLevels(global, components)
+	if err != nil {
+		t.Fatalf("new levels: %v", err)
+	}
+	return l
+}
+
+// logAll 在每个级别记录一条消息，消息就是级别的名字
+func logAll(log *zap.SugaredLogger) {
+	log.Debug("debug")
+	log.Info("info")
+	log.Warn("warn")
+	log.Error("error")
+}
+
+// =============================================================================
+
+func TestComponentLevels(t *testing.T) {
+	lv := levels(t, "info", map[string]string{
+		"chat": "debug",
+		"mid":  "error",
+	})
+	log, read := newLogger(t, logger.Config{Levels: lv})
+
+	logAll(log)
+	logAll(log.Named("chat"))
+	// 组件名只使用第一段，chat.ping 属于 chat 组件
+	logAll(log.Named("chat").Named("ping"))
+	logAll(log.Named("mid"))
+	logAll(log.Named("other"))
+
+	entries := read()
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"", []string{"info", "warn", "error"}},
+		{"chat", []string{"debug", "info", "warn", "error"}},
+		{"chat.ping", []string{"debug", "info", "warn", "error"}},
+		{"mid", []string{"error"}},
+		{"other", []string{"info", "warn", "error"}},
+	}
+	for _, tt := range tests {
+		if got := logged(entries, tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("logger %q: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveOverride(t *testing.T) {
+	lv := levels(t, "warn", map[string]string{
+		"chat": "debug",
+		"mid":  "error",
+	})
+	log, read := newLogger(t, logger.Config{Levels: lv})
+
+	// SetLevel 的级别为空时删除单个组件的级别
+	if err := lv.SetLevel("chat", ""); err != nil {
+		t.Fatalf("set level: %v", err)
+	}
+	logAll(log.Named("chat"))
+
+	// Set 替换所有组件的级别，没有出现的组件使用全局级别
+	if err := lv.Set("info", nil); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	logAll(log.Named("mid"))
+
+	entries := read()
+	if got, want := logged(entries, "chat"), []string{"warn", "error"}; !slices.Equal(got, want) {
+		t.Errorf("chat after SetLevel: got %v, want %v", got, want)
+	}
+	if got, want := logged(entries, "mid"), []string{"info", "warn", "error"}; !slices.Equal(got, want) {
+		t.Errorf("mid after Set: got %v, want %v", got, want)
+	}
+
+	if _, m := lv.Snapshot(); len(m) != 0 {
+		t.Errorf("snapshot: got components %v, want none", m)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	lv := levels(t, "info", map[string]string{"chat": "info"})
+	log, read := newLogger(t, logger.Config{
+		Levels:           lv,
+		SampleMessages:   []string{"ping"},
+		SampleInitial:    2,
+		SampleThereafter: 100,
+	})
+
+	// 被级别过滤的日志不进入采样计数
+	for range 10 {
+		log.Named("chat").Debug("ping")
+	}
+	for range 10 {
+		log.Named("chat").Info("ping")
+		log.Named("chat").Info("pong")
+	}
+
+	var pings, pongs int
+	for _, m := range logged(read(), "chat") {
+		switch m {
+		case "ping":
+			pings++
+		case "pong":
+			pongs++
+		}
+	}
+
+	// 同一个 tick 内只记录前 SampleInitial 条，没有采样的消息全部记录
+	if pings != 2 {
+		t.Errorf("ping: got %d entries, want 2", pings)
+	}
+	if pongs != 10 {
+		t.Errorf("pong: got %d entries, want 10", pongs)
+	}
+}
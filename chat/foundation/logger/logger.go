@@ -2,117 +2,137 @@
 package logger
 
 import (
+	"errors"
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
+	"time"
 )
 
-// Logger 及其需要性能的时候使用 logger，logger只支持结构化记录
-var Logger *zap.Logger
+// Config 日志的配置
+type Config struct {
+	// Levels 全局以及各个组件的日志级别，可以在运行时修改，为 nil 时使用 info 级别
+	Levels *Levels
+	// Encoding 日志的编码格式：console 或者 json
+	Encoding string
+	// Stdout 是否输出到标准输出，容器中一般只输出到标准输出
+	Stdout bool
+	// InfoFile 低于 error 级别的日志文件，为空时不写文件
+	InfoFile string
+	// ErrorFile 高于等于 error 级别的日志文件，为空时不写文件
+	ErrorFile string
+	// MaxSize 单个日志文件的最大大小，单位 MB
+	MaxSize int
+	// MaxBackups 保留的旧日志文件的最大个数
+	MaxBackups int
+	// MaxAge 旧日志文件保留的最大天数
+	MaxAge int
+	// Compress 是否使用 gzip 压缩切割后的日志文件
+	Compress bool
+	// SampleMessages 需要采样的日志消息，每秒内相同级别的消息只记录前 SampleInitial 条
+	// 之后每 SampleThereafter 条记录一条，用于过于频繁的日志
+	SampleMessages   []string
+	SampleInitial    int
+	SampleThereafter int
+}
 
-// Log SugaredLogger 一般不需要性能的场景中使用 SugaredLogger
-var Log *zap.SugaredLogger
+// New 根据配置创建 logger
+// 低于 error 级别的日志写入 InfoFile，高于等于 error 级别的日志写入 ErrorFile
+// 日志级别由 Levels 根据 logger 的名字决定
+func New(cfg Config) (*zap.SugaredLogger, error) {
+	levels := cfg.Levels
+	if levels == nil {
+		var err error
+		if levels, err = NewLevels("info", nil); err != nil {
+			return nil, err
+		}
+	}
 
-func InitLogger() {
+	encoder, err := getEncoder(cfg.Encoding)
+	if err != nil {
+		return nil, err
+	}
 
-	// 高于 error level 的进入 error.log 文件
-	highLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
-		return level >= zapcore.ErrorLevel
-	})
+	if !cfg.Stdout && cfg.InfoFile == "" && cfg.ErrorFile == "" {
+		return nil, errors.New("no log output configured")
+	}
 
-	// 小于 error level 并且大于 debug level 的进入 info.log 文件
-	lowLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
-		return level < zapcore.ErrorLevel && level > zapcore.DebugLevel
+	// 高于等于 error level 的进入 error 日志文件
+	highLevel := zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+		return l >= zapcore.ErrorLevel
 	})
 
-	// 创建 WriteSyncer
-	infoFileWriteSyncer := GetInfoWriteSyncer("")
-	errorWriteSyncer := GetErrorWriteSyncer("")
-
-	infoCore := zapcore.NewCore(getEncoder(), zapcore.NewMultiWriteSyncer(infoFileWriteSyncer, os.Stdout), lowLevel)
-	errorCore := zapcore.NewCore(getEncoder(), zapcore.NewMultiWriteSyncer(errorWriteSyncer, os.Stdout), highLevel)
-
-	var coreArr []zapcore.Core
-
-	coreArr = append(coreArr, infoCore)
-	coreArr = append(coreArr, errorCore)
-	//coreArr = append(coreArr, consoleCore)
+	// 小于 error level 的进入 info 日志文件
+	lowLevel := zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+		return l < zapcore.ErrorLevel
+	})
 
-	logger := zap.New(zapcore.NewTee(coreArr...), zap.AddCaller()) // AddCaller() 显示文件名和行号
+	var core zapcore.Core = zapcore.NewTee(
+		zapcore.NewCore(encoder, getWriteSyncer(cfg, cfg.InfoFile), lowLevel),
+		zapcore.NewCore(encoder, getWriteSyncer(cfg, cfg.ErrorFile), highLevel),
+	)
+
+	if len(cfg.SampleMessages) > 0 {
+		messages := make(map[string]struct{}, len(cfg.SampleMessages))
+		for _, msg := range cfg.SampleMessages {
+			messages[msg] = struct{}{}
+		}
+
+		core = &sampledCore{
+			Core:     core,
+			sampled:  zapcore.NewSamplerWithOptions(core, time.Second, cfg.SampleInitial, cfg.SampleThereafter),
+			messages: messages,
+		}
+	}
 
-	Log = logger.Sugar()
+	// 级别过滤放在最外层，被过滤的日志不会进入采样计数
+	core = &levelCore{
+		Core:   core,
+		levels: levels,
+	}
 
-	// 确保日志缓冲区在程序退出时被刷新
-	defer Log.Sync()
+	// AddCaller() 显示文件名和行号
+	return zap.New(core, zap.AddCaller()).Sugar(), nil
 }
 
-func getEncoder() zapcore.Encoder {
+func getEncoder(encoding string) (zapcore.Encoder, error) {
 	encoderConfig := zap.NewProductionEncoderConfig()
 
-	//TimeKey:        "ts",
-	//LevelKey:       "level",
-	//NameKey:        "logger",
-	//CallerKey:      "caller",
-	//FunctionKey:    zapcore.OmitKey,
-	//MessageKey:     "msg",
-	//StacktraceKey:  "stacktrace",
-	//LineEnding:     zapcore.DefaultLineEnding,
-	//EncodeLevel:    zapcore.LowercaseLevelEncoder,
-	//EncodeTime:     zapcore.EpochTimeEncoder,
-	//EncodeDuration: zapcore.SecondsDurationEncoder,
-	//EncodeCaller:   zapcore.ShortCallerEncoder,
-
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
 	// 在日志中使用大写字母记录日志级别
 	// 比如 INFO
 	encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
 
-	// 不同级别的日志显示不同的颜色
-	//encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-
-	return zapcore.NewConsoleEncoder(encoderConfig)
-
-}
-
-func getWriterSyncer(fileName string) zapcore.WriteSyncer {
-
-	lumberWriteSyncer := &lumberjack.Logger{
-		Filename:   "./logs" + fileName,
-		MaxSize:    10, // megabytes
-		MaxBackups: 100,
-		MaxAge:     28,    // days
-		Compress:   false, //Compress确定是否应该使用gzip压缩已旋转的日志文件。默认值是不执行压缩。
+	switch encoding {
+	case "console":
+		return zapcore.NewConsoleEncoder(encoderConfig), nil
+	case "json":
+		return zapcore.NewJSONEncoder(encoderConfig), nil
 	}
 
-	return zapcore.AddSync(lumberWriteSyncer)
-}
-
-func GetMultiWriteSyncer(fileName string) zapcore.WriteSyncer {
-	return zapcore.NewMultiWriteSyncer(getWriterSyncer(fileName), os.Stdout)
+	return nil, fmt.Errorf("unknown log encoding %q", encoding)
 }
 
-func GetInfoWriteSyncer(fileName string) zapcore.WriteSyncer {
-	lumberWriteSyncer := &lumberjack.Logger{
-		Filename:   "./logs/info.log",
-		MaxSize:    10, // megabytes
-		MaxBackups: 100,
-		MaxAge:     28,    // days
-		Compress:   false, //Compress确定是否应该使用gzip压缩已旋转的日志文件。默认值是不执行压缩。
+// getWriteSyncer 返回写入指定文件的 WriteSyncer，按配置同时写入标准输出
+func getWriteSyncer(cfg Config, fileName string) zapcore.WriteSyncer {
+	var syncers []zapcore.WriteSyncer
+
+	if fileName != "" {
+		syncers = append(syncers, zapcore.AddSync(&lumberjack.Logger{
+			Filename:   fileName,
+			MaxSize:    cfg.MaxSize, // megabytes
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge, // days
+			Compress:   cfg.Compress,
+		}))
 	}
 
-	return zapcore.AddSync(lumberWriteSyncer)
-}
-
-func GetErrorWriteSyncer(fileName string) zapcore.WriteSyncer {
-	lumberWriteSyncer := &lumberjack.Logger{
-		Filename:   "./logs/error.log",
-		MaxSize:    10, // megabytes
-		MaxBackups: 100,
-		MaxAge:     28,    // days
-		Compress:   false, //Compress确定是否应该使用gzip压缩已旋转的日志文件。默认值是不执行压缩。
+	if cfg.Stdout {
+		syncers = append(syncers, zapcore.Lock(os.Stdout))
 	}
 
-	return zapcore.AddSync(lumberWriteSyncer)
+	return zapcore.NewMultiWriteSyncer(syncers...)
 }
@@ -0,0 +1,402 @@
+// Package metrics 提供 counter、gauge 和 histogram，并以 Prometheus 文本格式输出
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets 默认的 histogram 桶，单位是秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector 可以输出到 Registry 的指标
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry 保存所有的指标
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]struct{}
+	collectors []collector
+}
+
+// NewRegistry 创建一个空的 Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]struct{}),
+	}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.names[name]; exists {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = struct{}{}
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	cw := countWriter{w: w}
+	bw := bufio.NewWriter(&cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+
+	return cw.n, err
+}
+
+// Handler 返回输出所有指标的 http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// =============================================================================
+
+// vec 按照标签值保存指标的值
+type vec[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	newT   func() *T
+}
+
+func newVec[T any](name string, help string, typ string, labels []string, newT func() *T) *vec[T] {
+	v := vec[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		newT:   newT,
+	}
+
+	// 没有标签的指标从一开始就输出 0
+	if len(labels) == 0 {
+		v.with(nil)
+	}
+
+	return &v
+}
+
+// with 返回标签值对应的指标，不存在时创建
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, exists := v.series[key]
+	if !exists {
+		t = v.newT()
+		v.series[key] = t
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+
+	return t
+}
+
+// each 按照标签值排序后遍历所有的指标
+// 持有锁时复制 series 和 values，遍历时 with 可以继续创建新的指标
+func (v *vec[T]) each(fn func(labelValues []string, t *T)) {
+	type entry struct {
+		key    string
+		values []string
+		t      *T
+	}
+
+	v.mu.Lock()
+	entries := make([]entry, 0, len(v.series))
+	for k, t := range v.series {
+		entries = append(entries, entry{key: k, values: v.values[k], t: t})
+	}
+	v.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, e := range entries {
+		fn(e.values, e.t)
+	}
+}
+
+func (v *vec[T]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// =============================================================================
+
+// value 可以并发修改的 float64
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(d float64) {
+	v.mu.Lock()
+	v.v = d
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter 只能增加的指标
+type Counter struct {
+	vec *vec[value]
+}
+
+// NewCounter 创建 counter 并注册到 Registry
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := Counter{
+		vec: newVec(name, help, "counter", labels, func() *value { return &value{} }),
+	}
+	r.register(name, &c)
+	return &c
+}
+
+// Inc 加 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.vec.with(labelValues).add(1)
+}
+
+// Add 增加 d，d 不能是负数
+func (c *Counter) Add(d float64, labelValues ...string) {
+	if d < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.vec.with(labelValues).add(d)
+}
+
+// Value 返回标签值对应的当前值
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.vec.with(labelValues).get()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.vec.writeHeader(w)
+	c.vec.each(func(labelValues []string, v *value) {
+		writeSample(w, c.vec.name, c.vec.labels, labelValues, "", "", v.get())
+	})
+}
+
+// Gauge 可以增加也可以减少的指标
+type Gauge struct {
+	vec *vec[value]
+}
+
+// NewGauge 创建 gauge 并注册到 Registry
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := Gauge{
+		vec: newVec(name, help, "gauge", labels, func() *value { return &value{} }),
+	}
+	r.register(name, &g)
+	return &g
+}
+
+// Set 设置为 v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.vec.with(labelValues).set(v)
+}
+
+// Add 增加 d，d 可以是负数
+func (g *Gauge) Add(d float64, labelValues ...string) {
+	g.vec.with(labelValues).add(d)
+}
+
+// Inc 加 1
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec 减 1
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value 返回标签值对应的当前值
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.vec.with(labelValues).get()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.vec.writeHeader(w)
+	g.vec.each(func(labelValues []string, v *value) {
+		writeSample(w, g.vec.name, g.vec.labels, labelValues, "", "", v.get())
+	})
+}
+
+// =============================================================================
+
+// histogramValue 一组标签值对应的 histogram 数据
+type histogramValue struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram 统计观测值的分布，比如请求的耗时
+type Histogram struct {
+	vec     *vec[histogramValue]
+	buckets []float64
+}
+
+// NewHistogram 创建 histogram 并注册到 Registry，buckets 为 nil 时使用 DefBuckets
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := Histogram{
+		buckets: buckets,
+	}
+	h.vec = newVec(name, help, "histogram", labels, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(buckets))}
+	})
+	r.register(name, &h)
+	return &h
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	hv := h.vec.with(labelValues)
+
+	// 第一个大于等于 v 的桶
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	if i < len(hv.counts) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.vec.writeHeader(w)
+	h.vec.each(func(labelValues []string, hv *histogramValue) {
+		hv.mu.Lock()
+		counts := append([]uint64(nil), hv.counts...)
+		count := hv.count
+		sum := hv.sum
+		hv.mu.Unlock()
+
+		// 桶是累计的
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += counts[i]
+			writeSample(w, h.vec.name+"_bucket", h.vec.labels, labelValues, "le", formatFloat(b), float64(cumulative))
+		}
+		writeSample(w, h.vec.name+"_bucket", h.vec.labels, labelValues, "le", "+Inf", float64(count))
+		writeSample(w, h.vec.name+"_sum", h.vec.labels, labelValues, "", "", sum)
+		writeSample(w, h.vec.name+"_count", h.vec.labels, labelValues, "", "", float64(count))
+	})
+}
+
+// =============================================================================
+
+// writeSample 输出一行样本，extraName 不为空时追加一个额外的标签，比如 histogram 的 le
+func writeSample(w *bufio.Writer, name string, labels []string, labelValues []string, extraName string, extraValue string, v float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// countWriter 记录写入的字节数
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,167 @@
+package metrics_test
+
+import (
+	"bytes"
+	"github.com/zhangpetergo/chat/chat/foundation/metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	requests := r.NewCounter("requests_total", "Requests handled.", "method", "status")
+	depth := r.NewGauge("queue_depth", "Frames waiting.")
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 0.1, 1}, "route")
+
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(3, "PUT", "500")
+	depth.Add(5)
+	depth.Dec()
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.2, "/a")
+	latency.Observe(2, "/a")
+
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 2
+requests_total{method="PUT",status="500"} 3
+# HELP queue_depth Frames waiting.
+# TYPE queue_depth gauge
+queue_depth 4
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="0.5"} 2
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 2.25
+latency_seconds_count{route="/a"} 3
+`
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("exposition mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d bytes, wrote %d", n, buf.Len())
+	}
+}
+
+func TestExpositionEscaping(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.NewCounter("escaped_total", "Help with a \\ and a\nnewline.", "value")
+	c.Inc("a \"quoted\" \\ value\nwith a newline")
+
+	want := `# HELP escaped_total Help with a \\ and a\nnewline.
+# TYPE escaped_total counter
+escaped_total{value="a \"quoted\" \\ value\nwith a newline"} 1
+`
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("exposition mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("twice_total", "First.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice did not panic")
+		}
+	}()
+	r.NewGauge("twice_total", "Second.")
+}
+
+// TestConcurrentScrape 在创建新的标签值的同时输出指标，需要使用 -race 运行
+func TestConcurrentScrape(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := r.NewCounter("concurrent_total", "Concurrent.", "label")
+	h := r.NewHistogram("concurrent_seconds", "Concurrent.", nil, "label")
+
+	const writers = 4
+	const labels = 500
+
+	// 先开始输出，这样创建标签值和输出一定会重叠
+	stop := make(chan struct{})
+	scraped := make(chan struct{})
+	var scrapes int
+	go func() {
+		defer close(scraped)
+		for {
+			if _, err := r.WriteTo(io.Discard); err != nil {
+				t.Errorf("WriteTo: %v", err)
+				return
+			}
+			scrapes++
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range labels {
+				l := strconv.Itoa(w*labels + i)
+				c.Inc(l)
+				h.Observe(0.1, l)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	<-scraped
+
+	if scrapes == 0 {
+		t.Fatal("no scrape finished")
+	}
+
+	for l := range writers * labels {
+		if got := c.Value(strconv.Itoa(l)); got != 1 {
+			t.Fatalf("label %d: got %v, want 1", l, got)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounter("handler_total", "Handler.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("content type %q, want %q", got, want)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("handler_total 1\n")) {
+		t.Errorf("body does not contain the sample:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,140 @@
+// Package origin 判断浏览器请求的 Origin 是否在允许的列表中，CORS 和 websocket 握手使用同一个列表
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Policy 允许的 Origin 列表，可以在运行时通过 Set 修改，可以并发使用
+//
+// 支持的格式：
+//
+//	https://chat.example.com 完全匹配 scheme 和 host，host 可以带端口
+//	https://*.example.com    匹配 example.com 的任意子域名，不匹配 example.com 本身
+//	*.example.com            没有 scheme 时匹配任意 scheme
+//	"*"                      允许所有来源
+type Policy struct {
+	current atomic.Pointer[[]pattern]
+}
+
+type pattern struct {
+	any    bool
+	scheme string
+	// host 小写的 host，wildcard 为 true 时是去掉 *. 之后的后缀
+	host     string
+	wildcard bool
+}
+
+// New 创建 Policy，列表中有不合法的格式时返回错误
+func New(patterns []string) (*Policy, error) {
+	var p Policy
+	if err := p.Set(patterns); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate 校验列表的格式，不修改任何 Policy
+func Validate(patterns []string) error {
+	_, err := parse(patterns)
+	return err
+}
+
+// Set 替换允许的列表，格式不合法时保持原来的列表
+func (p *Policy) Set(patterns []string) error {
+	ps, err := parse(patterns)
+	if err != nil {
+		return err
+	}
+
+	p.current.Store(&ps)
+	return nil
+}
+
+// AllowAll 列表中包含 *
+func (p *Policy) AllowAll() bool {
+	for _, pt := range *p.current.Load() {
+		if pt.any {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed 判断 origin 是否在允许的列表中，origin 是请求头中的值，比如 https://chat.example.com
+// 浏览器在沙箱等场景下发送的 null 只有在允许所有来源时才允许
+func (p *Policy) Allowed(origin string) bool {
+	patterns := *p.current.Load()
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return p.AllowAll()
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+
+	for _, pt := range patterns {
+		if pt.match(scheme, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pt pattern) match(scheme, host string) bool {
+	if pt.any {
+		return true
+	}
+
+	if pt.scheme != "" && pt.scheme != scheme {
+		return false
+	}
+
+	if pt.wildcard {
+		return strings.HasSuffix(host, "."+pt.host)
+	}
+
+	return host == pt.host
+}
+
+func parse(patterns []string) ([]pattern, error) {
+	ps := make([]pattern, 0, len(patterns))
+
+	for _, s := range patterns {
+		s = strings.ToLower(strings.TrimSpace(s))
+
+		if s == "*" {
+			ps = append(ps, pattern{any: true})
+			continue
+		}
+
+		var pt pattern
+		host := s
+		if scheme, rest, ok := strings.Cut(s, "://"); ok {
+			if scheme == "" {
+				return nil, fmt.Errorf("origin %q: missing scheme", s)
+			}
+			pt.scheme = scheme
+			host = rest
+		}
+
+		if wild, ok := strings.CutPrefix(host, "*."); ok {
+			pt.wildcard = true
+			host = wild
+		}
+
+		if host == "" || strings.ContainsAny(host, "*/?#@ ") {
+			return nil, fmt.Errorf("origin %q: want *, scheme://host[:port] or [scheme://]*.domain", s)
+		}
+
+		pt.host = host
+		ps = append(ps, pt)
+	}
+
+	return ps, nil
+}
@@ -0,0 +1,96 @@
+package origin_test
+
+import (
+	"github.com/zhangpetergo/chat/chat/foundation/origin"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		origin   string
+		want     bool
+	}{
+		{"exact", []string{"https://chat.example.com"}, "https://chat.example.com", true},
+		{"exact case insensitive", []string{"https://chat.example.com"}, "HTTPS://Chat.Example.COM", true},
+		{"exact other host", []string{"https://chat.example.com"}, "https://evil.example.com", false},
+		{"exact scheme mismatch", []string{"https://chat.example.com"}, "http://chat.example.com", false},
+		{"exact suffix is not a subdomain", []string{"https://example.com"}, "https://evilexample.com", false},
+
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://chat.example.com", true},
+		{"wildcard nested subdomain", []string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard apex", []string{"https://*.example.com"}, "https://example.com", false},
+		{"wildcard scheme mismatch", []string{"https://*.example.com"}, "http://chat.example.com", false},
+		{"wildcard lookalike", []string{"https://*.example.com"}, "https://chat.evilexample.com", false},
+		{"wildcard other domain", []string{"https://*.example.com"}, "https://example.com.evil.net", false},
+		{"wildcard without scheme", []string{"*.example.com"}, "http://chat.example.com", true},
+		// host 包含端口，通配符只匹配默认端口
+		{"wildcard with port", []string{"https://*.example.com"}, "https://chat.example.com:8443", false},
+
+		{"explicit port", []string{"http://localhost:3000"}, "http://localhost:3000", true},
+		{"explicit port mismatch", []string{"http://localhost:3000"}, "http://localhost:3001", false},
+		{"explicit port missing", []string{"http://localhost:3000"}, "http://localhost", false},
+		{"no port in pattern", []string{"http://localhost"}, "http://localhost:3000", false},
+
+		{"null", []string{"https://*.example.com"}, "null", false},
+		{"null allowed by any", []string{"*"}, "null", true},
+		{"any", []string{"*"}, "https://anything.test", true},
+		{"malformed", []string{"https://chat.example.com"}, "chat.example.com", false},
+		{"empty list", nil, "https://chat.example.com", false},
+		{"second pattern", []string{"https://a.test", "https://*.example.com"}, "https://chat.example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := origin.New(tt.patterns)
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+
+			if got := p.Allowed(tt.origin); got != tt.want {
+				t.Errorf("Allowed(%q) with %q: got %v, want %v", tt.origin, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"*", true},
+		{"https://chat.example.com", true},
+		{"https://chat.example.com:8443", true},
+		{"https://*.example.com", true},
+		{"*.example.com", true},
+		{"://example.com", false},
+		{"https://", false},
+		{"https://*", false},
+		{"https://a.*.example.com", false},
+		{"https://example.com/path", false},
+		{"https://user@example.com", false},
+	}
+
+	for _, tt := range tests {
+		err := origin.Validate([]string{tt.pattern})
+		if (err == nil) != tt.valid {
+			t.Errorf("Validate(%q): got %v, want valid %v", tt.pattern, err, tt.valid)
+		}
+	}
+}
+
+func TestSetKeepsPreviousOnError(t *testing.T) {
+	p, err := origin.New([]string{"https://chat.example.com"})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	if err := p.Set([]string{"https://ok.example.com", "https://"}); err == nil {
+		t.Fatal("set: expected an error")
+	}
+	if !p.Allowed("https://chat.example.com") || p.Allowed("https://ok.example.com") {
+		t.Error("set: the previous list was not kept")
+	}
+}
@@ -0,0 +1,180 @@
+// Package rate 提供令牌桶限流
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶，每秒补充 rate 个令牌，桶的容量为 burst
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter 创建一个装满令牌的令牌桶
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow 尝试取出一个令牌，桶为空时返回 false
+func (l *Limiter) Allow() bool {
+	return l.AllowAt(time.Now())
+}
+
+// AllowAt 与 Allow 相同，但是使用传入的时间计算补充的令牌
+func (l *Limiter) AllowAt(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
+
+// RetryAfterAt 返回从 now 开始还需要等待多久才有一个令牌，有令牌时返回 0
+func (l *Limiter) RetryAfterAt(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+
+	if l.tokens >= 1 || l.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// SetLimit 修改补充令牌的速度和桶的容量，已有的令牌超过新的容量时会被丢弃
+func (l *Limiter) SetLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = float64(burst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// refill 根据距离上次取令牌的时间补充令牌，调用方需要持有锁
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return
+	}
+	l.last = now
+
+	l.tokens += elapsed.Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// full 判断令牌桶是否已经补满，补满的令牌桶可以被回收
+func (l *Limiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(now)
+	return l.tokens >= l.burst
+}
+
+// =============================================================================
+
+// Keyed 按照 key 维护一组令牌桶，比如按照 IP 或者用户 ID 限流
+type Keyed struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    int
+	limiters map[string]*Limiter
+	lastGC   time.Time
+}
+
+// NewKeyed 创建按 key 限流的令牌桶集合
+func NewKeyed(rate float64, burst int) *Keyed {
+	return &Keyed{
+		rate:     rate,
+		burst:    burst,
+		limiters: make(map[string]*Limiter),
+		lastGC:   time.Now(),
+	}
+}
+
+// Allow 尝试为 key 取出一个令牌
+func (k *Keyed) Allow(key string) bool {
+	return k.AllowAt(key, time.Now())
+}
+
+// AllowAt 与 Allow 相同，但是使用传入的时间计算补充的令牌
+func (k *Keyed) AllowAt(key string, now time.Time) bool {
+	k.mu.Lock()
+	// 先回收再查找，否则刚取出的令牌桶可能被回收，下一次调用会得到一个新的装满的令牌桶
+	k.gc(now)
+	l, exists := k.limiters[key]
+	if !exists {
+		l = NewLimiter(k.rate, k.burst)
+		l.last = now
+		k.limiters[key] = l
+	}
+	k.mu.Unlock()
+
+	return l.AllowAt(now)
+}
+
+// RetryAfter 返回 key 还需要等待多久才有一个令牌，用于设置 Retry-After
+func (k *Keyed) RetryAfter(key string) time.Duration {
+	return k.RetryAfterAt(key, time.Now())
+}
+
+// RetryAfterAt 与 RetryAfter 相同，但是使用传入的时间计算补充的令牌
+func (k *Keyed) RetryAfterAt(key string, now time.Time) time.Duration {
+	k.mu.Lock()
+	l, exists := k.limiters[key]
+	k.mu.Unlock()
+
+	if !exists {
+		return 0
+	}
+
+	return l.RetryAfterAt(now)
+}
+
+// SetLimit 修改所有令牌桶的速度和容量，之后创建的令牌桶也使用新的限制
+func (k *Keyed) SetLimit(rate float64, burst int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.rate = rate
+	k.burst = burst
+
+	for _, l := range k.limiters {
+		l.SetLimit(rate, burst)
+	}
+}
+
+// gc 每分钟清理一次已经补满的令牌桶，避免 map 无限增长，调用方需要持有锁
+func (k *Keyed) gc(now time.Time) {
+	if now.Sub(k.lastGC) < time.Minute {
+		return
+	}
+	k.lastGC = now
+
+	for key, l := range k.limiters {
+		if l.full(now) {
+			delete(k.limiters, key)
+		}
+	}
+}
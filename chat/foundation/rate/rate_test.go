@@ -0,0 +1,40 @@
+package rate_test
+
+import (
+	"github.com/zhangpetergo/chat/chat/foundation/rate"
+	"testing"
+	"time"
+)
+
+func TestKeyedGCKeepsCurrentBucket(t *testing.T) {
+	k := rate.NewKeyed(0.001, 1)
+
+	// 超过一分钟后的第一次调用会触发回收，新建的令牌桶是满的，不能在取出令牌之后被回收
+	now := time.Now().Add(2 * time.Minute)
+	if !k.AllowAt("alice", now) {
+		t.Fatal("first call: got denied, want allowed")
+	}
+	if k.AllowAt("alice", now) {
+		t.Fatal("second call: got allowed, want denied")
+	}
+	if d := k.RetryAfterAt("alice", now); d <= 0 {
+		t.Errorf("retry after: got %s, want positive", d)
+	}
+}
+
+func TestKeyedGCRemovesFullBuckets(t *testing.T) {
+	k := rate.NewKeyed(1, 1)
+
+	now := time.Now()
+	k.AllowAt("alice", now)
+	if d := k.RetryAfterAt("alice", now); d <= 0 {
+		t.Fatalf("retry after: got %s, want positive", d)
+	}
+
+	// 一分钟后 alice 的令牌桶已经补满，bob 的调用触发回收
+	later := now.Add(2 * time.Minute)
+	k.AllowAt("bob", later)
+	if !k.AllowAt("alice", later) {
+		t.Error("alice after gc: got denied, want allowed")
+	}
+}
@@ -0,0 +1,260 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter 把一批 span 发送到追踪后端
+type Exporter interface {
+	Export(service string, spans []SpanData) error
+}
+
+// =============================================================================
+
+// StdoutExporter 每个 span 输出一行 JSON
+type StdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter 创建输出到 w 的导出器
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{
+		w: w,
+	}
+}
+
+type stdoutSpan struct {
+	Service    string         `json:"service"`
+	Name       string         `json:"name"`
+	Kind       Kind           `json:"kind"`
+	TraceID    string         `json:"traceID"`
+	SpanID     string         `json:"spanID"`
+	ParentID   string         `json:"parentID,omitempty"`
+	Links      []string       `json:"links,omitempty"`
+	Start      time.Time      `json:"start"`
+	Duration   string         `json:"duration"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Export 实现 Exporter 接口
+func (e *StdoutExporter) Export(service string, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		out := stdoutSpan{
+			Service:    service,
+			Name:       s.Name,
+			Kind:       s.Kind,
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Start:      s.Start,
+			Duration:   s.End.Sub(s.Start).String(),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.Parent.IsValid() {
+			out.ParentID = s.Parent.String()
+		}
+		for _, l := range s.Links {
+			out.Links = append(out.Links, l.Traceparent())
+		}
+
+		if err := enc.Encode(out); err != nil {
+			return fmt.Errorf("encode span: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// OTLPExporter 使用 OTLP/HTTP JSON 协议把 span 发送到 collector
+// 任何实现了 POST /v1/traces 的本地替身都可以代替 collector
+type OTLPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter 创建 OTLP 导出器，endpoint 例如 http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string, headers map[string]string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Export 实现 Exporter 接口
+func (e *OTLPExporter) Export(service string, spans []SpanData) error {
+	data, err := json.Marshal(otlpRequest(service, spans))
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// 下面的结构对应 OTLP 的 JSON 编码，trace-id 和 span-id 使用十六进制
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpRequest(service string, spans []SpanData) otlpTraces {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", service)}
+
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/zhangpetergo/chat"
+
+	for _, s := range spans {
+		os := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent.IsValid() {
+			os.ParentSpanID = s.Parent.String()
+		}
+
+		// 属性按照 key 排序，保证输出稳定
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			os.Attributes = append(os.Attributes, otlpAttribute(k, s.Attributes[k]))
+		}
+
+		for _, l := range s.Links {
+			os.Links = append(os.Links, otlpLink{TraceID: l.TraceID.String(), SpanID: l.SpanID.String()})
+		}
+
+		// 1 表示成功，2 表示失败
+		os.Status.Code = 1
+		if s.Error != "" {
+			os.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+
+		ss.Spans = append(ss.Spans, os)
+	}
+
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func otlpAttribute(key string, v any) otlpKeyValue {
+	var av otlpAnyValue
+
+	switch v := v.(type) {
+	case string:
+		av.StringValue = &v
+	case bool:
+		av.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		av.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		av.IntValue = &s
+	case float64:
+		av.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		av.StringValue = &s
+	}
+
+	return otlpKeyValue{Key: key, Value: av}
+}
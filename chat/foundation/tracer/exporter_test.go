@@ -0,0 +1,181 @@
+package tracer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spanData 返回一个有父 span、关联、属性和错误的 span
+func spanData(t *testing.T) tracer.SpanData {
+	t.Helper()
+
+	parent, err := tracer.ParseTraceparent("00-" + traceID + "-" + spanID + "-01")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	link, err := tracer.ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	return tracer.SpanData{
+		Name:    "chat.route",
+		Kind:    tracer.KindProducer,
+		Context: tracer.SpanContext{TraceID: parent.TraceID, SpanID: tracer.SpanID{1, 2, 3, 4, 5, 6, 7, 8}, Sampled: true},
+		Parent:  parent.SpanID,
+		Links:   []tracer.SpanContext{link},
+		Start:   start,
+		End:     start.Add(1500 * time.Microsecond),
+		Attributes: map[string]any{
+			"chat.to":    "bob",
+			"chat.bytes": 42,
+			"chat.muted": false,
+			"chat.score": 0.5,
+		},
+		Error: "user not connected",
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exp := tracer.NewStdoutExporter(&buf)
+
+	root := tracer.SpanData{Name: "root", Kind: tracer.KindServer, Context: spanData(t).Context}
+	if err := exp.Export("chat", []tracer.SpanData{spanData(t), root}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	// 每个 span 一行
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf.String())
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	want := map[string]any{
+		"service":  "chat",
+		"name":     "chat.route",
+		"kind":     float64(tracer.KindProducer),
+		"traceID":  traceID,
+		"spanID":   "0102030405060708",
+		"parentID": spanID,
+		"links":    []any{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"start":    "2024-01-02T03:04:05Z",
+		"duration": "1.5ms",
+		"attributes": map[string]any{
+			"chat.to":    "bob",
+			"chat.bytes": float64(42),
+			"chat.muted": false,
+			"chat.score": 0.5,
+		},
+		"error": "user not connected",
+	}
+	if g, w := marshal(t, got), marshal(t, want); g != w {
+		t.Errorf("span:\n got %s\nwant %s", g, w)
+	}
+
+	// 没有父 span、关联、属性和错误时省略这些字段
+	var rootOut map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &rootOut); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	for _, k := range []string{"parentID", "links", "attributes", "error"} {
+		if v, exists := rootOut[k]; exists {
+			t.Errorf("root: got %s %v, want omitted", k, v)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	type request struct {
+		method  string
+		ctype   string
+		auth    string
+		body    []byte
+		readErr error
+	}
+	reqs := make(chan request, 1)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		reqs <- request{
+			method:  r.Method,
+			ctype:   r.Header.Get("Content-Type"),
+			auth:    r.Header.Get("Authorization"),
+			body:    body,
+			readErr: err,
+		}
+	}))
+	defer collector.Close()
+
+	exp := tracer.NewOTLPExporter(collector.URL+"/v1/traces", map[string]string{"Authorization": "Bearer secret"}, time.Second)
+
+	data := spanData(t)
+	ok := tracer.SpanData{Name: "root", Kind: tracer.KindServer, Context: data.Context, Start: data.Start, End: data.End}
+	if err := exp.Export("chat", []tracer.SpanData{data, ok}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	r := <-reqs
+	if r.readErr != nil {
+		t.Fatalf("read body: %v", r.readErr)
+	}
+	if r.method != http.MethodPost || r.ctype != "application/json" || r.auth != "Bearer secret" {
+		t.Errorf("got %s Content-Type %q Authorization %q", r.method, r.ctype, r.auth)
+	}
+
+	want := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"chat"}}]},"scopeSpans":[{"scope":{"name":"github.com/zhangpetergo/chat"},"spans":[` +
+		`{"traceId":"` + traceID + `","spanId":"0102030405060708","parentSpanId":"` + spanID + `","name":"chat.route","kind":4,` +
+		`"startTimeUnixNano":"1704164645000000000","endTimeUnixNano":"1704164645001500000",` +
+		// 属性按照 key 排序
+		`"attributes":[{"key":"chat.bytes","value":{"intValue":"42"}},{"key":"chat.muted","value":{"boolValue":false}},{"key":"chat.score","value":{"doubleValue":0.5}},{"key":"chat.to","value":{"stringValue":"bob"}}],` +
+		`"links":[{"traceId":"0af7651916cd43dd8448eb211c80319c","spanId":"b7ad6b7169203331"}],` +
+		`"status":{"code":2,"message":"user not connected"}},` +
+		// 没有父 span、属性和关联时省略这些字段
+		`{"traceId":"` + traceID + `","spanId":"0102030405060708","name":"root","kind":2,` +
+		`"startTimeUnixNano":"1704164645000000000","endTimeUnixNano":"1704164645001500000","status":{"code":1}}` +
+		`]}]}]}`
+	if got := string(r.body); got != want {
+		t.Errorf("body:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestOTLPExporterStatus(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	exp := tracer.NewOTLPExporter(collector.URL, nil, time.Second)
+	err := exp.Export("chat", []tracer.SpanData{spanData(t)})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want the collector status", err)
+	}
+
+	if err := tracer.NewOTLPExporter("http://127.0.0.1:0", nil, time.Second).Export("chat", nil); err == nil {
+		t.Error("unreachable collector: got no error")
+	}
+}
+
+func marshal(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(b)
+}
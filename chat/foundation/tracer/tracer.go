@@ -0,0 +1,553 @@
+// Package tracer 提供兼容 W3C Trace Context 的分布式追踪
+package tracer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID W3C Trace Context 中的 trace-id，16 字节
+type TraceID [16]byte
+
+// String 返回 32 位小写十六进制
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid trace-id 不能全为 0
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// SpanID W3C Trace Context 中的 parent-id，8 字节
+type SpanID [8]byte
+
+// String 返回 16 位小写十六进制
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid span-id 不能全为 0
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext 在进程之间传递的追踪上下文
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid trace-id 和 span-id 都不为 0
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent 返回 traceparent 请求头的值
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ErrInvalidTraceparent traceparent 的格式不正确
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent 解析 traceparent 请求头，格式为 version-traceid-parentid-flags
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	// 版本 ff 是非法的，版本 00 只能有 4 个部分
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	// 规范只允许小写的十六进制
+	for _, p := range parts[:4] {
+		if !isLowerHex(p) {
+			return SpanContext{}, ErrInvalidTraceparent
+		}
+	}
+
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	return sc, nil
+}
+
+// =============================================================================
+
+// Kind span 的类型，和 OTLP 中的定义一致
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+	KindProducer Kind = 4
+	KindConsumer Kind = 5
+)
+
+// Span 一次操作的追踪记录
+type Span struct {
+	tracer *Tracer
+
+	mu       sync.Mutex
+	name     string
+	kind     Kind
+	sc       SpanContext
+	parent   SpanID
+	links    []SpanContext
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	errMsg   string
+	finished bool
+}
+
+// SpanData 导出器使用的 span 数据
+type SpanData struct {
+	Name       string
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanID
+	Links      []SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	// Error 不为空时表示操作失败
+	Error string
+}
+
+// Context 返回 span 的追踪上下文，nil span 返回空值
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes 以 key/value 的形式添加属性
+func (s *Span) SetAttributes(kv ...any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		s.attrs[key] = kv[i+1]
+	}
+}
+
+// SetError 记录操作失败的原因
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errMsg = err.Error()
+}
+
+// AddLink 关联另一个 trace 中的 span，比如接收者的投递关联发送者的消息
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.links = append(s.links, sc)
+}
+
+// End 结束 span，采样的 span 会交给导出器
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.end = time.Now()
+
+	attrs := make(map[string]any, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs[k] = v
+	}
+
+	data := SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		Context:    s.sc,
+		Parent:     s.parent,
+		Links:      append([]SpanContext(nil), s.links...),
+		Start:      s.start,
+		End:        s.end,
+		Attributes: attrs,
+		Error:      s.errMsg,
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+// =============================================================================
+
+type ctxKey int
+
+const spanKey ctxKey = 1
+
+// ContextWithSpan 把 span 放入 context，后续创建的 span 会成为它的子 span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// SpanFromContext 返回 context 中的 span，不存在时返回 nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// =============================================================================
+
+// Option 创建 span 时的选项
+type Option func(*spanOptions)
+
+type spanOptions struct {
+	kind    Kind
+	parent  SpanContext
+	traceID TraceID
+	attrs   []any
+}
+
+// WithKind 设置 span 的类型
+func WithKind(kind Kind) Option {
+	return func(o *spanOptions) {
+		o.kind = kind
+	}
+}
+
+// WithParent 使用远程的追踪上下文作为父 span，比如来自 traceparent 请求头或者消息信封
+func WithParent(sc SpanContext) Option {
+	return func(o *spanOptions) {
+		o.parent = sc
+	}
+}
+
+// WithTraceID 没有父 span 时使用指定的 trace-id，比如来自 X-Request-ID 请求头
+func WithTraceID(id TraceID) Option {
+	return func(o *spanOptions) {
+		o.traceID = id
+	}
+}
+
+// WithAttributes 以 key/value 的形式添加属性
+func WithAttributes(kv ...any) Option {
+	return func(o *spanOptions) {
+		o.attrs = append(o.attrs, kv...)
+	}
+}
+
+// Config 追踪的配置
+type Config struct {
+	// ServiceName 导出时使用的服务名称
+	ServiceName string
+	// Probability 没有父 span 时的采样概率，取值 0 到 1
+	Probability float64
+	// Exporter 为 nil 时不导出任何 span，但是仍然传播追踪上下文
+	Exporter Exporter
+	// BatchSize 每次导出的最大 span 数量
+	BatchSize int
+	// QueueSize 等待导出的最大 span 数量，队列满时丢弃新的 span
+	QueueSize int
+	// FlushInterval 定时导出的间隔
+	FlushInterval time.Duration
+}
+
+// Tracer 创建 span 并在后台批量导出
+type Tracer struct {
+	cfg    Config
+	queue  chan SpanData
+	flush  chan chan struct{}
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// New 创建 Tracer，并启动后台导出的 goroutine
+func New(cfg Config) *Tracer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 2048
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+
+	t := Tracer{
+		cfg:   cfg,
+		queue: make(chan SpanData, cfg.QueueSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.run()
+
+	return &t
+}
+
+// Start 创建一个新的 span，父 span 来自 WithParent 或者 context
+// nil Tracer 也可以调用，返回的 span 只传播追踪上下文
+func (t *Tracer) Start(ctx context.Context, name string, opts ...Option) (context.Context, *Span) {
+	o := spanOptions{
+		kind: KindInternal,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	parent := o.parent
+	if !parent.IsValid() {
+		parent = SpanFromContext(ctx).Context()
+	}
+
+	span := Span{
+		tracer: t,
+		name:   name,
+		kind:   o.kind,
+		start:  time.Now(),
+		attrs:  make(map[string]any),
+	}
+
+	switch {
+	case parent.IsValid():
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+
+	case o.traceID.IsValid():
+		span.sc.TraceID = o.traceID
+		span.sc.Sampled = t.sample(span.sc.TraceID)
+
+	default:
+		span.sc.TraceID = newTraceID()
+		span.sc.Sampled = t.sample(span.sc.TraceID)
+	}
+	span.sc.SpanID = newSpanID()
+
+	span.SetAttributes(o.attrs...)
+
+	return ContextWithSpan(ctx, &span), &span
+}
+
+// Shutdown 导出所有剩余的 span 并停止后台 goroutine
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.closed.Do(func() {
+		close(t.done)
+	})
+
+	ch := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(ch)
+	}()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush 立即导出所有等待中的 span
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	ch := make(chan struct{})
+	select {
+	case t.flush <- ch:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sample 按照 trace-id 的低 8 字节决定是否采样，同一个 trace 的结果相同
+func (t *Tracer) sample(id TraceID) bool {
+	if t == nil || t.cfg.Exporter == nil {
+		return false
+	}
+
+	switch {
+	case t.cfg.Probability >= 1:
+		return true
+	case t.cfg.Probability <= 0:
+		return false
+	}
+
+	v := binary.BigEndian.Uint64(id[8:]) >> 1
+	return v < uint64(t.cfg.Probability*float64(math.MaxInt64))
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	if t == nil || t.cfg.Exporter == nil {
+		return
+	}
+
+	select {
+	case t.queue <- data:
+	default:
+		// 队列满时丢弃，不能阻塞业务代码
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.cfg.BatchSize)
+
+	export := func() {
+		if len(batch) == 0 || t.cfg.Exporter == nil {
+			batch = batch[:0]
+			return
+		}
+		// 导出失败只能丢弃，追踪数据不影响业务
+		t.cfg.Exporter.Export(t.cfg.ServiceName, batch)
+		batch = make([]SpanData, 0, t.cfg.BatchSize)
+	}
+
+	drain := func() {
+		for {
+			select {
+			case data := <-t.queue:
+				batch = append(batch, data)
+				if len(batch) >= t.cfg.BatchSize {
+					export()
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case data := <-t.queue:
+			batch = append(batch, data)
+			if len(batch) >= t.cfg.BatchSize {
+				export()
+			}
+
+		case <-ticker.C:
+			export()
+
+		case ch := <-t.flush:
+			drain()
+			export()
+			close(ch)
+
+		case <-t.done:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+// =============================================================================
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,183 @@
+package tracer_test
+
+import (
+	"context"
+	"errors"
+	"github.com/zhangpetergo/chat/chat/foundation/tracer"
+	"sync"
+	"testing"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+// memoryExporter 把导出的 span 保存在内存中
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []tracer.SpanData
+}
+
+func (e *memoryExporter) Export(service string, spans []tracer.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// newTracer 创建采样所有 span 的 Tracer，返回的函数导出等待中的 span 并返回所有已导出的 span
+func newTracer(t *testing.T) (*tracer.Tracer, func() []tracer.SpanData) {
+	t.Helper()
+
+	var exp memoryExporter
+	tr := tracer.New(tracer.Config{
+		ServiceName: "test",
+		Probability: 1,
+		Exporter:    &exp,
+	})
+	t.Cleanup(func() {
+		tr.Shutdown(context.Background())
+	})
+
+	spans := func() []tracer.SpanData {
+		t.Helper()
+
+		if err := tr.Flush(context.Background()); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+
+		exp.mu.Lock()
+		defer exp.mu.Unlock()
+		return append([]tracer.SpanData(nil), exp.spans...)
+	}
+
+	return tr, spans
+}
+
+// =============================================================================
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"surrounding spaces", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"version 00 with extra fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		// 未来的版本可以有更多的部分
+		{"future version with extra fields", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"future version", "cc-" + traceID + "-" + spanID + "-01", true, true},
+
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+
+		{"uppercase trace id", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"uppercase span id", "00-" + traceID + "-00F067AA0BA902B7-01", false, false},
+		{"uppercase version", "0A-" + traceID + "-" + spanID + "-01", false, false},
+		{"uppercase flags", "00-" + traceID + "-" + spanID + "-0B", false, false},
+
+		{"empty", "", false, false},
+		{"too few fields", "00-" + traceID + "-" + spanID, false, false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e473-" + spanID + "-01", false, false},
+		{"short span id", "00-" + traceID + "-00f067aa0ba902b-01", false, false},
+		{"not hex", "00-" + traceID + "-00f067aa0ba902bz-01", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := tracer.ParseTraceparent(tt.in)
+
+			if !tt.valid {
+				if !errors.Is(err, tracer.ErrInvalidTraceparent) {
+					t.Fatalf("got %v %v, want ErrInvalidTraceparent", sc, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID || sc.Sampled != tt.sampled {
+				t.Errorf("got %s %s sampled %v", sc.TraceID, sc.SpanID, sc.Sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	in := "00-" + traceID + "-" + spanID + "-01"
+
+	sc, err := tracer.ParseTraceparent(in)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := sc.Traceparent(); got != in {
+		t.Errorf("got %s, want %s", got, in)
+	}
+
+	if got := (tracer.SpanContext{}).Traceparent(); got != "" {
+		t.Errorf("invalid context: got %q, want empty", got)
+	}
+}
+
+func TestStartParent(t *testing.T) {
+	tr, spans := newTracer(t)
+
+	ctx, root := tr.Start(context.Background(), "root")
+	_, child := tr.Start(ctx, "child", tracer.WithKind(tracer.KindClient))
+	child.End()
+	root.End()
+
+	// 远程的父 span 优先于 context 中的 span
+	remote, _ := tracer.ParseTraceparent("00-" + traceID + "-" + spanID + "-01")
+	_, fromRemote := tr.Start(ctx, "remote", tracer.WithParent(remote))
+	fromRemote.End()
+
+	got := spans()
+	if len(got) != 3 {
+		t.Fatalf("got %d spans, want 3", len(got))
+	}
+
+	c, r, rem := got[0], got[1], got[2]
+	if r.Parent.IsValid() {
+		t.Errorf("root: got parent %s, want none", r.Parent)
+	}
+	if c.Context.TraceID != r.Context.TraceID || c.Parent != r.Context.SpanID || c.Kind != tracer.KindClient {
+		t.Errorf("child: got trace %s parent %s kind %d, want trace %s parent %s", c.Context.TraceID, c.Parent, c.Kind, r.Context.TraceID, r.Context.SpanID)
+	}
+	if rem.Context.TraceID.String() != traceID || rem.Parent.String() != spanID {
+		t.Errorf("remote: got trace %s parent %s", rem.Context.TraceID, rem.Parent)
+	}
+}
+
+func TestNotSampled(t *testing.T) {
+	tr, spans := newTracer(t)
+
+	// 父 span 没有采样时子 span 也不采样，但是仍然传播追踪上下文
+	remote, _ := tracer.ParseTraceparent("00-" + traceID + "-" + spanID + "-00")
+	_, span := tr.Start(context.Background(), "child", tracer.WithParent(remote))
+	span.End()
+
+	if sc := span.Context(); !sc.IsValid() || sc.Sampled || sc.TraceID.String() != traceID {
+		t.Errorf("got context %v", sc)
+	}
+	if got := spans(); len(got) != 0 {
+		t.Errorf("got %d spans, want none", len(got))
+	}
+
+	// nil Tracer 的 span 也能传播追踪上下文
+	var nilTracer *tracer.Tracer
+	_, span = nilTracer.Start(context.Background(), "nil", tracer.WithParent(remote))
+	span.End()
+	if sc := span.Context(); sc.TraceID.String() != traceID || sc.Sampled {
+		t.Errorf("nil tracer: got context %v", sc)
+	}
+}
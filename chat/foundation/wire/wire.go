@@ -0,0 +1,138 @@
+// Package wire 提供 websocket 帧使用的 JSON、MessagePack 和 CBOR 编码，服务端和客户端使用同一份实现
+//
+// 二进制编码先把值按 json 的规则转换为 map、slice 和基本类型再编码，所以字段名和类型与 JSON 完全相同：
+// uuid、时间和错误码都是字符串，同一套带 json 标签的模型可以用于所有编码
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+// Codec 一种编码，Binary 为 true 时使用二进制帧，否则使用文本帧
+type Codec struct {
+	Name      string
+	Binary    bool
+	Marshal   func(v any) ([]byte, error)
+	Unmarshal func(data []byte, v any) error
+}
+
+// JSON 使用文本帧的 JSON 编码
+var JSON = Codec{
+	Name:      "json",
+	Marshal:   json.Marshal,
+	Unmarshal: json.Unmarshal,
+}
+
+// Msgpack 使用二进制帧的 MessagePack 编码
+var Msgpack = binary("msgpack", func() codec.Handle {
+	var h codec.MsgpackHandle
+	// 使用新版的格式，区分 str 和 bin
+	h.WriteExt = true
+	h.RawToString = true
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	return &h
+}())
+
+// CBOR 使用二进制帧的 CBOR 编码
+var CBOR = binary("cbor", func() codec.Handle {
+	var h codec.CborHandle
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	return &h
+}())
+
+// Lookup 按名字返回编码，名字是 json、msgpack 或者 cbor
+func Lookup(name string) (Codec, bool) {
+	switch name {
+	case JSON.Name:
+		return JSON, true
+	case Msgpack.Name:
+		return Msgpack, true
+	case CBOR.Name:
+		return CBOR, true
+	}
+	return Codec{}, false
+}
+
+func binary(name string, h codec.Handle) Codec {
+	return Codec{
+		Name:   name,
+		Binary: true,
+		Marshal: func(v any) ([]byte, error) {
+			g, err := toGeneric(v)
+			if err != nil {
+				return nil, err
+			}
+
+			var data []byte
+			if err := codec.NewEncoderBytes(&data, h).Encode(g); err != nil {
+				return nil, fmt.Errorf("%s encode: %w", name, err)
+			}
+			return data, nil
+		},
+		Unmarshal: func(data []byte, v any) error {
+			var g any
+			if err := codec.NewDecoderBytes(data, h).Decode(&g); err != nil {
+				return fmt.Errorf("%s decode: %w", name, err)
+			}
+			return fromGeneric(g, v)
+		},
+	}
+}
+
+// =============================================================================
+
+// toGeneric 把 v 按 json 的规则转换为 map[string]any、[]any 和基本类型
+// 整数转换为 int64，避免在二进制编码中变成浮点数
+func toGeneric(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var g any
+	if err := d.Decode(&g); err != nil {
+		return nil, err
+	}
+
+	return numbers(g), nil
+}
+
+func numbers(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = numbers(e)
+		}
+		return v
+	case []any:
+		for i, e := range v {
+			v[i] = numbers(e)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// fromGeneric 把二进制解码后的值按 json 的规则放入 v
+func fromGeneric(g any, v any) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("convert %T: %w", g, err)
+	}
+
+	return json.Unmarshal(data, v)
+}